@@ -0,0 +1,65 @@
+/*
+Repairdb removes rows left dangling by older versions of the web API: followers, likes, comments and bans that point
+to users or photos that do not exist anymore, and users following or banning themselves.
+
+Usage:
+
+	repairdb [flags]
+
+The flags are:
+
+	-db <path>
+		Path of the SQLite database file (default: /tmp/decaf.db, the same default as webapi).
+
+Return values (exit codes):
+
+	0
+		The database was repaired (or there was nothing to repair)
+
+	> 0
+		The database could not be opened or repaired
+*/
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func main() {
+	var filename = flag.String("db", "/tmp/decaf.db", "SQLite database file")
+
+	flag.Parse()
+
+	if err := run(*filename); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "error: ", err)
+		os.Exit(1)
+	}
+}
+
+func run(filename string) error {
+	dbconn, err := sql.Open("sqlite3", database.DataSourceName(filename))
+	if err != nil {
+		return fmt.Errorf("opening SQLite: %w", err)
+	}
+	defer func() { _ = dbconn.Close() }()
+
+	db, err := database.New(dbconn)
+	if err != nil {
+		return fmt.Errorf("creating AppDatabase: %w", err)
+	}
+
+	report, err := db.RepairDanglingRows()
+	if err != nil {
+		return fmt.Errorf("repairing database: %w", err)
+	}
+
+	fmt.Printf("removed %d followers, %d likes, %d comments, %d bans\n", //nolint:forbidigo
+		report.Followers, report.Likes, report.Comments, report.Bans)
+	return nil
+}
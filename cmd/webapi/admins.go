@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/sirupsen/logrus"
+)
+
+// promoteAdmins makes administrators of the users with the given usernames. Unknown users are reported and skipped,
+// so that the administrators can be listed before they sign up: they are promoted at the next start. Users without a
+// password or a linked identity are refused, since anybody could claim their name, or use their ID as a legacy token.
+func promoteAdmins(db database.AppDatabase, usernames []string, logger logrus.FieldLogger) {
+	for _, name := range usernames {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		user, err := db.GetUserByUsername(name)
+		if err != nil {
+			logger.WithError(err).Errorf("error looking up administrator %s", name)
+			continue
+		} else if user == nil {
+			logger.Warnf("administrator %s not found: sign up and restart to promote them", name)
+			continue
+		}
+		creds, err := db.GetCredentials(user.ID)
+		if err != nil {
+			logger.WithError(err).Errorf("error looking up administrator %s", name)
+			continue
+		} else if creds.PasswordHash == "" && creds.Identities == 0 {
+			logger.Errorf("NOT promoting administrator %s: the account has no password nor linked identity, so "+
+				"anybody could sign in as %s. Administrators must register with a password or an identity provider",
+				name, name)
+			continue
+		}
+		if err = db.SetRole(database.Actor{}, user.ID, database.RoleAdmin); err != nil {
+			logger.WithError(err).Errorf("error promoting administrator %s", name)
+			continue
+		}
+		logger.Infof("user %s is an administrator", name)
+	}
+}
@@ -27,6 +27,51 @@ type WebAPIConfiguration struct {
 	DB    struct {
 		Filename string `conf:"default:/tmp/decaf.db"`
 	}
+	Auth struct {
+		// LegacyLogin keeps the name-only login for users without a password (used for the course evaluation)
+		LegacyLogin bool `conf:"default:true"`
+		// Admins lists the usernames of the users promoted to administrators at startup (separated by ";" in flags
+		// and environment variables). Only users with a password or a linked identity are promoted. Users are never
+		// demoted here: removing a name has no effect.
+		Admins []string
+	}
+	Accounts struct {
+		// DeletionGracePeriod is how long deleted accounts can be restored by signing in, before being purged
+		DeletionGracePeriod time.Duration `conf:"default:720h"`
+		// PurgeInterval is how often the deleted accounts past their grace period, and the expired data exports, are
+		// purged
+		PurgeInterval time.Duration `conf:"default:1h"`
+		// ExportTTL is how long data exports can be downloaded once ready
+		ExportTTL time.Duration `conf:"default:24h"`
+	}
+	Tags struct {
+		// TrendInterval is how often the trending tags are computed
+		TrendInterval time.Duration `conf:"default:5m"`
+	}
+	Mail struct {
+		// Outbox is the directory where e-mails are written. If empty, e-mails are written to the log.
+		Outbox string
+	}
+	OIDC struct {
+		// PublicURL is where browsers reach the API server: the callback of each issuer is at
+		// <PublicURL>/oidc/<name>/callback, and must be registered at the provider
+		PublicURL string `conf:"default:http://localhost:3000"`
+		// FrontendURL is where browsers are sent after signing in (see api.Config)
+		FrontendURL string
+		// FakeIdPHost starts the fake identity provider (package oidc/fakeidp) on this address, as issuer "fake".
+		// For development only.
+		FakeIdPHost string `conf:"flag:oidc-fake-idp-host,env:OIDC_FAKE_IDP_HOST"`
+		// Issuers can be set only in the configuration file
+		Issuers []OIDCIssuer `conf:"-"`
+	}
+}
+
+// OIDCIssuer is an OpenID Connect provider that users can sign in with
+type OIDCIssuer struct {
+	Name         string // Used in the API paths
+	URL          string // Issuer URL
+	ClientID     string
+	ClientSecret string
 }
 
 // loadConfiguration creates a WebAPIConfiguration starting from flags, environment variables and configuration file.
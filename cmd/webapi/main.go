@@ -31,6 +31,7 @@ import (
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/mailer"
 	"github.com/ardanlabs/conf"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
@@ -82,7 +83,7 @@ func run() error {
 
 	// Start Database
 	logger.Println("initializing database support")
-	dbconn, err := sql.Open("sqlite3", cfg.DB.Filename)
+	dbconn, err := sql.Open("sqlite3", database.DataSourceName(cfg.DB.Filename))
 	if err != nil {
 		logger.WithError(err).Error("error opening SQLite DB")
 		return fmt.Errorf("opening SQLite: %w", err)
@@ -96,6 +97,27 @@ func run() error {
 		logger.WithError(err).Error("error creating AppDatabase")
 		return fmt.Errorf("creating AppDatabase: %w", err)
 	}
+	promoteAdmins(db, cfg.Auth.Admins, logger)
+
+	// Start the mailer: no mail server is used, e-mails are stored in a directory or logged
+	var mail mailer.Mailer
+	if cfg.Mail.Outbox != "" {
+		logger.Infof("writing e-mails to %s", cfg.Mail.Outbox)
+		mail, err = mailer.NewFileMailer(cfg.Mail.Outbox)
+		if err != nil {
+			logger.WithError(err).Error("error creating the mailer")
+			return fmt.Errorf("creating the mailer: %w", err)
+		}
+	} else {
+		mail = mailer.NewLogMailer(logger)
+	}
+
+	// Set up the OpenID Connect providers
+	providers, err := oidcProviders(cfg, logger)
+	if err != nil {
+		logger.WithError(err).Error("error setting up OpenID Connect providers")
+		return fmt.Errorf("setting up OpenID Connect providers: %w", err)
+	}
 
 	// Start (main) API server
 	logger.Info("initializing API server")
@@ -111,8 +133,17 @@ func run() error {
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:        logger,
+		Database:      db,
+		Mailer:        mail,
+		LegacyLogin:   cfg.Auth.LegacyLogin,
+		OIDCProviders: providers,
+		FrontendURL:   cfg.OIDC.FrontendURL,
+
+		DeletionGracePeriod: cfg.Accounts.DeletionGracePeriod,
+		PurgeInterval:       cfg.Accounts.PurgeInterval,
+		ExportTTL:           cfg.Accounts.ExportTTL,
+		TrendInterval:       cfg.Tags.TrendInterval,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
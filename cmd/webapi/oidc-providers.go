@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc/fakeidp"
+	"github.com/sirupsen/logrus"
+)
+
+// oidcProviders returns the OpenID Connect providers from the configuration. If requested, the fake identity provider
+// is started in a separate goroutine, and added as issuer "fake".
+func oidcProviders(cfg WebAPIConfiguration, logger logrus.FieldLogger) ([]*oidc.Provider, error) {
+	issuers := cfg.OIDC.Issuers
+	if cfg.OIDC.FakeIdPHost != "" {
+		idp := fakeidp.New()
+		idp.Issuer = "http://" + cfg.OIDC.FakeIdPHost
+		listener, err := net.Listen("tcp", cfg.OIDC.FakeIdPHost)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			logger.Warnf("fake identity provider listening on %s: do not use in production", idp.Issuer)
+			_ = http.Serve(listener, idp)
+		}()
+		issuers = append(issuers, OIDCIssuer{Name: "fake", URL: idp.Issuer, ClientID: "decaf"})
+	}
+
+	providers := make([]*oidc.Provider, 0, len(issuers))
+	for _, issuer := range issuers {
+		providers = append(providers, &oidc.Provider{
+			Name:         issuer.Name,
+			Issuer:       issuer.URL,
+			ClientID:     issuer.ClientID,
+			ClientSecret: issuer.ClientSecret,
+			RedirectURL:  strings.TrimSuffix(cfg.OIDC.PublicURL, "/") + "/oidc/" + issuer.Name + "/callback",
+		})
+	}
+	return providers, nil
+}
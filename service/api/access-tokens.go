@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Scopes of personal access tokens. Each route lists the scopes it requires in api-handler.go.
+const (
+	scopeReadPhotos    = "read:photos"
+	scopeWritePhotos   = "write:photos"
+	scopeWriteComments = "write:comments"
+	scopeAdmin         = "admin"
+)
+
+var validScopes = map[string]bool{
+	scopeReadPhotos:    true,
+	scopeWritePhotos:   true,
+	scopeWriteComments: true,
+	scopeAdmin:         true,
+}
+
+// accessTokenPrefix starts every personal access token, to tell them apart from session tokens
+const accessTokenPrefix = "pat_"
+
+const (
+	maxAccessTokenNameLength = 50
+	maxAccessTokens          = 50
+)
+
+// hasScopes reports whether granted contains all the required scopes.
+func hasScopes(granted []string, required []string) bool {
+	for _, req := range required {
+		found := false
+		for _, g := range granted {
+			found = found || g == req
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// handleGetAccessTokens lists the personal access tokens of the caller. The tokens themselves are never shown again
+// after their creation.
+func handleGetAccessTokens(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	tokens, err := ctx.Database.GetAccessTokens(ctx.User.ID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get access tokens")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tokens)
+}
+
+// handleCreateAccessToken creates a personal access token for the caller, with the requested scopes and an optional
+// expiration time. The token is returned only here.
+func handleCreateAccessToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	req.Name = strings.TrimSpace(req.Name)
+	var violations []violation
+	if req.Name == "" {
+		violations = append(violations, violation{"name", "is required"})
+	}
+	violations = checkText(violations, "name", req.Name, maxAccessTokenNameLength, false)
+	if len(req.Scopes) == 0 {
+		violations = append(violations, violation{"scopes", "at least one scope is required"})
+	}
+	seen := make(map[string]bool)
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			violations = append(violations, violation{"scopes", "unknown scope " + scope})
+		} else if seen[scope] {
+			violations = append(violations, violation{"scopes", "duplicated scope " + scope})
+		}
+		seen[scope] = true
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(globaltime.Now()) {
+		violations = append(violations, violation{"expiresAt", "must be in the future"})
+	}
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	existing, err := ctx.Database.GetAccessTokens(ctx.User.ID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get access tokens")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxAccessTokens {
+		writeViolations(w, []violation{{"name", "too many access tokens, revoke some first"}})
+		return
+	}
+
+	secret, _, err := newToken()
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to generate access token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	secret = accessTokenPrefix + secret
+
+	token := database.AccessToken{Name: req.Name, Scopes: req.Scopes, ExpiresAt: req.ExpiresAt}
+	if err := ctx.Database.CreateAccessToken(actor(ctx), &token, hashToken(secret)); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to create access token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Access token %s created by %s", token.ID, ctx.User.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(struct {
+		database.AccessToken
+		Token string `json:"token"`
+	}{token, secret})
+}
+
+// handleDeleteAccessToken revokes a personal access token of the caller.
+func handleDeleteAccessToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	err := ctx.Database.DeleteAccessToken(actor(ctx), ps.ByName("tokenId"))
+	if errors.Is(err, database.ErrAccessTokenNotFound) {
+		http.Error(w, "Access token not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to delete access token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Access token %s revoked by %s", ps.ByName("tokenId"), ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
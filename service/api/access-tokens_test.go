@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// createAccessToken creates a personal access token for the user signed in with token, and returns it.
+func (ts *testServer) createAccessToken(token string, body string) string {
+	ts.t.Helper()
+	status, resp := ts.request(http.MethodPost, "/users/me/tokens", token, body)
+	if status != http.StatusCreated {
+		ts.t.Fatalf("token creation: %d %s", status, resp)
+	}
+	var created struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(resp), &created); err != nil {
+		ts.t.Fatal(err)
+	}
+	return created.Token
+}
+
+func TestAccessTokenScopes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	session, _ := ts.register("alice")
+	readOnly := ts.createAccessToken(session, `{"name":"reader","scopes":["read:photos"]}`)
+	everything := ts.createAccessToken(session,
+		`{"name":"all","scopes":["read:photos","write:photos","write:comments","admin"]}`)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+	}{
+		{"read scope on a read route", http.MethodGet, "/stream", readOnly, "", http.StatusOK},
+		{"read scope on a write route", http.MethodPut, "/photos/photo00001/likes", readOnly, "", http.StatusForbidden},
+		{"read scope on an upload", http.MethodPost, "/photos", readOnly, "", http.StatusForbidden},
+		{"token creation with a token", http.MethodPost, "/users/me/tokens", everything,
+			`{"name":"more","scopes":["admin"]}`, http.StatusForbidden},
+		{"password change with a token", http.MethodPut, "/users/me/password", everything,
+			`{"newPassword":"another long password"}`, http.StatusForbidden},
+		{"token list with a token", http.MethodGet, "/users/me/tokens", everything, "", http.StatusForbidden},
+		{"token list with the session", http.MethodGet, "/users/me/tokens", session, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := ts.request(tt.method, tt.path, tt.token, tt.body); status != tt.want {
+				t.Errorf("%s %s: %d %s, want %d", tt.method, tt.path, status, body, tt.want)
+			}
+		})
+	}
+	if n := ts.count(`SELECT COUNT(*) FROM access_tokens`); n != 2 {
+		t.Errorf("%d access tokens, want 2", n)
+	}
+}
+
+func TestAccessTokenExpired(t *testing.T) {
+	ts := newTestServer(t, nil)
+	session, _ := ts.register("alice")
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	token := ts.createAccessToken(session, `{"name":"short","scopes":["read:photos"],"expiresAt":"`+expiresAt+`"}`)
+
+	if status, _ := ts.request(http.MethodGet, "/stream", token, ""); status != http.StatusOK {
+		t.Fatalf("token refused before expiring: %d", status)
+	}
+	globaltime.FixedTime = time.Now().Add(2 * time.Hour)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+	if status, _ := ts.request(http.MethodGet, "/stream", token, ""); status != http.StatusUnauthorized {
+		t.Errorf("expired token: %d, want 401", status)
+	}
+}
+
+func TestAccessTokenSuspendedUser(t *testing.T) {
+	ts := newTestServer(t, nil)
+	session, userID := ts.register("alice")
+	token := ts.createAccessToken(session, `{"name":"reader","scopes":["read:photos"]}`)
+
+	if err := ts.db.SuspendUser(database.Actor{}, userID, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := ts.request(http.MethodGet, "/stream", token, ""); status != http.StatusUnauthorized {
+		t.Errorf("token of a suspended user: %d, want 401", status)
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleDeleteMe deletes the account of the caller. The account is deactivated at once, and purged with all its data
+// after the grace period, unless the user signs in again before then.
+func (rt *_router) handleDeleteMe(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	deletedAt, err := ctx.Database.DeleteUser(actor(ctx), ctx.User.ID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to delete user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s deleted their account", ctx.User.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(struct {
+		PurgeAt time.Time `json:"purgeAt"`
+	}{deletedAt.Add(rt.deletionGracePeriod)})
+}
+
+// purgeDeletedAccounts purges the accounts past their grace period.
+func (rt *_router) purgeDeletedAccounts() {
+	purged, err := rt.db.PurgeDeletedUsers(globaltime.Now().Add(-rt.deletionGracePeriod))
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("Failed to purge deleted accounts")
+	}
+	if len(purged) > 0 {
+		rt.baseLogger.Infof("Purged %d deleted accounts", len(purged))
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+const maxSuspensionReasonLength = 500
+
+// requireAdmin writes an error and returns false unless the caller is an administrator.
+func requireAdmin(w http.ResponseWriter, ctx reqcontext.RequestContext) bool {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if ctx.User.Role != database.RoleAdmin {
+		http.Error(w, "Administrators only", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleAdminSuspendUser suspends a user: their sessions are closed, and they cannot sign in or use their access
+// tokens until unsuspended.
+func handleAdminSuspendUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	var violations []violation
+	if req.Reason == "" {
+		violations = append(violations, violation{"reason", "is required"})
+	}
+	violations = checkText(violations, "reason", req.Reason, maxSuspensionReasonLength, true)
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	userID := ps.ByName("userID")
+	err := ctx.Database.SuspendUser(actor(ctx), userID, req.Reason)
+	if errors.Is(err, database.ErrSelfTarget) {
+		writeViolations(w, []violation{{"userId", "administrators cannot suspend themselves"}})
+		return
+	} else if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to suspend user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s suspended by %s", userID, ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminUnsuspendUser lifts the suspension of a user.
+func handleAdminUnsuspendUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	userID := ps.ByName("userID")
+	err := ctx.Database.UnsuspendUser(actor(ctx), userID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to unsuspend user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s unsuspended by %s", userID, ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminRenameUser changes the username of any user, for example to remove an offensive name. The limit on the
+// number of renames does not apply.
+func handleAdminRenameUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if violations := checkUsername(nil, "username", req.Username); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	userID := ps.ByName("userID")
+	err := ctx.Database.ForceUsername(actor(ctx), userID, req.Username)
+	if errors.Is(err, database.ErrUsernameTaken) {
+		http.Error(w, "Username already exists", http.StatusConflict)
+		return
+	} else if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to rename user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s renamed to %s by %s", userID, req.Username, ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminDeletePhoto deletes the photo of any user, with its comments and likes.
+func handleAdminDeletePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	photoID := ps.ByName("photoId")
+	err := ctx.Database.AdminDeletePhoto(actor(ctx), photoID)
+	if errors.Is(err, database.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to delete photo")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Photo %s deleted by administrator %s", photoID, ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminDeleteComment deletes the comment of any user.
+func handleAdminDeleteComment(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	commentID := ps.ByName("commentId")
+	err := ctx.Database.AdminDeleteComment(actor(ctx), commentID)
+	if errors.Is(err, database.ErrCommentNotFound) {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to delete comment")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Comment %s deleted by administrator %s", commentID, ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,9 +1,11 @@
 package api
 
 import (
+	"net"
 	"net/http"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
@@ -13,8 +15,9 @@ import (
 // required by the httprouter package.
 type httpRouterHandler func(http.ResponseWriter, *http.Request, httprouter.Params, reqcontext.RequestContext)
 
-// wrap parses the request and adds a reqcontext.RequestContext instance related to the request.
-func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+// wrap parses the request and adds a reqcontext.RequestContext instance related to the request. Personal access tokens
+// can be used only if they have all the given scopes: routes without scopes accept signed in users only.
+func (rt *_router) wrap(fn httpRouterHandler, scopes ...string) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		reqUUID, err := uuid.NewV4()
 		if err != nil {
@@ -22,16 +25,27 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		authHeader := r.Header.Get("Authorization")
-		user, err := rt.db.GetUser(authHeader)
+		user, tokenScopes, legacy, err := rt.authenticate(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			rt.baseLogger.WithError(err).Error("can't authenticate the request")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if tokenScopes != nil && (len(scopes) == 0 || !hasScopes(tokenScopes, scopes)) {
+			http.Error(w, "The access token does not allow this request", http.StatusForbidden)
 			return
 		}
+		remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remoteIP = r.RemoteAddr
+		}
 		var ctx = reqcontext.RequestContext{
 			ReqUUID:  reqUUID,
+			RemoteIP: remoteIP,
 			Database: rt.db,
 			User:     user,
+			Scopes:   tokenScopes,
+			Legacy:   legacy,
 		}
 
 		// Create a request-specific logger
@@ -44,3 +58,13 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 		fn(w, r, ps, ctx)
 	}
 }
+
+// actor returns the caller as the actor of an action recorded in the audit log. Anonymous callers are recorded with
+// their request only.
+func actor(ctx reqcontext.RequestContext) database.Actor {
+	a := database.Actor{RequestID: ctx.ReqUUID.String(), RemoteIP: ctx.RemoteIP}
+	if ctx.User != nil {
+		a.UserID = ctx.User.ID
+	}
+	return a
+}
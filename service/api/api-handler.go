@@ -6,37 +6,110 @@ import (
 
 // Handler returns an instance of httprouter.Router that handle APIs registered here
 func (rt *_router) Handler() http.Handler {
-	// Register routes
+	// Register routes. The scopes after a handler are required to use the route with a personal access token: routes
+	// without scopes cannot be used with personal access tokens at all (see access-tokens.go).
 	rt.router.GET("/", rt.getHelloWorld)
 	rt.router.GET("/context", rt.wrap(rt.getContextReply))
 
 	// Special routes
 	rt.router.GET("/liveness", rt.liveness)
-	rt.router.GET("/bans", rt.wrap(handleGetBannedUsers))
+	rt.router.GET("/bans", rt.wrap(handleGetBannedUsers, scopeAdmin)) // Deprecated alias of /admin/bans
 	rt.router.GET("/users/id/:userID", rt.wrap(HandleGetUserProfileID))
-	rt.router.GET("/photos", rt.wrap(handleGetPhotos))
+	rt.router.GET("/users/id/:userID/avatar", rt.wrap(handleGetAvatar))
+	rt.router.GET("/users/id/:userID/photos", rt.wrap(handleGetUserPhotos, scopeReadPhotos))
+	// The lists of a user are under /users/id like its profile, since httprouter cannot have /users/:userID next to
+	// the static routes of /users
+	rt.router.GET("/users/id/:userID/followers", rt.wrap(handleGetUserFollowers))
+	rt.router.GET("/users/id/:userID/following", rt.wrap(handleGetUserFollowing))
+	rt.router.GET("/users/id/:userID/mutuals", rt.wrap(handleGetUserMutuals))
+	rt.router.GET("/photos", rt.wrap(handleGetPhotos, scopeReadPhotos))
+	rt.router.GET("/oidc", rt.wrap(rt.handleListProviders))
+	rt.router.GET("/oidc/:provider/authorize", rt.wrap(rt.handleOIDCAuthorize))
+	rt.router.GET("/oidc/:provider/callback", rt.wrap(rt.handleOIDCCallback))
 	rt.router.GET("/users", rt.wrap(HandleGetAllUsers))
-	rt.router.GET("/photos/:photoId/comment/", rt.wrap(handleGetComments))
-	rt.router.GET("/stream", rt.wrap(handleGetMyStream))
+	rt.router.GET("/search/users", rt.wrap(handleSearchUsers))
+	rt.router.GET("/search/photos", rt.wrap(handleSearchPhotos, scopeReadPhotos))
+	rt.router.GET("/tags/trending", rt.wrap(handleGetTrendingTags))
+	rt.router.GET("/tags/name/:tag", rt.wrap(handleGetTag))
+	rt.router.GET("/tags/name/:tag/photos", rt.wrap(handleGetTagPhotos, scopeReadPhotos))
+	rt.router.GET("/photos/:photoId/comment/", rt.wrap(handleGetComments, scopeReadPhotos))
+	rt.router.GET("/stream", rt.wrap(handleGetMyStream, scopeReadPhotos))
 	rt.router.GET("/users/followers/:username", rt.wrap(handleGetFollowers))
-	rt.router.GET("/photos/:photoId", rt.wrap(handleGetPhoto))
+	rt.router.GET("/users/me/tokens", rt.wrap(handleGetAccessTokens))
+	rt.router.GET("/users/me/export", rt.wrap(handleGetExports))
+	rt.router.GET("/users/me/follow-requests", rt.wrap(handleGetFollowRequests))
+	rt.router.GET("/users/me/mutes", rt.wrap(handleGetMutes))
+	rt.router.GET("/users/me/close-friends", rt.wrap(handleGetCloseFriends))
+	rt.router.GET("/users/me/suggestions", rt.wrap(handleGetSuggestions))
+	rt.router.GET("/users/me/tags", rt.wrap(handleGetFollowedTags))
+	rt.router.GET("/users/me/notification-preferences", rt.wrap(handleGetNotificationPreferences))
+	rt.router.GET("/notifications", rt.wrap(handleGetNotifications))
+	rt.router.GET("/exports/:exportId/archive", rt.wrap(handleDownloadExport))
+	rt.router.GET("/photos/:photoId", rt.wrap(handleGetPhoto, scopeReadPhotos))
+	rt.router.GET("/photos/:photoId/likes", rt.wrap(handleGetLikers, scopeReadPhotos))
 	rt.router.GET("/username/:userId", rt.wrap(handleGetUsername))
-	rt.router.GET("/likes/:photoId", rt.wrap(HandleIsLiked))
+	rt.router.GET("/likes/:photoId", rt.wrap(HandleIsLiked, scopeReadPhotos))
 	rt.router.GET("/follows/:userId", rt.wrap(handleIsUserFollowed))
 	rt.router.GET("/bans/:userId", rt.wrap(handleIsUserBanned))
 	rt.router.POST("/users", rt.wrap(HandleAddUser))
-	rt.router.POST("/photos/:photoId/comments", rt.wrap(handleCommentPhoto))
-	rt.router.POST("/photos/:photoId/likes", rt.wrap(HandleLikePhoto))
+	rt.router.POST("/photos/:photoId/comments", rt.wrap(handleCommentPhoto, scopeWriteComments))
+	rt.router.POST("/photos/:photoId/likes", rt.wrap(HandleLikePhoto, scopeWritePhotos))
 	rt.router.POST("/users/bans/:userId", rt.wrap(handleBanUser))
 	rt.router.POST("/users/follows/:userId", rt.wrap(HandleFollowUser))
-	rt.router.POST("/session", rt.wrap(doLogin))
-	rt.router.POST("/photos", rt.wrap(handleUploadPhoto))
-	rt.router.PATCH("/users/:username", rt.wrap(HandleSetUsername))
-	rt.router.DELETE("/photos/:photoId/likes", rt.wrap(HandleUnlikePhoto))
-	rt.router.DELETE("/photos/:photoId", rt.wrap(handleDeletePhoto))
+	rt.router.POST("/session", rt.wrap(rt.doLogin))
+	rt.router.POST("/register", rt.wrap(rt.handleRegister))
+	rt.router.POST("/oidc/:provider/authorize", rt.wrap(rt.handleOIDCAuthorize))
+	rt.router.POST("/password-reset", rt.wrap(rt.handleRequestPasswordReset))
+	rt.router.POST("/password-reset/confirm", rt.wrap(rt.handleResetPassword))
+	rt.router.POST("/photos", rt.wrap(handleUploadPhoto, scopeWritePhotos))
+	rt.router.POST("/users/me/tokens", rt.wrap(handleCreateAccessToken))
+	rt.router.POST("/users/me/export", rt.wrap(rt.handleCreateExport))
+	rt.router.POST("/reports", rt.wrap(handleCreateReport))
+	rt.router.POST("/notifications/read-all", rt.wrap(handleMarkAllNotificationsRead))
+	rt.router.PUT("/photos/:photoId/likes", rt.wrap(HandleLikePhoto, scopeWritePhotos))
+	rt.router.PUT("/photos/:photoId/visibility", rt.wrap(handleSetPhotoVisibility, scopeWritePhotos))
+	rt.router.PUT("/users/bans/:userId", rt.wrap(handleBanUser))
+	rt.router.PUT("/users/follows/:userId", rt.wrap(HandleFollowUser))
+	rt.router.PUT("/users/mutes/:userId", rt.wrap(handleMuteUser))
+	rt.router.PUT("/users/me/avatar", rt.wrap(handleSetAvatar))
+	rt.router.PUT("/users/me/password", rt.wrap(rt.handleChangePassword))
+	rt.router.PUT("/users/me/follow-requests/:userID", rt.wrap(handleAnswerFollowRequest))
+	rt.router.PUT("/users/me/close-friends/:userID", rt.wrap(handleAddCloseFriend))
+	rt.router.PUT("/users/me/tags/:tag", rt.wrap(handleFollowTag))
+	rt.router.PUT("/notifications/id/:notificationID/read", rt.wrap(handleMarkNotificationRead))
+	rt.router.PUT("/users/me/notification-preferences", rt.wrap(handleUpdateNotificationPreferences))
+	rt.router.PATCH("/users/:username", rt.wrap(handlePatchUser))
+	rt.router.DELETE("/photos/:photoId/likes", rt.wrap(HandleUnlikePhoto, scopeWritePhotos))
+	rt.router.DELETE("/photos/:photoId", rt.wrap(handleDeletePhoto, scopeWritePhotos))
 	rt.router.DELETE("/users/bans/:userId", rt.wrap(handleUnbanUser))
 	rt.router.DELETE("/users/follows/:userId", rt.wrap(HandleUnfollowUser))
-	rt.router.DELETE("/comments/:commentId", rt.wrap(handleUncommentPhoto))
+	rt.router.DELETE("/users/mutes/:userId", rt.wrap(handleUnmuteUser))
+	rt.router.DELETE("/comments/:commentId", rt.wrap(handleUncommentPhoto, scopeWriteComments))
+	rt.router.DELETE("/users/me", rt.wrap(rt.handleDeleteMe))
+	rt.router.DELETE("/users/me/avatar", rt.wrap(handleDeleteAvatar))
+	rt.router.DELETE("/session", rt.wrap(rt.handleLogout))
+	rt.router.DELETE("/users/me/tokens/:tokenId", rt.wrap(handleDeleteAccessToken))
+	rt.router.DELETE("/users/me/follow-requests/:userID", rt.wrap(handleAnswerFollowRequest))
+	rt.router.DELETE("/users/me/close-friends/:userID", rt.wrap(handleRemoveCloseFriend))
+	rt.router.DELETE("/users/me/tags/:tag", rt.wrap(handleUnfollowTag))
+	rt.router.DELETE("/users/me/suggestions/:userID", rt.wrap(handleDismissSuggestion))
+
+	// Administration: the handlers check that the caller is an administrator (see admin.go, audit.go and reports.go)
+	rt.router.GET("/admin/bans", rt.wrap(handleGetBannedUsers, scopeAdmin))
+	rt.router.GET("/admin/audit", rt.wrap(handleGetAuditEvents, scopeAdmin))
+	rt.router.GET("/admin/audit/export", rt.wrap(handleExportAuditEvents, scopeAdmin))
+	rt.router.GET("/admin/reports", rt.wrap(handleGetReports, scopeAdmin))
+	rt.router.GET("/admin/reports/:reportId", rt.wrap(handleGetReport, scopeAdmin))
+	rt.router.PUT("/admin/reports/:reportId/resolution", rt.wrap(handleResolveReport, scopeAdmin))
+	rt.router.PUT("/admin/photos/:photoId/hidden", rt.wrap(handleAdminHidePhoto, scopeAdmin))
+	rt.router.PUT("/admin/comments/:commentId/hidden", rt.wrap(handleAdminHideComment, scopeAdmin))
+	rt.router.PUT("/admin/users/:userID/suspension", rt.wrap(handleAdminSuspendUser, scopeAdmin))
+	rt.router.PUT("/admin/users/:userID/username", rt.wrap(handleAdminRenameUser, scopeAdmin))
+	rt.router.DELETE("/admin/users/:userID/suspension", rt.wrap(handleAdminUnsuspendUser, scopeAdmin))
+	rt.router.DELETE("/admin/photos/:photoId", rt.wrap(handleAdminDeletePhoto, scopeAdmin))
+	rt.router.DELETE("/admin/comments/:commentId", rt.wrap(handleAdminDeleteComment, scopeAdmin))
+	rt.router.DELETE("/admin/photos/:photoId/hidden", rt.wrap(handleAdminHidePhoto, scopeAdmin))
+	rt.router.DELETE("/admin/comments/:commentId/hidden", rt.wrap(handleAdminHideComment, scopeAdmin))
 
 	return rt.router
 }
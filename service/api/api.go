@@ -38,10 +38,15 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/mailer"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Config is used to provide dependencies and configuration to the New function.
@@ -51,6 +56,32 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// Mailer delivers e-mails to users, like password reset tokens
+	Mailer mailer.Mailer
+
+	// LegacyLogin enables the name-only login: users without a password sign in with just their name, and their ID is
+	// accepted as token
+	LegacyLogin bool
+
+	// OIDCProviders are the OpenID Connect providers that users can sign in with
+	OIDCProviders []*oidc.Provider
+
+	// FrontendURL is where browsers are sent back after signing in with a provider, with the token in the query. If
+	// empty, the token is returned as JSON.
+	FrontendURL string
+
+	// DeletionGracePeriod is how long deleted accounts wait before being purged; signing in meanwhile restores them
+	DeletionGracePeriod time.Duration
+
+	// PurgeInterval is how often the accounts past their grace period, and the expired data exports, are purged
+	PurgeInterval time.Duration
+
+	// ExportTTL is how long data exports can be downloaded once ready
+	ExportTTL time.Duration
+
+	// TrendInterval is how often the trending tags are computed
+	TrendInterval time.Duration
 }
 
 // Router is the package API interface representing an API handler builder
@@ -71,6 +102,31 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.Mailer == nil {
+		return nil, errors.New("mailer is required")
+	}
+	if cfg.DeletionGracePeriod < 0 {
+		return nil, errors.New("the deletion grace period cannot be negative")
+	}
+	if cfg.PurgeInterval <= 0 {
+		return nil, errors.New("the purge interval must be positive")
+	}
+	if cfg.ExportTTL <= 0 {
+		return nil, errors.New("the export TTL must be positive")
+	}
+	if cfg.TrendInterval <= 0 {
+		return nil, errors.New("the trend interval must be positive")
+	}
+	providers := make(map[string]*oidc.Provider, len(cfg.OIDCProviders))
+	for _, p := range cfg.OIDCProviders {
+		if p.Name == "" {
+			return nil, errors.New("OpenID Connect providers must have a name")
+		}
+		if _, ok := providers[p.Name]; ok {
+			return nil, fmt.Errorf("duplicated OpenID Connect provider %q", p.Name)
+		}
+		providers[p.Name] = p
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
@@ -78,11 +134,27 @@ func New(cfg Config) (Router, error) {
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 
-	return &_router{
-		router:     router,
-		baseLogger: cfg.Logger,
-		db:         cfg.Database,
-	}, nil
+	rt := &_router{
+		router:              router,
+		baseLogger:          cfg.Logger,
+		db:                  cfg.Database,
+		mailer:              cfg.Mailer,
+		legacyLogin:         cfg.LegacyLogin,
+		providers:           providers,
+		providerList:        cfg.OIDCProviders,
+		frontendURL:         cfg.FrontendURL,
+		deletionGracePeriod: cfg.DeletionGracePeriod,
+		exportTTL:           cfg.ExportTTL,
+		stop:                make(chan struct{}),
+		maintenanceDone:     make(chan struct{}),
+		exportWake:          make(chan struct{}, 1),
+		exportsDone:         make(chan struct{}),
+		trendsDone:          make(chan struct{}),
+	}
+	go rt.runMaintenance(cfg.PurgeInterval)
+	go rt.runExports()
+	go rt.runTrends(cfg.TrendInterval)
+	return rt, nil
 }
 
 type _router struct {
@@ -93,4 +165,27 @@ type _router struct {
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	mailer mailer.Mailer
+
+	legacyLogin bool
+
+	// providers are the OpenID Connect providers by name, providerList in the configured order
+	providers    map[string]*oidc.Provider
+	providerList []*oidc.Provider
+
+	frontendURL string
+
+	deletionGracePeriod time.Duration
+
+	exportTTL time.Duration
+
+	// stop is closed by Close to end the background jobs, which close their done channel when they have ended (see
+	// background.go)
+	stop            chan struct{}
+	stopOnce        sync.Once
+	maintenanceDone chan struct{}
+	exportWake      chan struct{}
+	exportsDone     chan struct{}
+	trendsDone      chan struct{}
 }
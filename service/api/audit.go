@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// parseAuditFilter reads the filters of the audit log from the query: actor, action, targetType, targetId, and since
+// and until as RFC 3339 times.
+func parseAuditFilter(r *http.Request) (database.AuditFilter, []violation) {
+	query := r.URL.Query()
+	filter := database.AuditFilter{
+		ActorID:    query.Get("actor"),
+		Action:     query.Get("action"),
+		TargetType: query.Get("targetType"),
+		TargetID:   query.Get("targetId"),
+	}
+	var violations []violation
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				violations = append(violations, violation{bound.name, "must be an RFC 3339 time"})
+			}
+			*bound.t = t
+		}
+	}
+	return filter, violations
+}
+
+// handleGetAuditEvents lists the events of the audit log matching the filters, most recent first.
+func handleGetAuditEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, violations := parseAuditFilter(r)
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	events, err := ctx.Database.GetAuditEvents(filter, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get audit events")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(events)
+}
+
+// handleExportAuditEvents streams the events of the audit log matching the filters as JSON Lines (one event per line),
+// oldest first.
+func handleExportAuditEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	filter, violations := parseAuditFilter(r)
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	enc := json.NewEncoder(w)
+	err := ctx.Database.ExportAuditEvents(filter, func(e database.AuditEvent) error {
+		return enc.Encode(e)
+	})
+	if err != nil {
+		// The status has been sent already if some events were written: the export just ends early
+		ctx.Logger.WithError(err).Error("Failed to export audit events")
+		return
+	}
+	ctx.Logger.Infof("Audit log exported by %s", ctx.User.Username)
+}
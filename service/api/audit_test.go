@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+func TestExportAuditEvents(t *testing.T) {
+	ts := newTestServer(t, nil)
+	adminToken, adminID := ts.register("carol")
+	if err := ts.db.SetRole(database.Actor{}, adminID, database.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	userToken, userID := ts.register("alice")
+	for i := 0; i < 2; i++ {
+		status, _ := ts.request(http.MethodPost, "/session", "", `{"name":"alice","password":"correct horse battery"}`)
+		if status != http.StatusOK {
+			t.Fatalf("login: %d", status)
+		}
+	}
+	if status, _ := ts.request(http.MethodPost, "/session", "", `{"name":"alice","password":"wrong"}`); status != http.StatusUnauthorized {
+		t.Fatalf("wrong password: %d", status)
+	}
+
+	if status, _ := ts.request(http.MethodGet, "/admin/audit/export", userToken, ""); status != http.StatusForbidden {
+		t.Errorf("export by a user: %d, want 403", status)
+	}
+	if status, _ := ts.request(http.MethodGet, "/admin/audit/export?since=yesterday", adminToken, ""); status != http.StatusUnprocessableEntity {
+		t.Errorf("export with an invalid time: %d, want 422", status)
+	}
+
+	// Registration opens a session as well: three logins in all
+	status, body := ts.request(http.MethodGet, "/admin/audit/export?action=user.login&targetId="+userID, adminToken, "")
+	if status != http.StatusOK {
+		t.Fatalf("export: %d %s", status, body)
+	}
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("exported %d lines, want 3:\n%s", len(lines), body)
+	}
+	var previous database.AuditEvent
+	for i, line := range lines {
+		var e database.AuditEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		if e.Action != "user.login" || e.TargetID != userID {
+			t.Errorf("line %d: %s on %s", i+1, e.Action, e.TargetID)
+		}
+		if e.CreatedAt.Before(previous.CreatedAt) {
+			t.Errorf("line %d is older than the previous one", i+1)
+		}
+		previous = e
+	}
+}
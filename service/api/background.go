@@ -0,0 +1,65 @@
+package api
+
+// Background jobs, started by New and stopped by Close.
+
+import (
+	"time"
+)
+
+// runMaintenance purges the deleted accounts past their grace period and the expired data exports, at startup and
+// then every interval.
+func (rt *_router) runMaintenance(interval time.Duration) {
+	defer close(rt.maintenanceDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rt.purgeDeletedAccounts()
+		rt.deleteExpiredExports()
+
+		select {
+		case <-rt.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runTrends computes the trending tags, at startup and then every interval.
+func (rt *_router) runTrends(interval time.Duration) {
+	defer close(rt.trendsDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rt.computeTagTrends()
+
+		select {
+		case <-rt.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runExports builds the pending data exports, at startup (exports left pending by a restart) and then whenever
+// wakeExports is called.
+func (rt *_router) runExports() {
+	defer close(rt.exportsDone)
+	for {
+		rt.buildPendingExports()
+
+		select {
+		case <-rt.stop:
+			return
+		case <-rt.exportWake:
+		}
+	}
+}
+
+// wakeExports tells runExports that there are new pending exports.
+func (rt *_router) wakeExports() {
+	select {
+	case rt.exportWake <- struct{}{}:
+	default:
+		// runExports is awake already
+	}
+}
@@ -2,32 +2,44 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"github.com/julienschmidt/httprouter"
 )
 
+// handleBanUser makes the caller ban a user. Banning a user twice is not an error.
 func handleBanUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	userId := ps.ByName("userId")
 
-	bannedBy := ctx.User.ID
-	var err = ctx.Database.BanUser(bannedBy, userId)
-	if err != nil {
-		if err.Error() == "user is already banned" {
-			http.Error(w, "User is already banned", http.StatusConflict)
-			return
-		}
+	created, err := ctx.Database.BanUser(actor(ctx), userId)
+	if errors.Is(err, database.ErrSelfTarget) {
+		http.Error(w, "You cannot ban yourself", http.StatusUnprocessableEntity)
+		return
+	} else if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to ban user")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	ctx.Logger.Infof("User %s banned by %s", userId, ctx.User.Username)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("User successfully banned"))
+	writeCreated(w, created)
 }
 
-// Handler for unbanning a user
+// Handler for unbanning a user. Unbanning a user that is not banned is not an error.
 func handleUnbanUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	userId := ps.ByName("userId")
 	ctx.Logger.Infof("Unbanning user %s", userId)
 	if userId == "" {
@@ -36,24 +48,28 @@ func handleUnbanUser(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 		return
 	}
 
-	// Fetch user IDs by username
-	bannerUser := ctx.User.ID
-
-	var err = ctx.Database.UnbanUser(bannerUser, userId)
+	var err = ctx.Database.UnbanUser(actor(ctx), userId)
 	if err != nil {
 		ctx.Logger.Infof("Internal server error " + err.Error())
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	ctx.Logger.Infof("User %s unbanned by %s", userId, ctx.User.Username)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("User successfully unbanned"))
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// Handler for getting all banned users
+// handleGetBannedUsers lists the bans of all the users, to administrators only.
 func handleGetBannedUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	bannedUsers, err := ctx.Database.GetBans()
+	bannedUsers, err := ctx.Database.GetBans(page)
 	if err != nil {
 		ctx.Logger.Infof("Internal server error1 " + err.Error())
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleAddCloseFriend adds a user to the close friends of the caller. Adding a user twice is not an error.
+func handleAddCloseFriend(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	friendID := ps.ByName("userID")
+	created, err := ctx.Database.AddCloseFriend(ctx.User.ID, friendID)
+	if errors.Is(err, database.ErrSelfTarget) {
+		http.Error(w, "You cannot add yourself to your close friends", http.StatusUnprocessableEntity)
+		return
+	} else if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to add close friend")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s added a close friend", ctx.User.Username)
+	writeCreated(w, created)
+}
+
+// handleRemoveCloseFriend removes a user from the close friends of the caller. Removing a user not in the list is not
+// an error.
+func handleRemoveCloseFriend(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := ctx.Database.RemoveCloseFriend(ctx.User.ID, ps.ByName("userID")); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to remove close friend")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s removed a close friend", ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetCloseFriends lists the close friends of the caller, most recently added first, one page at a time.
+func handleGetCloseFriends(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	friends, err := ctx.Database.GetCloseFriends(ctx.User.ID, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get close friends")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(friends)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+func TestCloseFriends(t *testing.T) {
+	ts := newTestServer(t, nil)
+	aliceToken, aliceID := ts.login("alice")
+	bobToken, _ := ts.login("bob")
+	carolToken, carolID := ts.login("carol")
+	for _, token := range []string{bobToken, carolToken} {
+		if status, body := ts.request(http.MethodPut, "/users/follows/"+aliceID, token, ""); status >= 300 {
+			t.Fatalf("follow: %d %s", status, body)
+		}
+	}
+	if status, body := ts.request(http.MethodPut, "/users/me/close-friends/"+carolID, aliceToken, ""); status != http.StatusCreated {
+		t.Fatalf("add close friend: %d %s", status, body)
+	}
+	photo := database.Photo{ID: "photo", UserID: aliceID, Timestamp: time.Now(), Visibility: database.VisibilityCloseFriends}
+	if err := ts.db.AddPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	// The photo is seen by the close friends, and not by the other followers
+	if status, _ := ts.request(http.MethodGet, "/photos/photo", carolToken, ""); status != http.StatusOK {
+		t.Errorf("close friend: %d, want 200", status)
+	}
+	if status, _ := ts.request(http.MethodGet, "/photos/photo", bobToken, ""); status != http.StatusNotFound {
+		t.Errorf("follower: %d, want 404", status)
+	}
+	stream := func(token string) []string {
+		t.Helper()
+		var photos []string
+		_, body := ts.request(http.MethodGet, "/stream", token, "")
+		if err := json.Unmarshal([]byte(body), &photos); err != nil {
+			t.Fatal(err)
+		}
+		return photos
+	}
+	if photos := stream(carolToken); len(photos) != 1 {
+		t.Errorf("stream of the close friend: %v", photos)
+	}
+	if photos := stream(bobToken); len(photos) != 0 {
+		t.Errorf("stream of the follower: %v", photos)
+	}
+
+	// Everybody reads only their own list
+	friends := func(token string) []database.CloseFriend {
+		t.Helper()
+		var friends []database.CloseFriend
+		status, body := ts.request(http.MethodGet, "/users/me/close-friends", token, "")
+		if status != http.StatusOK {
+			t.Fatalf("close friends: %d %s", status, body)
+		}
+		if err := json.Unmarshal([]byte(body), &friends); err != nil {
+			t.Fatal(err)
+		}
+		return friends
+	}
+	if list := friends(aliceToken); len(list) != 1 || list[0].UserID != carolID {
+		t.Errorf("alice reads %v, want carol", list)
+	}
+	if list := friends(carolToken); len(list) != 0 {
+		t.Errorf("carol reads %v, want an empty list", list)
+	}
+	if status, _ := ts.request(http.MethodGet, "/users/me/close-friends", "", ""); status != http.StatusUnauthorized {
+		t.Errorf("anonymous: %d, want 401", status)
+	}
+	if status, _ := ts.request(http.MethodGet, "/users/id/"+aliceID+"/close-friends", carolToken, ""); status != http.StatusNotFound {
+		t.Errorf("list of another user: %d, want 404", status)
+	}
+}
@@ -2,7 +2,9 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
@@ -25,11 +27,16 @@ func handleCommentPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 
 	var req struct {
 		Content string `json:"content"`
+		ReplyTo string `json:"replyTo"` // Optional: the comment of the same photo this one replies to
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if strings.TrimSpace(req.Content) == "" {
+		http.Error(w, "Comment content must be provided", http.StatusBadRequest)
+		return
+	}
 
 	comment := database.Comment{
 		ID:        uuid.Must(uuid.NewV4()).String(), // Using a UUID library to generate the comment ID
@@ -37,10 +44,18 @@ func handleCommentPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		PhotoID:   photoId,
 		Content:   req.Content,
 		Timestamp: time.Now(),
+		ReplyTo:   req.ReplyTo,
 	}
 
 	err := ctx.Database.AddComment(comment)
-	if err != nil {
+	if errors.Is(err, database.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrCommentNotFound) {
+		writeViolations(w, []violation{{"replyTo", "must be a comment of the photo"}})
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to add comment")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -49,15 +64,27 @@ func handleCommentPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 	w.Write([]byte("Comment added successfully"))
 }
 
+// handleUncommentPhoto deletes a comment. The author of the comment and the owner of the photo can delete it;
+// administrators delete any comment with handleAdminDeleteComment.
 func handleUncommentPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	commentID := ps.ByName("commentId")
 	if commentID == "" {
 		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
 		return
 	}
 
-	err := ctx.Database.DeleteComment(commentID)
-	if err != nil {
+	err := ctx.Database.DeleteComment(actor(ctx), commentID)
+	if errors.Is(err, database.ErrCommentNotFound) {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotOwner) {
+		http.Error(w, "Only the author or the owner of the photo can delete a comment", http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -73,7 +100,7 @@ func handleGetComments(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 		return
 	}
 
-	comments, err := ctx.Database.GetCommentsByPhotoId(photoId)
+	comments, err := ctx.Database.GetCommentsByPhotoId(photoId, viewerID(ctx))
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
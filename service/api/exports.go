@@ -0,0 +1,200 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// A data export is a ZIP archive with the personal data of a user: manifest.json (see database.Takeout) and the
+// original images of the photos and of the avatar. Archives are built in the background (see runExports), and can be
+// downloaded with the link returned when the export is requested, until they expire.
+
+// imageExtensions are the extensions of the image files in the archives, by content type
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/bmp":  ".bmp",
+}
+
+// handleCreateExport starts building a data export of the caller, and replies with the link to download it once ready.
+// The link cannot be retrieved later.
+func (rt *_router) handleCreateExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	token, tokenHash, err := newToken()
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to generate export token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	export, err := ctx.Database.CreateExport(ctx.User.ID, tokenHash)
+	if errors.Is(err, database.ErrExportPending) {
+		http.Error(w, "An export is already being built", http.StatusConflict)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to create export")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.wakeExports()
+	ctx.Logger.Infof("Data export %s requested by %s", export.ID, ctx.User.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(struct {
+		*database.Export
+		DownloadURL string `json:"downloadUrl"`
+	}{export, "/exports/" + export.ID + "/archive?token=" + token})
+}
+
+// handleGetExports lists the data exports of the caller that have not expired, newest first.
+func handleGetExports(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	exports, err := ctx.Database.GetExports(ctx.User.ID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get exports")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(exports)
+}
+
+// handleDownloadExport sends the archive of a data export. The token of the download link is the only credential, so
+// that the link can be opened by a browser.
+func handleDownloadExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	exportID := ps.ByName("exportId")
+	archive, err := ctx.Database.GetExportArchive(exportID, hashToken(r.URL.Query().Get("token")))
+	if errors.Is(err, database.ErrExportNotFound) {
+		http.Error(w, "Export not found or expired", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get export")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%s.zip"`, exportID))
+	_, _ = w.Write(archive)
+}
+
+// buildPendingExports builds the archives of the pending exports, one at a time, until there are none left or Close
+// is called. Exports that cannot be built are marked as failed.
+func (rt *_router) buildPendingExports() {
+	exports, err := rt.db.GetPendingExports()
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("Failed to get pending exports")
+		return
+	}
+	for _, export := range exports {
+		select {
+		case <-rt.stop:
+			return
+		default:
+		}
+
+		expiresAt := globaltime.Now().Add(rt.exportTTL)
+		archive, err := rt.buildArchive(export.UserID)
+		if err != nil {
+			rt.baseLogger.WithError(err).Errorf("Failed to build export %s", export.ID)
+			err = rt.db.FailExport(export.ID, expiresAt)
+		} else {
+			err = rt.db.FinishExport(export.ID, archive, expiresAt)
+		}
+		if err != nil {
+			rt.baseLogger.WithError(err).Errorf("Failed to store export %s", export.ID)
+		}
+	}
+}
+
+// buildArchive writes the ZIP archive of the personal data of a user. The whole archive is held in memory, since it is
+// stored in the database (see database.AppDatabase.FinishExport).
+func (rt *_router) buildArchive(userID string) ([]byte, error) {
+	takeout, err := rt.db.GetTakeout(userID)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	// Images are written first, since the manifest refers to their files
+	files := make(map[string]string, len(takeout.Photos))
+	err = rt.db.ExportImages(userID, func(photoID string, imageData []byte) error {
+		name := "photos/" + photoID + imageExtension(imageData)
+		files[photoID] = name
+		return writeZipFile(zw, name, imageData, zip.Store)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("writing photos: %w", err)
+	}
+	for i := range takeout.Photos {
+		takeout.Photos[i].File = files[takeout.Photos[i].PhotoID]
+	}
+
+	avatar, err := rt.db.GetAvatar(userID)
+	if err == nil {
+		takeout.Account.Avatar = "avatar" + imageExtension(avatar)
+		err = writeZipFile(zw, takeout.Account.Avatar, avatar, zip.Store)
+	}
+	if err != nil && !errors.Is(err, database.ErrAvatarNotFound) {
+		return nil, fmt.Errorf("writing avatar: %w", err)
+	}
+
+	manifest, err := json.MarshalIndent(struct {
+		ExportedAt time.Time `json:"exportedAt"`
+		*database.Takeout
+	}{globaltime.Now().UTC(), takeout}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encoding manifest: %w", err)
+	}
+	if err = writeZipFile(zw, "manifest.json", manifest, zip.Deflate); err != nil {
+		return nil, fmt.Errorf("writing manifest: %w", err)
+	}
+	if err = zw.Close(); err != nil {
+		return nil, fmt.Errorf("closing archive: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeZipFile adds a file to an archive. Images are stored as they are, since they are compressed already.
+func writeZipFile(zw *zip.Writer, name string, data []byte, method uint16) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: globaltime.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// imageExtension returns the extension of the file of an image, or "" if its type is unknown.
+func imageExtension(imageData []byte) string {
+	return imageExtensions[http.DetectContentType(imageData)]
+}
+
+// deleteExpiredExports removes the expired data exports.
+func (rt *_router) deleteExpiredExports() {
+	n, err := rt.db.DeleteExpiredExports()
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("Failed to delete expired exports")
+	}
+	if n > 0 {
+		rt.baseLogger.Infof("Deleted %d expired exports", n)
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// pngImage returns a distinct image for each name, with the signature of a PNG file: enough for its content type to
+// be detected.
+func pngImage(name string) []byte {
+	return []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR" + name)
+}
+
+func TestExportArchive(t *testing.T) {
+	ts := newTestServer(t, nil)
+	token, userID := ts.register("alice")
+	for _, id := range []string{"first", "second"} {
+		photo := database.Photo{ID: id, UserID: userID, ImageData: pngImage(id),
+			Timestamp: time.Now(), Visibility: database.VisibilityPublic, Caption: "photo " + id}
+		if err := ts.db.AddPhoto(photo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, body := ts.request(http.MethodPost, "/users/me/export", token, "")
+	if status != http.StatusAccepted {
+		t.Fatalf("export request: %d %s", status, body)
+	}
+	var export struct {
+		DownloadURL string `json:"downloadUrl"`
+	}
+	if err := json.Unmarshal([]byte(body), &export); err != nil {
+		t.Fatal(err)
+	}
+
+	// The archive is built in the background
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var exports []database.Export
+		_, body = ts.request(http.MethodGet, "/users/me/export", token, "")
+		if err := json.Unmarshal([]byte(body), &exports); err != nil {
+			t.Fatal(err)
+		}
+		if exports[0].State != database.ExportPending {
+			if exports[0].State != database.ExportReady {
+				t.Fatalf("export %s", exports[0].State)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the export is still pending")
+		}
+	}
+
+	status, body = ts.request(http.MethodGet, export.DownloadURL, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("download: %d", status)
+	}
+	archive, err := zip.NewReader(bytes.NewReader([]byte(body)), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var manifest database.Takeout
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("manifest.json: %v", err)
+	}
+	if manifest.Account.Username != "alice" || len(manifest.Photos) != 2 {
+		t.Fatalf("manifest of %s with %d photos", manifest.Account.Username, len(manifest.Photos))
+	}
+	for _, p := range manifest.Photos {
+		want := "photos/" + p.PhotoID + ".png"
+		if p.File != want {
+			t.Errorf("photo %s is in %q, want %q", p.PhotoID, p.File, want)
+		}
+		if !bytes.Equal(files[want], pngImage(p.PhotoID)) {
+			t.Errorf("%s does not hold the image of photo %s", want, p.PhotoID)
+		}
+	}
+	if len(files) != 3 {
+		t.Errorf("%d files in the archive, want the manifest and 2 photos", len(files))
+	}
+}
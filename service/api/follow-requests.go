@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleGetFollowRequests lists the pending follow requests sent to the caller, oldest first, one page at a time.
+func handleGetFollowRequests(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	requests, err := ctx.Database.GetFollowRequests(ctx.User.ID, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get follow requests")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(requests)
+}
+
+// handleAnswerFollowRequest approves (PUT) or rejects (DELETE) the follow request of a user. Rejected users are not
+// told: they can send a new request.
+func handleAnswerFollowRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	requesterID := ps.ByName("userID")
+
+	var err error
+	if r.Method == http.MethodPut {
+		err = ctx.Database.ApproveFollowRequest(ctx.User.ID, requesterID)
+	} else {
+		err = ctx.Database.RejectFollowRequest(ctx.User.ID, requesterID)
+	}
+	if errors.Is(err, database.ErrFollowRequestNotFound) {
+		http.Error(w, "Follow request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to answer follow request")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPut {
+		ctx.Logger.Infof("User %s approved the follow request of %s", ctx.User.Username, requesterID)
+	} else {
+		ctx.Logger.Infof("User %s rejected the follow request of %s", ctx.User.Username, requesterID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// doubleSubmits is how many times the same write is sent at once
+const doubleSubmits = 8
+
+// TestConcurrentDoubleSubmits sends the same like, follow and ban many times at once: exactly one request must create
+// the relationship (201), the others must find it in place (204), and a single row must be stored.
+func TestConcurrentDoubleSubmits(t *testing.T) {
+	ts := newTestServer(t, nil)
+	aliceToken, aliceID := ts.login("alice")
+	_, bobID := ts.login("bob")
+	_, carolID := ts.login("carol")
+	err := ts.db.AddPhoto(database.Photo{ID: "photo00001", UserID: bobID, Timestamp: time.Now(),
+		Visibility: database.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		query string
+		args  []interface{}
+	}{
+		{"like", "/photos/photo00001/likes", `SELECT COUNT(*) FROM likes WHERE user_id = ? AND photo_id = ?`,
+			[]interface{}{aliceID, "photo00001"}},
+		{"follow", "/users/follows/" + bobID, `SELECT COUNT(*) FROM followers WHERE user_id = ? AND follower_id = ?`,
+			[]interface{}{bobID, aliceID}},
+		{"ban", "/users/bans/" + carolID, `SELECT COUNT(*) FROM new_bans WHERE banned_by = ? AND banned_user = ?`,
+			[]interface{}{aliceID, carolID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statuses := make([]int, doubleSubmits)
+			bodies := make([]string, doubleSubmits)
+			var wg sync.WaitGroup
+			for i := range statuses {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					statuses[i], bodies[i] = ts.request(http.MethodPut, tt.path, aliceToken, "")
+				}(i)
+			}
+			wg.Wait()
+
+			sort.Ints(statuses)
+			want := []int{http.StatusCreated}
+			for len(want) < doubleSubmits {
+				want = append(want, http.StatusNoContent)
+			}
+			for i := range want {
+				if statuses[i] != want[i] {
+					t.Fatalf("statuses = %v, want one 201 and 204 for the others (bodies: %q)", statuses, bodies)
+				}
+			}
+			if n := ts.count(tt.query, tt.args...); n != 1 {
+				t.Errorf("%d rows stored, want 1", n)
+			}
+
+			// Once settled, the write is still idempotent
+			if status, body := ts.request(http.MethodPut, tt.path, aliceToken, ""); status != http.StatusNoContent {
+				t.Errorf("PUT %s again = %d %s, want 204", tt.path, status, body)
+			}
+		})
+	}
+}
@@ -1,82 +1,78 @@
 package api
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
 
 	"encoding/json"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"github.com/julienschmidt/httprouter"
 )
 
-// HandleLikePhoto processes the request to like a photo
+// HandleLikePhoto processes the request to like a photo. Liking a photo twice is not an error.
 func HandleLikePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	photoID := ps.ByName("photoId") // Assuming you're using httprouter and path parameter named "photoId"
-	userID := ctx.User.ID           // Assuming `ctx` has a User object with ID field
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	photoID := ps.ByName("photoId")
+	userID := ctx.User.ID
 
 	// Log the action
-	ctx.Logger.Info("Liking photo", "userID", userID, "photoID", photoID)
+	ctx.Logger.Infof("User %s liking photo %s", userID, photoID)
 
 	// Call LikePhoto method of the database object
-	err := ctx.Database.LikePhoto(userID, photoID)
-	if err != nil {
-		ctx.Logger.Error("Error liking photo", "error", err)
+	created, err := ctx.Database.LikePhoto(userID, photoID)
+	if errors.Is(err, database.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Error liking photo")
 		http.Error(w, "Failed to like photo", http.StatusInternalServerError)
 		return
 	}
-
-	// Successfully liked the photo
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "Photo liked successfully")
+	writeCreated(w, created)
 }
 
-// HandleUnlikePhoto processes the request to unlike a photo
+// HandleUnlikePhoto processes the request to unlike a photo. Unliking a photo that is not liked is not an error.
 func HandleUnlikePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Use a map to hold the JSON payload for simplicity
-	var data map[string]string
-
-	// Decode the JSON body into the map
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	defer r.Body.Close()
-
+	photoID := ps.ByName("photoId")
 	userID := ctx.User.ID
-	photoID, ok := data["photoId"]
-	if !ok {
-		http.Error(w, "Photo ID is required", http.StatusBadRequest)
-		return
-	}
 
 	// Log the action
-	ctx.Logger.Info("Unliking photo", "userID", userID, "photoID", photoID)
+	ctx.Logger.Infof("User %s unliking photo %s", userID, photoID)
 
 	// Call UnlikePhoto method of the database object
 	err := ctx.Database.UnlikePhoto(userID, photoID)
 	if err != nil {
-		ctx.Logger.Error("Error unliking photo", "error", err)
+		ctx.Logger.WithError(err).Error("Error unliking photo")
 		http.Error(w, "Failed to unlike photo", http.StatusInternalServerError)
 		return
 	}
-
-	// Successfully unliked the photo
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "Photo unliked successfully")
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func HandleIsLiked(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	photoID := ps.ByName("photoId") // Assuming you're using httprouter and path parameter named "photoId"
-	userID := ctx.User.ID           // Assuming `ctx` has a User object with ID field
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	photoID := ps.ByName("photoId")
+	userID := ctx.User.ID
 
 	// Log the action
-	ctx.Logger.Info("Checking if photo is liked", "userID", userID, "photoID", photoID)
+	ctx.Logger.Infof("Checking if photo %s is liked by %s", photoID, userID)
 
 	// Call IsLiked method of the database object
-	liked, err := ctx.Database.IsLiked(userID, photoID)
+	liked, err := ctx.Database.IsLiked(photoID, userID)
 	if err != nil {
-		ctx.Logger.Error("Error checking if photo is liked", "error", err)
+		ctx.Logger.WithError(err).Error("Error checking if photo is liked")
 		http.Error(w, "Failed to check if photo is liked", http.StatusInternalServerError)
 		return
 	}
@@ -86,3 +82,31 @@ func HandleIsLiked(w http.ResponseWriter, r *http.Request, ps httprouter.Params,
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]bool{"liked": liked})
 }
+
+// handleGetLikers returns the users who liked a photo, one page at a time
+func handleGetLikers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	photoID := ps.ByName("photoId")
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	likers, err := ctx.Database.GetLikers(photoID, ctx.User.ID, page)
+	if errors.Is(err, database.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get likers")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(likers)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleMuteUser makes the caller mute the posts, the comments, or both, of a user. Without a body, both are muted;
+// otherwise only the fields set to true are. Muting a muted user again replaces what is muted.
+func handleMuteUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Posts    bool `json:"posts"`
+		Comments bool `json:"comments"`
+	}
+	if r.ContentLength == 0 {
+		req.Posts, req.Comments = true, true
+	} else {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if !req.Posts && !req.Comments {
+		writeViolations(w, []violation{{"posts", "posts or comments must be muted"}})
+		return
+	}
+
+	userID := ps.ByName("userId")
+	created, err := ctx.Database.MuteUser(ctx.User.ID, userID, req.Posts, req.Comments)
+	if errors.Is(err, database.ErrSelfTarget) {
+		http.Error(w, "You cannot mute yourself", http.StatusUnprocessableEntity)
+		return
+	} else if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to mute user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s muted by %s", userID, ctx.User.Username)
+	writeCreated(w, created)
+}
+
+// handleUnmuteUser makes the caller unmute a user. Unmuting a user who is not muted is not an error.
+func handleUnmuteUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID := ps.ByName("userId")
+	if err := ctx.Database.UnmuteUser(ctx.User.ID, userID); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to unmute user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s unmuted by %s", userID, ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetMutes lists the users muted by the caller, most recent first, one page at a time. Nobody else can see them.
+func handleGetMutes(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutes, err := ctx.Database.GetMutes(ctx.User.ID, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get mutes")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(mutes)
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// notificationActions tell what the actors of each type of notification did, see describeNotification
+var notificationActions = map[string]string{
+	database.NotifyLike:          "liked your photo",
+	database.NotifyComment:       "commented on your photo",
+	database.NotifyReply:         "replied to your comment",
+	database.NotifyMention:       "mentioned you in a photo",
+	database.NotifyFollow:        "started following you",
+	database.NotifyFollowRequest: "asked to follow you",
+}
+
+// handleGetNotifications lists the notifications of the caller, most recent first, one page at a time, with how many
+// of them are unread.
+func handleGetNotifications(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	notifications, unread, err := ctx.Database.GetNotifications(ctx.User.ID, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get notifications")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for i := range notifications {
+		notifications[i].Message = describeNotification(notifications[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Unread        int                     `json:"unread"`
+		Notifications []database.Notification `json:"notifications"`
+	}{unread, notifications})
+}
+
+// describeNotification tells what happened, naming the most recent actors: "alice and 5 others liked your photo".
+func describeNotification(n database.Notification) string {
+	action := notificationActions[n.Type]
+	if n.Type == database.NotifyMention && n.CommentID != "" {
+		action = "mentioned you in a comment"
+	}
+	if len(n.Actors) == 0 {
+		return ""
+	}
+	switch {
+	case n.ActorCount == 2 && len(n.Actors) == 2:
+		return n.Actors[0].Username + " and " + n.Actors[1].Username + " " + action
+	case n.ActorCount == 2:
+		return n.Actors[0].Username + " and 1 other " + action
+	case n.ActorCount > 2:
+		return fmt.Sprintf("%s and %d others %s", n.Actors[0].Username, n.ActorCount-1, action)
+	default:
+		return n.Actors[0].Username + " " + action
+	}
+}
+
+// handleMarkNotificationRead marks a notification of the caller as read.
+func handleMarkNotificationRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	err := ctx.Database.MarkNotificationRead(ctx.User.ID, ps.ByName("notificationID"))
+	if errors.Is(err, database.ErrNotificationNotFound) {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to mark notification read")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMarkAllNotificationsRead marks all the notifications of the caller as read.
+func handleMarkAllNotificationsRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, err := ctx.Database.MarkAllNotificationsRead(ctx.User.ID); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to mark notifications read")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetNotificationPreferences returns, for every type of notification, whether the caller receives it.
+func handleGetNotificationPreferences(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeNotificationPreferences(w, ctx)
+}
+
+// handleUpdateNotificationPreferences turns on or off the types of notifications in the request body, e.g.
+// {"like": false}, and returns the preferences of the caller. Types missing from the body are left untouched.
+func handleUpdateNotificationPreferences(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var violations []violation
+	for kind := range req {
+		if _, ok := notificationActions[kind]; !ok {
+			violations = append(violations, violation{kind, "is not a type of notification"})
+		}
+	}
+	if len(violations) > 0 {
+		sort.Slice(violations, func(i, j int) bool { return violations[i].Field < violations[j].Field })
+		writeViolations(w, violations)
+		return
+	}
+
+	if err := ctx.Database.SetNotificationPreferences(ctx.User.ID, req); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to set notification preferences")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeNotificationPreferences(w, ctx)
+}
+
+// writeNotificationPreferences writes the notification preferences of the caller to w.
+func writeNotificationPreferences(w http.ResponseWriter, ctx reqcontext.RequestContext) {
+	preferences, err := ctx.Database.GetNotificationPreferences(ctx.User.ID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get notification preferences")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(preferences)
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/username"
+	"github.com/julienschmidt/httprouter"
+)
+
+// oidcLoginLifetime is how long the browser can take to sign in at the provider and come back
+const oidcLoginLifetime = 10 * time.Minute
+
+// handleListProviders lists the names of the OpenID Connect providers that can be used to sign in.
+func (rt *_router) handleListProviders(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	type provider struct {
+		Name string `json:"name"`
+	}
+	providers := make([]provider, 0, len(rt.providers))
+	for _, p := range rt.providerList {
+		providers = append(providers, provider{p.Name})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(providers)
+}
+
+// handleOIDCAuthorize starts a login at a provider. With POST, the URL where the browser must be sent is returned; if
+// the caller is signed in, the identity will be linked to their account instead. Callers using a legacy token are
+// refused: user IDs are public, so anybody could link their own identity to the account and lock its owner out. With
+// GET (a plain link), the browser is redirected to the provider right away.
+func (rt *_router) handleOIDCAuthorize(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	p, ok := rt.providers[ps.ByName("provider")]
+	if !ok {
+		http.Error(w, "Provider not found", http.StatusNotFound)
+		return
+	}
+	if ctx.Legacy && r.Method == http.MethodPost {
+		http.Error(w, "Identities cannot be linked with a legacy token", http.StatusForbidden)
+		return
+	}
+
+	login, err := oidc.NewLogin()
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to start login")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	authURL, err := p.AuthCodeURL(login)
+	if err != nil {
+		ctx.Logger.WithError(err).Errorf("Provider %s is not available", p.Name)
+		http.Error(w, "Provider not available", http.StatusBadGateway)
+		return
+	}
+
+	stored := database.OIDCLogin{
+		StateHash: hashToken(login.State),
+		Provider:  p.Name,
+		Nonce:     login.Nonce,
+		Verifier:  login.Verifier,
+		ExpiresAt: globaltime.Now().Add(oidcLoginLifetime),
+	}
+	if ctx.User != nil && r.Method == http.MethodPost {
+		stored.UserID = ctx.User.ID
+	}
+	if err := ctx.Database.CreateOIDCLogin(stored); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to store login")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		http.Redirect(w, r, authURL, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		AuthorizationURL string `json:"authorizationUrl"`
+	}{authURL})
+}
+
+// handleOIDCCallback completes a login when the provider sends the browser back. The user linked to the identity is
+// signed in; if there is none, a new user is created, named after the username given by the provider when possible.
+func (rt *_router) handleOIDCCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	p, ok := rt.providers[ps.ByName("provider")]
+	if !ok {
+		http.Error(w, "Provider not found", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("error") != "" {
+		http.Error(w, "Login refused by the provider: "+q.Get("error"), http.StatusUnauthorized)
+		return
+	}
+
+	login, err := ctx.Database.ConsumeOIDCLogin(hashToken(q.Get("state")))
+	if errors.Is(err, database.ErrOIDCLoginInvalid) || (err == nil && login.Provider != p.Name) {
+		http.Error(w, "Invalid or expired login", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get login")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := p.Exchange(q.Get("code"), oidc.Login{State: q.Get("state"), Nonce: login.Nonce, Verifier: login.Verifier})
+	if errors.Is(err, oidc.ErrInvalidToken) {
+		ctx.Logger.WithError(err).Warningf("Provider %s sent an invalid ID token", p.Name)
+		http.Error(w, "Invalid identity", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Errorf("Failed to complete login at provider %s", p.Name)
+		http.Error(w, "Provider not available", http.StatusBadGateway)
+		return
+	}
+	identity := database.ExternalIdentity{Issuer: id.Issuer, Subject: id.Subject}
+
+	var user *database.User
+	status := http.StatusOK
+	if login.UserID != "" {
+		err = ctx.Database.LinkIdentity(login.UserID, identity)
+		if errors.Is(err, database.ErrIdentityLinked) {
+			http.Error(w, "This identity is linked to another user", http.StatusConflict)
+			return
+		}
+		user = &database.User{ID: login.UserID}
+	} else {
+		user, err = ctx.Database.GetExternalUser(identity)
+		if err == nil && user == nil {
+			user, err = registerExternalUser(ctx, id)
+			status = http.StatusCreated
+		}
+	}
+	var creds *database.Credentials
+	if err == nil {
+		creds, err = ctx.Database.GetCredentials(user.ID)
+	}
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to sign in with external identity")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if creds.Suspended {
+		recordLogin(ctx, user.ID, "user.login_failed", "suspended")
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
+	ctx.Logger.Infof("User %s signed in with provider %s", user.ID, p.Name)
+
+	if rt.frontendURL == "" {
+		rt.startSession(w, ctx, user, "oidc:"+p.Name, status)
+		return
+	}
+	// The token is sent to the web UI in the fragment of the URL, which browsers do not send to servers
+	token, err := newSession(ctx, user.ID, "oidc:"+p.Name)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to create session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, rt.frontendURL+"?"+url.Values{"token": {token}, "userId": {user.ID}}.Encode(), http.StatusSeeOther)
+}
+
+// registerExternalUser creates the user for a new external identity. The username given by the provider is used if it
+// is acceptable and free, otherwise a random one is chosen: users can change it later.
+func registerExternalUser(ctx reqcontext.RequestContext, id *oidc.Identity) (*database.User, error) {
+	identity := database.ExternalIdentity{Issuer: id.Issuer, Subject: id.Subject}
+	if id.PreferredUsername != "" && len(username.Validate(id.PreferredUsername)) == 0 {
+		user := &database.User{Username: id.PreferredUsername}
+		err := ctx.Database.RegisterExternalUser(user, identity, id.Email)
+		if !errors.Is(err, database.ErrUsernameTaken) {
+			return user, err
+		}
+	}
+
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	user := &database.User{Username: "user_" + hex.EncodeToString(b)}
+	return user, ctx.Database.RegisterExternalUser(user, identity, id.Email)
+}
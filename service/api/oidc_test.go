@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc/fakeidp"
+)
+
+// newOIDCTestServer starts the API with two providers, "fake" and "other", both backed by the same fake identity
+// provider.
+func newOIDCTestServer(t *testing.T) *testServer {
+	t.Helper()
+	idp := fakeidp.New()
+	srv := httptest.NewServer(idp)
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+
+	var providers []*oidc.Provider
+	for _, name := range []string{"fake", "other"} {
+		providers = append(providers, &oidc.Provider{Name: name, Issuer: srv.URL, ClientID: "decaf", Client: srv.Client()})
+	}
+	ts := newTestServer(t, func(cfg *Config) { cfg.OIDCProviders = providers })
+	for _, p := range providers {
+		p.RedirectURL = ts.URL + "/oidc/" + p.Name + "/callback"
+	}
+	return ts
+}
+
+// oidcLogin is a login started at the API, completed at the provider and waiting for the callback.
+type oidcLogin struct {
+	Status   int    // Of the POST to the authorize endpoint
+	Callback string // Path and query of the callback, if the login was started
+}
+
+// startOIDCLogin starts a login at provider with the given token (if any), and signs in at the provider as name, like a
+// browser would. The callback is not called.
+func (ts *testServer) startOIDCLogin(provider string, token string, name string) oidcLogin {
+	ts.t.Helper()
+	status, body := ts.request(http.MethodPost, "/oidc/"+provider+"/authorize", token, "")
+	if status != http.StatusOK {
+		return oidcLogin{Status: status}
+	}
+	var start struct {
+		AuthorizationURL string `json:"authorizationUrl"`
+	}
+	if err := json.Unmarshal([]byte(body), &start); err != nil {
+		ts.t.Fatal(err)
+	}
+
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(start.AuthorizationURL + "&login_hint=" + url.QueryEscape(name))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		ts.t.Fatalf("authorization answered %s (%v)", resp.Status, err)
+	}
+	return oidcLogin{Status: status, Callback: back.RequestURI()}
+}
+
+// finish calls the callback of the login, and returns the status and the session, if one was started.
+func (l oidcLogin) finish(ts *testServer) (int, string, string) {
+	ts.t.Helper()
+	status, body := ts.request(http.MethodGet, l.Callback, "", "")
+	var session struct {
+		Token  string `json:"token"`
+		UserID string `json:"userId"`
+	}
+	if status == http.StatusOK || status == http.StatusCreated {
+		if err := json.Unmarshal([]byte(body), &session); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+	return status, session.Token, session.UserID
+}
+
+func TestOIDCLogin(t *testing.T) {
+	ts := newOIDCTestServer(t)
+
+	login := ts.startOIDCLogin("fake", "", "alice")
+	status, token, userID := login.finish(ts)
+	if status != http.StatusCreated || token == "" {
+		t.Fatalf("first login: %d", status)
+	}
+	if status, body := ts.request(http.MethodGet, "/users/me/tokens", token, ""); status != http.StatusOK {
+		t.Errorf("session refused: %d %s", status, body)
+	}
+	if n := ts.count(`SELECT COUNT(*) FROM users WHERE user_id = ? AND username = 'alice'`, userID); n != 1 {
+		t.Error("the user was not named after the identity")
+	}
+
+	// The state can be used only once
+	if status, _, _ := login.finish(ts); status != http.StatusBadRequest {
+		t.Errorf("replayed callback: %d, want 400", status)
+	}
+
+	status, _, again := ts.startOIDCLogin("fake", "", "alice").finish(ts)
+	if status != http.StatusOK || again != userID {
+		t.Errorf("second login: %d as %s, want 200 as %s", status, again, userID)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	ts := newOIDCTestServer(t)
+
+	// A login started for a provider cannot be completed at another one
+	login := ts.startOIDCLogin("fake", "", "alice")
+	login.Callback = "/oidc/other" + login.Callback[len("/oidc/fake"):]
+	if status, _, _ := login.finish(ts); status != http.StatusBadRequest {
+		t.Errorf("callback of another provider: %d, want 400", status)
+	}
+
+	if status, _, _ := (oidcLogin{Callback: "/oidc/fake/callback?state=forged&code=forged"}).finish(ts); status != http.StatusBadRequest {
+		t.Errorf("unknown state: %d, want 400", status)
+	}
+
+	// An ID token issued for another login is refused
+	login = ts.startOIDCLogin("fake", "", "alice")
+	if _, err := ts.conn.Exec(`UPDATE oidc_logins SET nonce = 'another nonce'`); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := login.finish(ts); status != http.StatusUnauthorized {
+		t.Errorf("wrong nonce: %d, want 401", status)
+	}
+	if n := ts.count(`SELECT COUNT(*) FROM users`); n != 0 {
+		t.Errorf("%d users were created", n)
+	}
+}
+
+func TestOIDCLink(t *testing.T) {
+	ts := newOIDCTestServer(t)
+	aliceToken, aliceID := ts.register("alice")
+	bobToken, _ := ts.register("bob")
+
+	status, _, userID := ts.startOIDCLogin("fake", aliceToken, "alice").finish(ts)
+	if status != http.StatusOK || userID != aliceID {
+		t.Fatalf("link: %d as %s, want 200 as %s", status, userID, aliceID)
+	}
+	status, _, userID = ts.startOIDCLogin("fake", "", "alice").finish(ts)
+	if status != http.StatusOK || userID != aliceID {
+		t.Errorf("login with the linked identity: %d as %s, want 200 as %s", status, userID, aliceID)
+	}
+
+	if status, _, _ := ts.startOIDCLogin("fake", bobToken, "alice").finish(ts); status != http.StatusConflict {
+		t.Errorf("link of an identity already linked: %d, want 409", status)
+	}
+
+	legacyToken, _ := ts.login("carol")
+	if login := ts.startOIDCLogin("fake", legacyToken, "carol"); login.Status != http.StatusForbidden {
+		t.Errorf("link with a legacy token: %d, want 403", login.Status)
+	}
+	if n := ts.count(`SELECT COUNT(*) FROM oidc_logins`); n != 0 {
+		t.Errorf("%d logins left", n)
+	}
+}
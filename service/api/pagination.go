@@ -0,0 +1,37 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// parsePage reads the `limit` and `offset` query parameters of a list request. Missing values fall back to the first
+// page of defaultPageLimit items.
+func parsePage(r *http.Request) (database.Page, error) {
+	page := database.Page{Limit: defaultPageLimit}
+	query := r.URL.Query()
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return page, errors.New("limit must be a number between 1 and 100")
+		}
+		page.Limit = limit
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return page, errors.New("offset must be a non-negative number")
+		}
+		page.Offset = offset
+	}
+	return page, nil
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"time"
@@ -15,6 +16,9 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
+// maxCaptionLength is the length of the longest photo caption
+const maxCaptionLength = 2200
+
 type Comment struct {
 	ID        string    `json:"commentId" db:"comment_id"` // Unique identifier
 	UserID    string    `json:"userId" db:"user_id"`       // ID of the user who commented
@@ -40,42 +44,41 @@ func handleUploadPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	}
 	userId := ctx.User.ID
 	ctx.Logger.Info("Called successfully")
-	// Read image data from the request body
-	// Parse the multipart form
-	err := r.ParseMultipartForm(10 << 20) // For example, max 10 MB file size
+	// Read the image from the multipart form
+	ImageData, err := readImage(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest) // Sets the status code only
 		return
 	}
 
-	// Retrieve the file from form data
-	file, _, err := r.FormFile("image") // "image" should be the name of your file input field
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest) // Sets the status code only
+	ctx.Logger.Info("Received image data length: ", len(ImageData))
+	// The audience of the photo can be chosen when posting it, and changed later (see handleSetPhotoVisibility)
+	visibility := r.FormValue("visibility")
+	if visibility == "" {
+		visibility = database.VisibilityPublic
+	} else if !validVisibilities[visibility] {
+		writeViolations(w, []violation{{"visibility", "must be public, followers, close_friends or only_me"}})
 		return
 	}
-	defer file.Close()
-
-	// Read the file data
-	ImageData, err := ioutil.ReadAll(file)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest) // Sets the status code only
+	caption := r.FormValue("caption")
+	if violations := checkText(nil, "caption", caption, maxCaptionLength, true); len(violations) > 0 {
+		writeViolations(w, violations)
 		return
 	}
-	defer r.Body.Close()
 
-	ctx.Logger.Info("Received image data length: ", len(ImageData))
 	// Set current time as Timestamp
 	Timestamp := time.Now()
 
 	// Create a Photo struct
 	photo := database.Photo{
-		ID:        uuid.Must(uuid.NewV4()).String(),
-		UserID:    userId,
-		ImageData: ImageData,
-		Timestamp: Timestamp,
-		Likes:     []database.Like{},
-		Comments:  []database.Comment{},
+		ID:         uuid.Must(uuid.NewV4()).String(),
+		UserID:     userId,
+		ImageData:  ImageData,
+		Timestamp:  Timestamp,
+		Visibility: visibility,
+		Caption:    caption,
+		Likes:      []database.Like{},
+		Comments:   []database.Comment{},
 	}
 	ctx.Logger.Info("Photo created " + photo.Timestamp.String())
 	// Call AddPhoto method to insert the photo into the database
@@ -97,9 +100,25 @@ func handleUploadPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	}
 }
 
+// readImage reads the image uploaded in the "image" field of a multipart form, up to 10 MB.
+func readImage(r *http.Request) ([]byte, error) {
+	err := r.ParseMultipartForm(10 << 20)
+	if err != nil {
+		return nil, err
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
 func handleGetPhotos(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	// Retrieve all photos from the database
-	photos, err := ctx.Database.GetPhotos()
+	photos, err := ctx.Database.GetPhotos(viewerID(ctx))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError) // Sets the status code only
 		return
@@ -130,15 +149,28 @@ func handleGetMyStream(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	json.NewEncoder(w).Encode(photos)
 }
 
+// handleDeletePhoto deletes a photo of the caller. Administrators delete the photos of other users with
+// handleAdminDeletePhoto.
 func handleDeletePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	photoID := ps.ByName("photoId")
 	if photoID == "" {
 		http.Error(w, "Invalid photo ID", http.StatusBadRequest)
 		return
 	}
 
-	err := ctx.Database.DeletePhoto(photoID)
-	if err != nil {
+	err := ctx.Database.DeletePhoto(actor(ctx), photoID)
+	if errors.Is(err, database.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotOwner) {
+		http.Error(w, "Only the owner can delete a photo", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to delete photo")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -154,8 +186,11 @@ func handleGetPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		return
 	}
 
-	photo, err := ctx.Database.GetPhoto(photoID)
-	if err != nil {
+	photo, err := ctx.Database.GetPhoto(photoID, viewerID(ctx))
+	if errors.Is(err, database.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -173,6 +208,8 @@ func handleGetPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		UserID     string             `json:"userId"`
 		Username   string             `json:"username"`
 		Timestamp  string             `json:"timestamp"`
+		Visibility string             `json:"visibility"`
+		Caption    string             `json:"caption"`
 		ImageData  string             `json:"imageData"`
 		LikesCount int                `json:"likesCount"`
 		Comments   []database.Comment `json:"comments"` // Using fully qualified type name
@@ -181,6 +218,8 @@ func handleGetPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		UserID:     photo.UserID,
 		Username:   photo.Username,
 		Timestamp:  photo.Timestamp.Format(time.RFC3339),
+		Visibility: photo.Visibility,
+		Caption:    photo.Caption,
 		ImageData:  imageData,
 		LikesCount: photo.LikesCount,
 		Comments:   photo.Comments,
@@ -189,3 +228,46 @@ func handleGetPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// validVisibilities are the visibility levels a photo can have
+var validVisibilities = map[string]bool{
+	database.VisibilityPublic:       true,
+	database.VisibilityFollowers:    true,
+	database.VisibilityCloseFriends: true,
+	database.VisibilityOnlyMe:       true,
+}
+
+// handleSetPhotoVisibility changes who can see a photo of the caller. Archiving a photo is setting it to only-me.
+func handleSetPhotoVisibility(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Visibility string `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validVisibilities[req.Visibility] {
+		writeViolations(w, []violation{{"visibility", "must be public, followers, close_friends or only_me"}})
+		return
+	}
+
+	photoID := ps.ByName("photoId")
+	err := ctx.Database.SetPhotoVisibility(ctx.User.ID, photoID, req.Visibility)
+	if errors.Is(err, database.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotOwner) {
+		http.Error(w, "Only the owner can change the visibility of a photo", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to set photo visibility")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Visibility of photo %s set to %s by %s", photoID, req.Visibility, ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
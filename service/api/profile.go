@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 300
+	maxWebsiteLength     = 200
+	maxEmailLength       = 254
+)
+
+// handlePatchUser dispatches PATCH /users/:username: "me" is a reserved name that selects the caller's profile, any
+// other value is the new username of the caller.
+func handlePatchUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ps.ByName("username") == "me" {
+		handleUpdateProfile(w, r, ps, ctx)
+		return
+	}
+	HandleSetUsername(w, r, ps, ctx)
+}
+
+// handleUpdateProfile changes the display name, bio, website, e-mail address and privacy of the caller. Fields missing
+// from the request body are left untouched. The address is private: it is only used to send password reset tokens, so
+// it cannot be set with a legacy token (see handleChangePassword).
+func handleUpdateProfile(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		DisplayName *string `json:"displayName"`
+		Bio         *string `json:"bio"`
+		Website     *string `json:"website"`
+		Email       *string `json:"email"`
+		Private     *bool   `json:"private"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if req.Email != nil && ctx.Legacy {
+		http.Error(w, "An e-mail address cannot be set with a legacy token", http.StatusForbidden)
+		return
+	}
+
+	var violations []violation
+	if req.DisplayName != nil {
+		*req.DisplayName = strings.TrimSpace(*req.DisplayName)
+		violations = checkText(violations, "displayName", *req.DisplayName, maxDisplayNameLength, false)
+	}
+	if req.Bio != nil {
+		*req.Bio = strings.TrimSpace(*req.Bio)
+		violations = checkText(violations, "bio", *req.Bio, maxBioLength, true)
+	}
+	if req.Website != nil {
+		*req.Website = strings.TrimSpace(*req.Website)
+		violations = checkWebsite(violations, *req.Website)
+	}
+	if req.Email != nil {
+		*req.Email = strings.TrimSpace(*req.Email)
+		violations = checkEmail(violations, "email", *req.Email)
+	}
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	err := ctx.Database.UpdateProfile(ctx.User.ID, database.ProfileUpdate{
+		DisplayName: req.DisplayName,
+		Bio:         req.Bio,
+		Website:     req.Website,
+		Email:       req.Email,
+		Private:     req.Private,
+	})
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to update profile")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Profile updated by %s", ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkWebsite appends a violation to vs unless website is empty (no website) or an absolute http(s) URL.
+func checkWebsite(vs []violation, website string) []violation {
+	if website == "" {
+		return vs
+	}
+	if len(website) > maxWebsiteLength {
+		return append(vs, violation{"website", "too long"})
+	}
+	u, err := url.Parse(website)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return append(vs, violation{"website", "must be an http or https URL"})
+	}
+	return vs
+}
+
+// handleSetAvatar replaces the avatar of the caller with the image uploaded in the "image" form field.
+func handleSetAvatar(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	imageData, err := readImage(r)
+	if err != nil {
+		http.Error(w, "Invalid image upload", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(http.DetectContentType(imageData), "image/") {
+		writeViolations(w, []violation{{"image", "must be an image"}})
+		return
+	}
+
+	if err := ctx.Database.SetAvatar(ctx.User.ID, imageData); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to set avatar")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Avatar updated by %s", ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeleteAvatar removes the avatar of the caller.
+func handleDeleteAvatar(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := ctx.Database.DeleteAvatar(ctx.User.ID); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to delete avatar")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetAvatar returns the avatar image of a user.
+func handleGetAvatar(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	imageData, err := ctx.Database.GetAvatar(ps.ByName("userID"))
+	if errors.Is(err, database.ErrAvatarNotFound) {
+		http.Error(w, "Avatar not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get avatar")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(imageData))
+	_, _ = w.Write(imageData)
+}
+
+// handleGetUserPhotos returns the IDs of the photos uploaded by a user, newest first, one page at a time.
+func handleGetUserPhotos(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	photoIDs, err := ctx.Database.GetUserPhotoIDs(ps.ByName("userID"), viewerID(ctx), page)
+	if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get user photos")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(photoIDs)
+}
+
+// viewerID returns the ID of the caller, or an empty string for anonymous requests.
+func viewerID(ctx reqcontext.RequestContext) string {
+	if ctx.User == nil {
+		return ""
+	}
+	return ctx.User.ID
+}
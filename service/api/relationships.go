@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleGetUserFollowers lists the followers of a user, most recent first, one page at a time.
+func handleGetUserFollowers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	writeRelatedUsers(w, r, ps, ctx, ctx.Database.GetFollowers)
+}
+
+// handleGetUserFollowing lists the users followed by a user, most recently followed first, one page at a time.
+func handleGetUserFollowing(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	writeRelatedUsers(w, r, ps, ctx, ctx.Database.GetFollowing)
+}
+
+// handleGetUserMutuals lists the followers of a user that the caller follows, one page at a time.
+func handleGetUserMutuals(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeRelatedUsers(w, r, ps, ctx, ctx.Database.GetMutuals)
+}
+
+// writeRelatedUsers answers with a page of the users listed by list for the user in the path, as seen by the caller.
+func writeRelatedUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext,
+	list func(userID string, viewerID string, page database.Page) ([]database.UserSummary, error)) {
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	users, err := list(ps.ByName("userID"), viewerID(ctx), page)
+	if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrPrivateAccount) {
+		http.Error(w, "This account is private", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get users")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(users)
+}
@@ -0,0 +1,240 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	maxReportCommentLength  = 500
+	maxResolutionNoteLength = 500
+)
+
+// validReportReasons are the categories users choose from when reporting
+var validReportReasons = map[string]bool{
+	"spam":          true,
+	"harassment":    true,
+	"nudity":        true,
+	"violence":      true,
+	"hate":          true,
+	"impersonation": true,
+	"other":         true,
+}
+
+var validReportTargets = map[string]bool{
+	database.TargetPhoto:   true,
+	database.TargetComment: true,
+	database.TargetUser:    true,
+}
+
+// handleCreateReport reports a photo, a comment or a user to the moderators. Reports about the same target are
+// collected in a single report of the moderation queue; reporting the same target twice has no further effect.
+func handleCreateReport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		TargetType string `json:"targetType"`
+		TargetID   string `json:"targetId"`
+		Reason     string `json:"reason"`
+		Comment    string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	req.Comment = strings.TrimSpace(req.Comment)
+	var violations []violation
+	if !validReportTargets[req.TargetType] {
+		violations = append(violations, violation{"targetType", "must be photo, comment or user"})
+	}
+	if req.TargetID == "" {
+		violations = append(violations, violation{"targetId", "is required"})
+	}
+	if !validReportReasons[req.Reason] {
+		violations = append(violations, violation{"reason", "is not a valid reason"})
+	}
+	violations = checkText(violations, "comment", req.Comment, maxReportCommentLength, true)
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	reportID, created, err := ctx.Database.CreateReport(ctx.User.ID, req.TargetType, req.TargetID,
+		database.ReportSubmission{Reason: req.Reason, Comment: req.Comment})
+	if errors.Is(err, database.ErrSelfTarget) {
+		writeViolations(w, []violation{{"targetId", "you cannot report yourself or your own content"}})
+		return
+	} else if errors.Is(err, database.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrCommentNotFound) {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to create report")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		ReportID string `json:"reportId"`
+	}{reportID})
+}
+
+// handleGetReports lists the reports of the moderation queue, the most reported targets first. The queue can be
+// filtered by state and by target type.
+func handleGetReports(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	filter := database.ReportFilter{State: query.Get("state"), TargetType: query.Get("targetType")}
+	var violations []violation
+	switch filter.State {
+	case "", database.ReportOpen, database.ReportActioned, database.ReportDismissed:
+	default:
+		violations = append(violations, violation{"state", "must be open, actioned or dismissed"})
+	}
+	if filter.TargetType != "" && !validReportTargets[filter.TargetType] {
+		violations = append(violations, violation{"targetType", "must be photo, comment or user"})
+	}
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	reports, err := ctx.Database.GetReports(filter, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get reports")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(reports)
+}
+
+// handleGetReport returns a report with the submissions of the single reporters.
+func handleGetReport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	report, submissions, err := ctx.Database.GetReport(ps.ByName("reportId"))
+	if errors.Is(err, database.ErrReportNotFound) {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get report")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		*database.Report
+		Submissions []database.ReportSubmission `json:"submissions"`
+	}{report, submissions})
+}
+
+// handleResolveReport closes an open report. Actioning it hides the reported photo or comment, or suspends the
+// reported user; dismissing it leaves the target alone.
+func handleResolveReport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	var req struct {
+		State string `json:"state"`
+		Note  string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	req.Note = strings.TrimSpace(req.Note)
+	var violations []violation
+	if req.State != database.ReportActioned && req.State != database.ReportDismissed {
+		violations = append(violations, violation{"state", "must be actioned or dismissed"})
+	}
+	violations = checkText(violations, "note", req.Note, maxResolutionNoteLength, true)
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	reportID := ps.ByName("reportId")
+	err := ctx.Database.ResolveReport(actor(ctx), reportID, req.State, req.Note)
+	if errors.Is(err, database.ErrReportNotFound) {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrReportResolved) {
+		http.Error(w, "Report already resolved", http.StatusConflict)
+		return
+	} else if errors.Is(err, database.ErrSelfTarget) {
+		writeViolations(w, []violation{{"state", "administrators cannot suspend themselves"}})
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to resolve report")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Report %s %s by %s", reportID, req.State, ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminHidePhoto hides a photo from everybody (PUT) or shows it again (DELETE).
+func handleAdminHidePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	photoID := ps.ByName("photoId")
+	err := ctx.Database.SetPhotoHidden(actor(ctx), photoID, r.Method == http.MethodPut)
+	if errors.Is(err, database.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to hide photo")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminHideComment hides a comment from everybody (PUT) or shows it again (DELETE).
+func handleAdminHideComment(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !requireAdmin(w, ctx) {
+		return
+	}
+	commentID := ps.ByName("commentId")
+	err := ctx.Database.SetCommentHidden(actor(ctx), commentID, r.Method == http.MethodPut)
+	if errors.Is(err, database.ErrCommentNotFound) {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to hide comment")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
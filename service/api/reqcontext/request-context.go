@@ -16,10 +16,17 @@ import (
 type RequestContext struct {
 	// ReqUUID is the request unique ID
 	ReqUUID uuid.UUID
+	// RemoteIP is the IP address of the client
+	RemoteIP string
 	// Database is the instance of database.AppDatabase where data is saved
 	Database database.AppDatabase
 	// Logger is a custom field logger for the request
 	Logger logrus.FieldLogger
 
 	User *database.User
+	// Scopes are the scopes of the personal access token used for the request, or nil if the user signed in (all
+	// permissions)
+	Scopes []string
+	// Legacy tells that the caller used its ID as token (legacy mode), which anybody could: it cannot set credentials
+	Legacy bool
 }
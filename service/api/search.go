@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxQueryLength is the length of the longest search query
+const maxQueryLength = 50
+
+// handleSearchUsers finds users by the prefix of their username or display name, tolerating typos, best match first.
+func handleSearchUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	query, ok := searchQuery(w, r)
+	if !ok {
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	users, err := ctx.Database.SearchUsers(viewerID(ctx), query, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to search users")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(users)
+}
+
+// handleSearchPhotos finds the photos whose caption or comments contain the words of the query, best match first.
+// Phrases go between double quotes, and words ending with * are matched as prefixes.
+func handleSearchPhotos(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	query, ok := searchQuery(w, r)
+	if !ok {
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	photos, err := ctx.Database.SearchPhotos(viewerID(ctx), query, page)
+	if errors.Is(err, database.ErrSearchUnavailable) {
+		http.Error(w, "Photo search is not available", http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to search photos")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(photos)
+}
+
+// searchQuery returns the search query in the q parameter of the request. If it is missing or too long, it writes the
+// error to w and returns false.
+func searchQuery(w http.ResponseWriter, r *http.Request) (string, bool) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Missing search query", http.StatusBadRequest)
+		return "", false
+	}
+	if utf8.RuneCountInString(query) > maxQueryLength {
+		http.Error(w, "Search query too long", http.StatusBadRequest)
+		return "", false
+	}
+	return query, true
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/mailer"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+// testServer is the API served on a fresh database, for the tests of the handlers
+type testServer struct {
+	*httptest.Server
+	t    *testing.T
+	db   database.AppDatabase
+	conn *sql.DB // For the checks the API cannot make
+}
+
+// newTestServer starts the API on a new database in a temporary directory, in legacy mode. configure, if not nil, can
+// change the configuration before the API is created. Everything is closed when the test ends.
+func newTestServer(t *testing.T, configure func(*Config)) *testServer {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", database.DataSourceName(filepath.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	db, err := database.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg := Config{
+		Logger:        logger,
+		Database:      db,
+		Mailer:        mailer.NewLogMailer(logger),
+		LegacyLogin:   true,
+		PurgeInterval: time.Hour,
+		ExportTTL:     time.Hour,
+		TrendInterval: time.Hour,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	router, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(router.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		_ = router.Close()
+	})
+	return &testServer{Server: srv, t: t, db: db, conn: conn}
+}
+
+// request sends a request with the given token (if any) and JSON body (if not empty), and returns the status and the
+// body of the response.
+func (ts *testServer) request(method string, path string, token string, body string) (int, string) {
+	ts.t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// login signs a user in with the legacy name-only login, creating it if needed, and returns its token and its ID.
+func (ts *testServer) login(name string) (string, string) {
+	ts.t.Helper()
+	status, body := ts.request(http.MethodPost, "/session", "", `{"name":"`+name+`"}`)
+	if status != http.StatusOK && status != http.StatusCreated {
+		ts.t.Fatalf("login of %s: %d %s", name, status, body)
+	}
+	var session struct {
+		Token  string `json:"token"`
+		UserID string `json:"userId"`
+	}
+	if err := json.Unmarshal([]byte(body), &session); err != nil {
+		ts.t.Fatal(err)
+	}
+	return session.Token, session.UserID
+}
+
+// register creates a user with a password, and returns its token and its ID.
+func (ts *testServer) register(name string) (string, string) {
+	ts.t.Helper()
+	status, body := ts.request(http.MethodPost, "/register", "", `{"name":"`+name+`","password":"correct horse battery"}`)
+	if status != http.StatusCreated {
+		ts.t.Fatalf("registration of %s: %d %s", name, status, body)
+	}
+	var session struct {
+		Token  string `json:"token"`
+		UserID string `json:"userId"`
+	}
+	if err := json.Unmarshal([]byte(body), &session); err != nil {
+		ts.t.Fatal(err)
+	}
+	return session.Token, session.UserID
+}
+
+// count returns the result of a COUNT query on the database.
+func (ts *testServer) count(query string, args ...interface{}) int {
+	ts.t.Helper()
+	var n int
+	if err := ts.conn.QueryRow(query, args...).Scan(&n); err != nil {
+		ts.t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,410 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/mailer"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/password"
+	"github.com/julienschmidt/httprouter"
+)
+
+// A token is sent by clients in the Authorization header, with or without the "Bearer " prefix. It is either a session
+// token, returned by the login and the registration, a personal access token (see access-tokens.go), or (in legacy
+// mode only) the ID of a user without a password.
+
+// authToken returns the token sent with the request, or "" if there is none.
+func authToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// authenticate returns the user who sent the request, or nil for anonymous requests, the scopes of the personal
+// access token used, or nil if it was not a personal access token, and whether the token was a legacy one (the ID of
+// the user). Unknown tokens are treated as anonymous, so that a stale token does not prevent the client from logging
+// in again.
+func (rt *_router) authenticate(r *http.Request) (*database.User, []string, bool, error) {
+	token := authToken(r)
+	if token == "" {
+		return nil, nil, false, nil
+	}
+	if strings.HasPrefix(token, accessTokenPrefix) {
+		user, scopes, err := rt.db.UseAccessToken(hashToken(token))
+		if user == nil || err != nil {
+			return nil, nil, false, err
+		}
+		return user, scopes, false, nil
+	}
+	user, err := rt.db.GetSessionUser(hashToken(token))
+	if err != nil || user != nil || !rt.legacyLogin {
+		return user, nil, false, err
+	}
+	user, err = rt.db.GetLegacyUser(token)
+	return user, nil, user != nil, err
+}
+
+// newToken returns a new random token, and its hash to be stored in the database.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generating token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hash of a token as stored in the database. Tokens are random, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeSession replies with the token the client must use from now on.
+func writeSession(w http.ResponseWriter, status int, token string, userID string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Token  string `json:"token"`
+		UserID string `json:"userId"`
+	}{token, userID})
+}
+
+// newSession opens a new session for a user and returns its token. method is how the user signed in, recorded in the
+// audit log.
+func newSession(ctx reqcontext.RequestContext, userID string, method string) (string, error) {
+	token, tokenHash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	return token, ctx.Database.CreateSession(actor(ctx), userID, tokenHash, method)
+}
+
+// startSession opens a new session for user and replies with its token.
+func (rt *_router) startSession(w http.ResponseWriter, ctx reqcontext.RequestContext, user *database.User, method string, status int) {
+	token, err := newSession(ctx, user.ID, method)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to create session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeSession(w, status, token, user.ID)
+}
+
+// doLogin signs a user in. Users with a password must always give it, and users linked to an external identity can
+// only use the password (if they set one) or their provider. Administrators can never sign in with just their name. In
+// legacy mode, the other users sign in with just their name (and are created if they do not exist), and get their ID
+// as token.
+func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Check if user exists
+	user, err := ctx.Database.GetUserByUsername(req.Name)
+	if err != nil {
+		ctx.Logger.Error("Error retrieving user: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var creds *database.Credentials
+	if user != nil {
+		creds, err = ctx.Database.GetCredentials(user.ID)
+		if err != nil {
+			ctx.Logger.WithError(err).Error("Error retrieving credentials")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.Password != "" || !rt.legacyLogin || (creds != nil && (creds.PasswordHash != "" || creds.Identities > 0 || creds.Admin)) {
+		// Unknown users are checked against an empty hash, which takes as long as a real one and never matches
+		var hash string
+		if creds != nil {
+			hash = creds.PasswordHash
+		}
+		ok, err := password.Verify(req.Password, hash)
+		if err != nil {
+			ctx.Logger.WithError(err).Error("Error verifying password")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			if user != nil {
+				recordLogin(ctx, user.ID, "user.login_failed", "password")
+			}
+			http.Error(w, "Invalid name or password", http.StatusUnauthorized)
+			return
+		}
+		if creds.Suspended {
+			recordLogin(ctx, user.ID, "user.login_failed", "suspended")
+			http.Error(w, "Account suspended", http.StatusForbidden)
+			return
+		}
+		rt.startSession(w, ctx, user, "password", http.StatusOK)
+		return
+	}
+
+	if creds != nil && creds.Suspended {
+		recordLogin(ctx, user.ID, "user.login_failed", "suspended")
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
+	status := http.StatusOK
+	if user == nil {
+		// User does not exist, create new one. The username policy is checked only here, so that users created
+		// before it existed can still log in.
+		if violations := checkUsername(nil, "name", req.Name); len(violations) > 0 {
+			writeViolations(w, violations)
+			return
+		}
+		user = &database.User{Username: req.Name}
+		err = ctx.Database.AddUser(user)
+		if err != nil {
+			if errors.Is(err, database.ErrUsernameTaken) {
+				http.Error(w, "Username already exists", http.StatusConflict)
+				return
+			}
+			ctx.Logger.Error("Failed to create user: ", err)
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusCreated
+	}
+
+	// Legacy users use their ID as token. Signing in cancels the deletion of the account, as sessions do.
+	if status == http.StatusOK {
+		if err = ctx.Database.RestoreUser(actor(ctx), user.ID); err != nil {
+			ctx.Logger.WithError(err).Error("Failed to restore user")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	recordLogin(ctx, user.ID, "user.login", "legacy")
+	writeSession(w, status, user.ID, user.ID)
+}
+
+// recordLogin adds a login that opens no session (a failed one, or a legacy one) to the audit log. Errors are only
+// logged: the login goes on anyway.
+func recordLogin(ctx reqcontext.RequestContext, userID string, action string, details string) {
+	err := ctx.Database.RecordAuditEvent(actor(ctx), database.AuditEvent{
+		Action:     action,
+		TargetType: "user",
+		TargetID:   userID,
+		Details:    details,
+	})
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to record login")
+	}
+}
+
+// handleLogout closes the session of the caller. Legacy tokens cannot be revoked: they are accepted until the user
+// sets a password.
+func (rt *_router) handleLogout(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := ctx.Database.DeleteSession(hashToken(authToken(r))); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to close session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRegister creates a user with a password, and signs it in.
+func (rt *_router) handleRegister(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	req.Email = strings.TrimSpace(req.Email)
+	violations := checkUsername(nil, "name", req.Name)
+	violations = checkPassword(violations, "password", req.Password)
+	violations = checkEmail(violations, "email", req.Email)
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	hash, err := password.Hash(req.Password)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to hash password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	user := &database.User{Username: req.Name}
+	err = ctx.Database.RegisterUser(user, hash, req.Email)
+	if errors.Is(err, database.ErrUsernameTaken) {
+		http.Error(w, "Username already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to register user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s registered", user.Username)
+	rt.startSession(w, ctx, user, "register", http.StatusCreated)
+}
+
+// handleChangePassword sets a new password for the caller. The current password is required if there is one. All the
+// sessions of the caller are closed, and a new one is opened. Legacy tokens cannot set a password: user IDs are public,
+// so anybody could take the account over and lock its owner out.
+func (rt *_router) handleChangePassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if ctx.Legacy {
+		http.Error(w, "A password cannot be set with a legacy token", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	creds, err := ctx.Database.GetCredentials(ctx.User.ID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error retrieving credentials")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if creds.PasswordHash != "" {
+		ok, err := password.Verify(req.CurrentPassword, creds.PasswordHash)
+		if err != nil {
+			ctx.Logger.WithError(err).Error("Error verifying password")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Wrong current password", http.StatusForbidden)
+			return
+		}
+	}
+	if violations := checkPassword(nil, "newPassword", req.NewPassword); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	hash, err := password.Hash(req.NewPassword)
+	if err == nil {
+		err = ctx.Database.SetPassword(actor(ctx), ctx.User.ID, hash)
+	}
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to set password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Password changed by %s", ctx.User.Username)
+	rt.startSession(w, ctx, ctx.User, "password_change", http.StatusOK)
+}
+
+// handleRequestPasswordReset mails a password reset token to the address of a user. The reply is the same whether the
+// user exists and has an address or not, so that it cannot be used to find out.
+func (rt *_router) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := rt.sendPasswordReset(ctx, req.Name); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to send password reset")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (rt *_router) sendPasswordReset(ctx reqcontext.RequestContext, name string) error {
+	user, err := ctx.Database.GetUserByUsername(name)
+	if err != nil || user == nil {
+		return err
+	}
+	creds, err := ctx.Database.GetCredentials(user.ID)
+	if err != nil || creds.Email == "" {
+		return err
+	}
+
+	token, tokenHash, err := newToken()
+	if err != nil {
+		return err
+	}
+	err = ctx.Database.CreatePasswordReset(user.ID, tokenHash, globaltime.Now().Add(password.ResetTokenLifetime))
+	if err != nil {
+		return err
+	}
+	return rt.mailer.Send(mailer.Message{
+		To:      creds.Email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("Somebody asked to reset the password of %s. If it was you, use this token to choose a new "+
+			"password within %d minutes:\n\n%s\n\nOtherwise, you can ignore this message.",
+			user.Username, int(password.ResetTokenLifetime.Minutes()), token),
+	})
+}
+
+// handleResetPassword sets a new password using a token sent by handleRequestPasswordReset.
+func (rt *_router) handleResetPassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if violations := checkPassword(nil, "newPassword", req.NewPassword); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	hash, err := password.Hash(req.NewPassword)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to hash password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	userID, err := ctx.Database.ResetPassword(actor(ctx), hashToken(req.Token), hash)
+	if errors.Is(err, database.ErrResetTokenInvalid) {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to reset password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("Password reset for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,13 @@
+package api
+
+import "net/http"
+
+// writeCreated answers an idempotent write on a relationship (like, follow, ban): 201 when the request created it,
+// 204 when it was already in place.
+func writeCreated(w http.ResponseWriter, created bool) {
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// suggestionActivityWindow is how far back photos count as recent activity when ranking suggestions
+const suggestionActivityWindow = 7 * 24 * time.Hour
+
+// handleGetSuggestions lists the users the caller may want to follow, best first, one page at a time.
+func handleGetSuggestions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	suggestions, err := ctx.Database.GetSuggestions(ctx.User.ID, globaltime.Now().Add(-suggestionActivityWindow), page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get suggestions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for i := range suggestions {
+		suggestions[i].Explanation = explainSuggestion(suggestions[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(suggestions)
+}
+
+// explainSuggestion tells why a user is suggested, from the strongest signal: "Followed by alice and 3 others".
+func explainSuggestion(s database.Suggestion) string {
+	switch {
+	case s.MutualFollowers == 1:
+		return "Followed by " + s.MutualExample
+	case s.MutualFollowers == 2:
+		return "Followed by " + s.MutualExample + " and 1 other"
+	case s.MutualFollowers > 2:
+		return fmt.Sprintf("Followed by %s and %d others", s.MutualExample, s.MutualFollowers-1)
+	case s.RecentPhotos > 0:
+		return "Recently active"
+	default:
+		return "Popular"
+	}
+}
+
+// handleDismissSuggestion stops suggesting a user to the caller.
+func handleDismissSuggestion(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	err := ctx.Database.DismissSuggestion(ctx.User.ID, ps.ByName("userID"))
+	if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to dismiss suggestion")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/hashtag"
+	"github.com/julienschmidt/httprouter"
+)
+
+// validTrendWindows are the windows tags can trend over
+var validTrendWindows = map[string]bool{
+	database.TrendHour: true,
+	database.TrendDay:  true,
+	database.TrendWeek: true,
+}
+
+// validTagSorts are the orders of the photos of a tag page
+var validTagSorts = map[string]bool{
+	database.TagSortRecent: true,
+	database.TagSortTop:    true,
+}
+
+// handleGetTrendingTags lists the tags whose usage grew the most in the window given in the query (24h by default),
+// as of the last run of computeTagTrends.
+func handleGetTrendingTags(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = database.TrendDay
+	} else if !validTrendWindows[window] {
+		http.Error(w, "window must be 1h, 24h or 7d", http.StatusBadRequest)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tags, err := ctx.Database.GetTrendingTags(window, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get trending tags")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tags)
+}
+
+// handleGetTag returns the page of a tag: how many photos have it and how many users follow it.
+func handleGetTag(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	tag, ok := tagParam(w, ps)
+	if !ok {
+		return
+	}
+	t, err := ctx.Database.GetTag(tag, viewerID(ctx))
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get tag")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(t)
+}
+
+// handleGetTagPhotos lists the IDs of the photos with a tag, most recent (sort=recent, the default) or most liked
+// (sort=top) first, one page at a time.
+func handleGetTagPhotos(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	tag, ok := tagParam(w, ps)
+	if !ok {
+		return
+	}
+	sort := r.URL.Query().Get("sort")
+	if sort == "" {
+		sort = database.TagSortRecent
+	} else if !validTagSorts[sort] {
+		http.Error(w, "sort must be recent or top", http.StatusBadRequest)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ids, err := ctx.Database.GetTagPhotoIDs(tag, viewerID(ctx), sort, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get tag photos")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ids)
+}
+
+// handleFollowTag makes the caller follow a tag: its photos join the stream. Following a tag twice is not an error.
+func handleFollowTag(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	tag, ok := tagParam(w, ps)
+	if !ok {
+		return
+	}
+	created, err := ctx.Database.FollowTag(ctx.User.ID, tag)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to follow tag")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s followed tag %s", ctx.User.Username, tag)
+	writeCreated(w, created)
+}
+
+// handleUnfollowTag makes the caller stop following a tag. Unfollowing a tag not followed is not an error.
+func handleUnfollowTag(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	tag, ok := tagParam(w, ps)
+	if !ok {
+		return
+	}
+	if err := ctx.Database.UnfollowTag(ctx.User.ID, tag); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to unfollow tag")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.Infof("User %s unfollowed tag %s", ctx.User.Username, tag)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetFollowedTags lists the tags followed by the caller, most recently followed first, one page at a time.
+func handleGetFollowedTags(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tags, err := ctx.Database.GetFollowedTags(ctx.User.ID, page)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get followed tags")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tags)
+}
+
+// tagParam returns the tag in the path, as compared by hashtag.Key: "#Travel", "travel" and "TRAVEL" are the same tag.
+// If it is not a tag, it writes the error to w and returns false.
+func tagParam(w http.ResponseWriter, ps httprouter.Params) (string, bool) {
+	tag := hashtag.Key(ps.ByName("tag"))
+	if !hashtag.Valid(tag) {
+		http.Error(w, "Invalid tag", http.StatusBadRequest)
+		return "", false
+	}
+	return tag, true
+}
+
+// computeTagTrends refreshes the trending tags.
+func (rt *_router) computeTagTrends() {
+	if err := rt.db.ComputeTagTrends(globaltime.Now()); err != nil {
+		rt.baseLogger.WithError(err).Error("Failed to compute trending tags")
+	}
+}
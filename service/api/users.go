@@ -2,12 +2,14 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
-
-	"strings"
+	"net/url"
+	"strconv"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -21,10 +23,15 @@ func HandleAddUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params,
 	}
 	defer r.Body.Close()
 
+	if violations := checkUsername(nil, "username", user.Username); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
 	ctx.Logger.Info("Adding user to the database")
 	err := db.AddUser(&user)
 	if err != nil {
-		if strings.Contains(err.Error(), "username already exists") {
+		if errors.Is(err, database.ErrUsernameTaken) {
 			http.Error(w, "Username already exists", http.StatusConflict) // Use HTTP 409 Conflict for username conflicts
 			return
 		}
@@ -39,19 +46,38 @@ func HandleAddUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params,
 }
 
 func HandleSetUsername(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	// Get the new username from URL parameters if needed
 	newUsername := ps.ByName("username")
 	if newUsername == "" {
 		http.Error(w, "New username must be provided", http.StatusBadRequest)
 		return
 	}
-	ctx.Logger.Info("CurrentID: ", ctx.User.ID)
+	if violations := checkUsername(nil, "username", newUsername); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
 
-	currentUserID := ctx.User.ID // Ensure that ctx.User is populated correctly in the middleware
+	currentUserID := ctx.User.ID
 
 	ctx.Logger.Info("Setting new username for user ID: ", currentUserID)
-	err := ctx.Database.SetUsername(currentUserID, newUsername)
-	if err != nil {
+	err := ctx.Database.SetUsername(actor(ctx), newUsername)
+	var limitErr *database.RenameLimitError
+	if errors.As(err, &limitErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(limitErr.RetryAt.Sub(globaltime.Now()).Seconds())+1))
+		http.Error(w, "Too many username changes, try again later", http.StatusTooManyRequests)
+		return
+	} else if errors.Is(err, database.ErrUsernameTaken) {
+		http.Error(w, "Username already exists", http.StatusConflict)
+		return
+	} else if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		ctx.Logger.Error("Failed to update username: ", err)
 		http.Error(w, "Failed to update username", http.StatusInternalServerError)
 		return
@@ -62,91 +88,66 @@ func HandleSetUsername(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	json.NewEncoder(w).Encode(map[string]string{"message": "Username updated successfully"})
 }
 
+// HandleGetUserProfileID returns the profile of a user, with counts and the relationship flags of the caller
 func HandleGetUserProfileID(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	userID := ps.ByName("userID") // Assuming userID is the URL parameter
 
 	ctx.Logger.Info("Retrieving user profile for userID: ", userID)
-	user, err := ctx.Database.GetUserProfileByID(userID)
-	if err != nil {
-		ctx.Logger.Error("User not found: ", err)
+	profile, err := ctx.Database.GetProfile(userID, viewerID(ctx))
+	if errors.Is(err, database.ErrUserNotFound) {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
-}
-
-func doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var req struct {
-		Name string `json:"name"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
-	// Check if user exists
-	user, err := ctx.Database.GetUserByUsername(req.Name)
-	if err != nil {
-		ctx.Logger.Error("Error retrieving user: ", err)
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to get user profile")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if user == nil {
-		// User does not exist, create new one
-		user = &database.User{Username: req.Name}
-		err = ctx.Database.AddUser(user) // Directly call AddUser now
-		if err != nil {
-			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-				http.Error(w, "Username already exists", http.StatusConflict)
-				return
-			}
-			ctx.Logger.Error("Failed to create user: ", err)
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusCreated)
-	} else {
-		w.WriteHeader(http.StatusOK)
-	}
-
-	// Return the userId as a token
-	response := struct {
-		Token string `json:"token"`
-	}{
-		Token: user.ID, // Use userId as the token directly
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		ctx.Logger.Error("Error encoding response: ", err)
-		http.Error(w, "Error encoding response", http.StatusInternalServerError)
-	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
 }
 
+// HandleFollowUser makes the caller follow a user. Following a user twice is not an error. Users with a private
+// account are sent a follow request instead, answered with 202 Accepted until they approve it.
 func HandleFollowUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	userId := ps.ByName("userId") // Extracting username from URL parameter
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userId := ps.ByName("userId")
 
 	followerID := ctx.User.ID
 
-	var err = ctx.Database.FollowUser(followerID, userId)
-	if err != nil {
+	state, err := ctx.Database.FollowUser(followerID, userId)
+	if errors.Is(err, database.ErrSelfTarget) {
+		http.Error(w, "You cannot follow yourself", http.StatusUnprocessableEntity)
+		return
+	} else if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		ctx.Logger.Errorf("Error following user: %v", err)
 		http.Error(w, "Failed to follow user", http.StatusInternalServerError)
 		return
 	}
+	if state == database.FollowRequested {
+		ctx.Logger.Infof("User %s asked to follow %s", ctx.User.Username, userId)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
 	ctx.Logger.Infof("User %s followed %s", ctx.User.Username, userId)
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "User Followed successfully"})
+	writeCreated(w, state == database.FollowStarted)
 }
 
+// HandleUnfollowUser makes the caller stop following a user, or withdraws its follow request. Unfollowing a user that
+// is not followed is not an error.
 func HandleUnfollowUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	userId := ps.ByName("userId") // Extracting username from URL parameter
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userId := ps.ByName("userId")
 
 	ctx.Logger.Infof("Unfollowing user: %s", userId)
 
@@ -158,13 +159,16 @@ func HandleUnfollowUser(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		return
 	}
 	ctx.Logger.Infof("User %s unfollowed %s", ctx.User.Username, userId)
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "User Unfollowed successfully"})
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // get all users
+// HandleGetAllUsers lists all the users, to signed-in users only.
 func HandleGetAllUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ctx.User == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	users, err := ctx.Database.GetAllUsers()
 	if err != nil {
 		ctx.Logger.Errorf("Failed to get all users: %v", err)
@@ -184,8 +188,36 @@ func handleGetFollowers(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		return
 	}
 
-	followers, err := ctx.Database.GetFollowersByUsername(username)
+	page, err := parsePage(r)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Usernames released by a rename keep working for a while, redirecting to the current one. The redirect is
+	// temporary: once the grace period is over, the old username may be claimed by somebody else.
+	user, renamed, err := ctx.Database.ResolveUsername(username)
+	if err != nil {
+		ctx.Logger.Error("Failed to resolve username: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	} else if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if renamed {
+		target := url.URL{Path: "/users/followers/" + url.PathEscape(user.Username), RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	followers, err := ctx.Database.GetFollowersByUsername(username, viewerID(ctx), page)
+	if errors.Is(err, database.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrPrivateAccount) {
+		http.Error(w, "This account is private", http.StatusForbidden)
+		return
+	} else if err != nil {
 		ctx.Logger.Error("Failed to retrieve followers: ", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
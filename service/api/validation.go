@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"unicode"
+	"unicode/utf8"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/password"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/username"
+)
+
+// violation describes why a field of a request was rejected
+type violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// writeViolations replies with HTTP 422 and the list of violations found in the request.
+func writeViolations(w http.ResponseWriter, violations []violation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_ = json.NewEncoder(w).Encode(struct {
+		Violations []violation `json:"violations"`
+	}{violations})
+}
+
+// checkText appends a violation to vs if the text is longer than maxLen characters or contains control characters.
+// Newlines are accepted only if multiline is true.
+func checkText(vs []violation, field, text string, maxLen int, multiline bool) []violation {
+	if utf8.RuneCountInString(text) > maxLen {
+		vs = append(vs, violation{field, "too long"})
+	}
+	for _, r := range text {
+		if unicode.IsControl(r) && !(multiline && r == '\n') {
+			vs = append(vs, violation{field, "contains control characters"})
+			break
+		}
+	}
+	return vs
+}
+
+// checkUsername appends to vs the reasons why name is not an acceptable username (see package username).
+func checkUsername(vs []violation, field, name string) []violation {
+	for _, message := range username.Validate(name) {
+		vs = append(vs, violation{field, message})
+	}
+	return vs
+}
+
+// checkPassword appends to vs the reasons why pw is not an acceptable password (see package password).
+func checkPassword(vs []violation, field, pw string) []violation {
+	for _, message := range password.Validate(pw) {
+		vs = append(vs, violation{field, message})
+	}
+	return vs
+}
+
+// checkEmail appends a violation to vs unless email is empty (no address) or a plain e-mail address, without a display
+// name.
+func checkEmail(vs []violation, field, email string) []violation {
+	if email == "" {
+		return vs
+	}
+	if len(email) > maxEmailLength {
+		return append(vs, violation{field, "too long"})
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return append(vs, violation{field, "must be an e-mail address"})
+	}
+	return vs
+}
@@ -0,0 +1,137 @@
+package database
+
+// Personal access tokens. Like session tokens, they are stored as hashes computed by the caller.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// CreateAccessToken stores a new personal access token for the actor. The ID and the creation time of token are set
+// here.
+func (db *appdbimpl) CreateAccessToken(actor Actor, token *AccessToken, tokenHash string) error {
+	id, err := generateRandomString(10)
+	if err != nil {
+		return fmt.Errorf("failed to generate token ID: %w", err)
+	}
+	token.ID = id
+	token.CreatedAt = globaltime.Now().UTC()
+	token.LastUsedAt = nil
+
+	var expiresAt sql.NullTime
+	if token.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: token.ExpiresAt.UTC(), Valid: true}
+	}
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec(`INSERT INTO access_tokens (token_id, user_id, name, token_hash, scopes, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		token.ID, actor.UserID, token.Name, tokenHash, strings.Join(token.Scopes, " "), token.CreatedAt, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create access token: %w", err)
+	}
+	if err = recordAudit(tx, actor, "token.create", "token", token.ID, "", nil, token); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// GetAccessTokens returns the personal access tokens of a user, expired ones included, newest first.
+func (db *appdbimpl) GetAccessTokens(userID string) ([]AccessToken, error) {
+	rows, err := db.c.Query(`SELECT token_id, name, scopes, created_at, expires_at, last_used_at FROM access_tokens
+        WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query access tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []AccessToken{}
+	for rows.Next() {
+		var t AccessToken
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &scopes, &t.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan access token: %w", err)
+		}
+		t.Scopes = strings.Fields(scopes)
+		t.ExpiresAt = nullTime(expiresAt)
+		t.LastUsedAt = nullTime(lastUsedAt)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAccessToken revokes a personal access token of the actor. ErrAccessTokenNotFound is returned if the actor has
+// no such token.
+func (db *appdbimpl) DeleteAccessToken(actor Actor, tokenID string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	token := AccessToken{ID: tokenID}
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	err = tx.QueryRow(`DELETE FROM access_tokens WHERE token_id = ? AND user_id = ?
+        RETURNING name, scopes, created_at, expires_at, last_used_at`, tokenID, actor.UserID).Scan(
+		&token.Name, &scopes, &token.CreatedAt, &expiresAt, &lastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrAccessTokenNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to delete access token: %w", err)
+	}
+	token.Scopes = strings.Fields(scopes)
+	token.ExpiresAt = nullTime(expiresAt)
+	token.LastUsedAt = nullTime(lastUsedAt)
+
+	if err = recordAudit(tx, actor, "token.revoke", "token", tokenID, "", token, nil); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// UseAccessToken returns the user and the scopes of the personal access token with the given hash, and records that
+// it was used. Nil is returned if there is no such token, if it has expired, or if the user is suspended or deleted.
+func (db *appdbimpl) UseAccessToken(tokenHash string) (*User, []string, error) {
+	now := globaltime.Now().UTC()
+	var user User
+	var scopes string
+	err := db.c.QueryRow(`UPDATE access_tokens SET last_used_at = ?
+        WHERE token_hash = ? AND (expires_at IS NULL OR expires_at > ?)
+        AND user_id IN (SELECT user_id FROM users WHERE suspended_at IS NULL AND deleted_at IS NULL)
+        RETURNING user_id, scopes`, now, tokenHash, now).Scan(&user.ID, &scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to use access token: %w", err)
+	}
+	err = db.c.QueryRow(`SELECT username, role FROM users WHERE user_id = ?`, user.ID).Scan(&user.Username, &user.Role)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get token user: %w", err)
+	}
+	return &user, strings.Fields(scopes), nil
+}
+
+// nullTime converts a nullable column to a pointer, nil for NULL.
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
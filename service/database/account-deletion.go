@@ -0,0 +1,203 @@
+package database
+
+// Account deletion. A deleted account is deactivated at once: its sessions are closed, its tokens stop working, and
+// its profile and its content are seen by nobody (see deletedUsersSQL). Signing in again restores it. After a grace
+// period, PurgeDeletedUsers removes it for good, with every row that refers to it.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// deletion is the state of the deletion of a user recorded in the audit log
+type deletion struct {
+	DeletedAt *time.Time `json:"deletedAt"` // Nil if the account is active
+}
+
+// purge is the last state of a purged user recorded in the audit log, with the number of rows removed by table
+type purge struct {
+	DeletedAt *time.Time     `json:"deletedAt"`
+	Removed   map[string]int `json:"removed"`
+}
+
+// DeleteUser deactivates the account of a user, and returns when it was deleted. Deleting a deleted account again
+// changes nothing. ErrUserNotFound is returned if there is no such user.
+func (db *appdbimpl) DeleteUser(actor Actor, userID string) (time.Time, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var deletedAt sql.NullTime
+	err = tx.QueryRow(`SELECT deleted_at FROM users WHERE user_id = ?`, userID).Scan(&deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrUserNotFound
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	if deletedAt.Valid {
+		return deletedAt.Time, nil
+	}
+
+	now := globaltime.Now().UTC()
+	if _, err = tx.Exec(`UPDATE users SET deleted_at = ? WHERE user_id = ?`, now, userID); err != nil {
+		return time.Time{}, fmt.Errorf("failed to delete user: %w", err)
+	}
+	// Access tokens are kept, like for suspensions: they work again if the account is restored
+	if _, err = tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		return time.Time{}, fmt.Errorf("failed to close sessions: %w", err)
+	}
+	if err = recordAudit(tx, actor, "user.delete", "user", userID, "", deletion{}, deletion{DeletedAt: &now}); err != nil {
+		return time.Time{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return time.Time{}, fmt.Errorf("failed to commit: %w", err)
+	}
+	return now, nil
+}
+
+// RestoreUser cancels the deletion of an account that was not purged yet. Restoring an active account changes nothing.
+// ErrUserNotFound is returned if there is no such user.
+func (db *appdbimpl) RestoreUser(actor Actor, userID string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = restoreUser(tx, actor, userID); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// restoreUser cancels the deletion of an account within tx; see RestoreUser.
+func restoreUser(tx *sql.Tx, actor Actor, userID string) error {
+	var deletedAt sql.NullTime
+	err := tx.QueryRow(`SELECT deleted_at FROM users WHERE user_id = ?`, userID).Scan(&deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	if !deletedAt.Valid {
+		return nil
+	}
+	if _, err = tx.Exec(`UPDATE users SET deleted_at = NULL WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to restore user: %w", err)
+	}
+	return recordAudit(tx, actor, "user.restore", "user", userID, "", deletion{DeletedAt: nullTime(deletedAt)}, deletion{})
+}
+
+// PurgeDeletedUsers removes for good the accounts deleted before deletedBefore, and returns their IDs. Each account is
+// removed in its own transaction, with its photos, comments, likes, follows, bans, avatar, credentials, reports and
+// exports; comments and likes of other users on its photos go as well. The audit log keeps its events.
+func (db *appdbimpl) PurgeDeletedUsers(deletedBefore time.Time) ([]string, error) {
+	userIDs, err := db.queryIDs(`SELECT user_id FROM users WHERE deleted_at IS NOT NULL AND deleted_at < ?
+        ORDER BY deleted_at`, deletedBefore.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deleted users: %w", err)
+	}
+	purged := []string{}
+	for _, userID := range userIDs {
+		ok, err := db.purgeUser(userID, deletedBefore)
+		if err != nil {
+			return purged, err
+		}
+		if ok {
+			purged = append(purged, userID)
+		}
+	}
+	return purged, nil
+}
+
+// purgeSteps remove the rows that refer to the user bound as @user, in order. The photos of the user go last, after
+// the rows that refer to them.
+var purgeSteps = []struct {
+	table string
+	query string
+}{
+	{"likes", `DELETE FROM likes WHERE user_id = @user
+        OR photo_id IN (SELECT photo_id FROM new_photos WHERE user_id = @user)`},
+	{"comments", `DELETE FROM comments WHERE user_id = @user
+        OR photo_id IN (SELECT photo_id FROM new_photos WHERE user_id = @user)`},
+	{"user_photos", `DELETE FROM user_photos WHERE user_id = @user
+        OR photo_id IN (SELECT photo_id FROM new_photos WHERE user_id = @user)`},
+	{"notification_actors", `DELETE FROM notification_actors WHERE actor_id = @user
+        OR notification_id IN (SELECT notification_id FROM notifications WHERE user_id = @user
+            OR photo_id IN (SELECT photo_id FROM new_photos WHERE user_id = @user))`},
+	{"notifications", `DELETE FROM notifications WHERE user_id = @user
+        OR photo_id IN (SELECT photo_id FROM new_photos WHERE user_id = @user)
+        OR notification_id NOT IN (SELECT notification_id FROM notification_actors)`},
+	{"notification_preferences", `DELETE FROM notification_preferences WHERE user_id = @user`},
+	{"photo_tags", `DELETE FROM photo_tags WHERE photo_id IN (SELECT photo_id FROM new_photos WHERE user_id = @user)`},
+	{"new_photos", `DELETE FROM new_photos WHERE user_id = @user`},
+	{"avatars", `DELETE FROM avatars WHERE user_id = @user`},
+	{"followers", `DELETE FROM followers WHERE user_id = @user OR follower_id = @user`},
+	{"follow_requests", `DELETE FROM follow_requests WHERE user_id = @user OR requester_id = @user`},
+	{"close_friends", `DELETE FROM close_friends WHERE user_id = @user OR friend_id = @user`},
+	{"mutes", `DELETE FROM mutes WHERE user_id = @user OR muted_id = @user`},
+	{"tag_follows", `DELETE FROM tag_follows WHERE user_id = @user`},
+	{"suggestion_dismissals", `DELETE FROM suggestion_dismissals WHERE user_id = @user OR dismissed_id = @user`},
+	{"new_bans", `DELETE FROM new_bans WHERE banned_by = @user OR banned_user = @user`},
+	{"report_submissions", `DELETE FROM report_submissions WHERE reporter_id = @user
+        OR report_id IN (SELECT report_id FROM reports WHERE target_owner = @user)`},
+	{"reports", `DELETE FROM reports WHERE target_owner = @user
+        OR report_id NOT IN (SELECT report_id FROM report_submissions)`},
+	{"exports", `DELETE FROM exports WHERE user_id = @user`},
+	{"sessions", `DELETE FROM sessions WHERE user_id = @user`},
+	{"password_resets", `DELETE FROM password_resets WHERE user_id = @user`},
+	{"access_tokens", `DELETE FROM access_tokens WHERE user_id = @user`},
+	{"identities", `DELETE FROM identities WHERE user_id = @user`},
+	{"oidc_logins", `DELETE FROM oidc_logins WHERE user_id = @user`},
+	{"username_history", `DELETE FROM username_history WHERE user_id = @user`},
+}
+
+// purgeUser removes a deleted account, and reports whether it did: the account may have been restored in the meantime.
+func (db *appdbimpl) purgeUser(userID string, deletedBefore time.Time) (bool, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var deletedAt sql.NullTime
+	err = tx.QueryRow(`SELECT deleted_at FROM users WHERE user_id = ?`, userID).Scan(&deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get user: %w", err)
+	}
+	if !deletedAt.Valid || !deletedAt.Time.Before(deletedBefore) {
+		return false, nil
+	}
+
+	state := purge{DeletedAt: nullTime(deletedAt), Removed: map[string]int{}}
+	for _, step := range purgeSteps {
+		res, err := tx.Exec(step.query, sql.Named("user", userID))
+		if err != nil {
+			return false, fmt.Errorf("failed to purge %s: %w", step.table, err)
+		}
+		if state.Removed[step.table], err = affected(res); err != nil {
+			return false, err
+		}
+	}
+	if _, err = tx.Exec(`DELETE FROM users WHERE user_id = ?`, userID); err != nil {
+		return false, fmt.Errorf("failed to purge user: %w", err)
+	}
+	if err = recordAudit(tx, Actor{}, "user.purge", "user", userID, "", state, nil); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+	return true, nil
+}
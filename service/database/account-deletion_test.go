@@ -0,0 +1,103 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurgeReports(t *testing.T) {
+	db := newTestDB(t)
+	ids := addUsers(t, db, "alice", "bob", "carol")
+	report := func(reporter string, target string) string {
+		t.Helper()
+		reportID, _, err := db.CreateReport(ids[reporter], TargetUser, ids[target], ReportSubmission{Reason: "spam"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reportID
+	}
+	aboutAlice := report("bob", "alice")
+	report("carol", "alice")
+	onlyByAlice := report("alice", "bob")
+	aboutCarol := report("alice", "carol")
+	report("bob", "carol")
+
+	if _, err := db.DeleteUser(Actor{}, ids["alice"]); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := db.PurgeDeletedUsers(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 {
+		t.Fatalf("purged %v", purged)
+	}
+
+	// The reports about alice go with their submissions, and so do the reports only alice submitted
+	reports, err := db.queryIDs(`SELECT report_id FROM reports`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0] != aboutCarol {
+		t.Errorf("reports left: %v, want only %s (not %s or %s)", reports, aboutCarol, aboutAlice, onlyByAlice)
+	}
+	reporters, err := db.queryIDs(`SELECT reporter_id FROM report_submissions`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reporters) != 1 || reporters[0] != ids["bob"] {
+		t.Errorf("submissions left by %v, want only bob", reporters)
+	}
+}
+
+func TestLikesOfDeletedUsers(t *testing.T) {
+	db := newTestDB(t)
+	ids := addUsers(t, db, "alice", "bob")
+	now := time.Now()
+	for i, id := range []string{"liked", "newer"} {
+		photo := Photo{ID: id, UserID: ids["alice"], Timestamp: now.Add(time.Duration(i) * time.Minute),
+			Visibility: VisibilityPublic, Caption: "#coffee"}
+		if err := db.AddPhoto(photo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.LikePhoto(ids["bob"], "liked"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(want int, top string) {
+		t.Helper()
+		photo, err := db.GetPhoto("liked", ids["alice"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if photo.LikesCount != want {
+			t.Errorf("GetPhoto counts %d likes, want %d", photo.LikesCount, want)
+		}
+		takeout, err := db.GetTakeout(ids["alice"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if takeout.Photos[0].Likes != want {
+			t.Errorf("GetTakeout counts %d likes, want %d", takeout.Photos[0].Likes, want)
+		}
+		photos, err := db.GetTagPhotoIDs("coffee", ids["alice"], TagSortTop, Page{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(photos) != 2 || photos[0] != top {
+			t.Errorf("top photos %v, want %s first", photos, top)
+		}
+	}
+	check(1, "liked")
+
+	// The like is not counted while bob's account is being deleted, and is counted again once the account is restored
+	if _, err := db.DeleteUser(Actor{}, ids["bob"]); err != nil {
+		t.Fatal(err)
+	}
+	check(0, "newer")
+	if err := db.RestoreUser(Actor{}, ids["bob"]); err != nil {
+		t.Fatal(err)
+	}
+	check(1, "liked")
+}
@@ -0,0 +1,211 @@
+package database
+
+// Administrative actions. Each of them is recorded in the audit log (see audit.go).
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// SetRole sets the role of a user. Setting the role a user already has is not recorded. ErrUserNotFound is returned if
+// there is no such user.
+func (db *appdbimpl) SetRole(actor Actor, userID string, role string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var oldRole string
+	err = tx.QueryRow(`SELECT role FROM users WHERE user_id = ?`, userID).Scan(&oldRole)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to get role: %w", err)
+	}
+	if oldRole == role {
+		return nil
+	}
+	_, err = tx.Exec(`UPDATE users SET role = ? WHERE user_id = ?`, role, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set role: %w", err)
+	}
+	err = recordAudit(tx, actor, "user.role", "user", userID, "",
+		map[string]string{"role": oldRole}, map[string]string{"role": role})
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// suspension is the state of the suspension of a user recorded in the audit log
+type suspension struct {
+	SuspendedAt *time.Time `json:"suspendedAt"` // Nil if the user is not suspended
+	Reason      string     `json:"reason"`
+}
+
+// getSuspension returns the suspension of a user, or ErrUserNotFound.
+func getSuspension(tx *sql.Tx, userID string) (suspension, error) {
+	var s suspension
+	var suspendedAt sql.NullTime
+	err := tx.QueryRow(`SELECT suspended_at, suspension_reason FROM users WHERE user_id = ?`,
+		userID).Scan(&suspendedAt, &s.Reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, ErrUserNotFound
+	} else if err != nil {
+		return s, fmt.Errorf("failed to get suspension: %w", err)
+	}
+	s.SuspendedAt = nullTime(suspendedAt)
+	return s, nil
+}
+
+// SuspendUser suspends a user, who is signed out everywhere and cannot sign in until unsuspended. Suspending a
+// suspended user only replaces the reason. ErrSelfTarget and ErrUserNotFound are returned for the actor itself and for
+// unknown users.
+func (db *appdbimpl) SuspendUser(actor Actor, userID string, reason string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = suspendUser(tx, actor, userID, reason); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func suspendUser(tx *sql.Tx, actor Actor, userID string, reason string) error {
+	if actor.UserID == userID {
+		return ErrSelfTarget
+	}
+	before, err := getSuspension(tx, userID)
+	if err != nil {
+		return err
+	}
+	after := suspension{SuspendedAt: before.SuspendedAt, Reason: reason}
+	if after.SuspendedAt == nil {
+		now := globaltime.Now().UTC()
+		after.SuspendedAt = &now
+	}
+	_, err = tx.Exec(`UPDATE users SET suspended_at = ?, suspension_reason = ? WHERE user_id = ?`,
+		*after.SuspendedAt, reason, userID)
+	if err != nil {
+		return fmt.Errorf("failed to suspend user: %w", err)
+	}
+	// Personal access tokens are kept: they stop working while the user is suspended
+	_, err = tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to close sessions: %w", err)
+	}
+	return recordAudit(tx, actor, "user.suspend", "user", userID, "", before, after)
+}
+
+// UnsuspendUser lifts the suspension of a user. Unsuspending a user who is not suspended is not recorded.
+// ErrUserNotFound is returned if there is no such user.
+func (db *appdbimpl) UnsuspendUser(actor Actor, userID string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	before, err := getSuspension(tx, userID)
+	if err != nil || before.SuspendedAt == nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE users SET suspended_at = NULL, suspension_reason = '' WHERE user_id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to unsuspend user: %w", err)
+	}
+	if err = recordAudit(tx, actor, "user.unsuspend", "user", userID, "", before, suspension{}); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// AdminDeletePhoto removes the photo of any user, with its comments and likes. ErrPhotoNotFound is returned if there
+// is no such photo.
+func (db *appdbimpl) AdminDeletePhoto(actor Actor, photoID string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	photo, err := deletePhoto(tx, photoID)
+	if err != nil {
+		return err
+	}
+	if err = recordAudit(tx, actor, "photo.delete", "photo", photoID, "", photo, nil); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// AdminDeleteComment removes the comment of any user. ErrCommentNotFound is returned if there is no such comment.
+func (db *appdbimpl) AdminDeleteComment(actor Actor, commentID string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	comment, _, err := deleteComment(tx, commentID)
+	if err != nil {
+		return err
+	}
+	if err = recordAudit(tx, actor, "comment.delete", "comment", commentID, "", comment, nil); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// ForceUsername renames any user, like SetUsername but without the limit on the number of renames.
+func (db *appdbimpl) ForceUsername(actor Actor, userID string, newUsername string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = setUsername(tx, actor, userID, newUsername, false); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// checkUserExistsTx is checkUserExists within a transaction.
+func checkUserExistsTx(tx *sql.Tx, userID string) error {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE user_id = ?)`, userID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check user: %w", err)
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	return nil
+}
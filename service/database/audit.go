@@ -0,0 +1,141 @@
+package database
+
+// The audit log: security-relevant actions, written by the methods that perform them in the same transaction as the
+// action itself. The audit_events table is append-only (see New).
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// RecordAuditEvent adds an event to the audit log, for actions that do not change the database otherwise (for example,
+// a failed login). The ID, the time and the actor of the event are filled in; Before and After are taken as they are.
+func (db *appdbimpl) RecordAuditEvent(actor Actor, event AuditEvent) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Empty snapshots are stored as NULL, not as JSON null
+	var before, after interface{}
+	if event.Before != nil {
+		before = event.Before
+	}
+	if event.After != nil {
+		after = event.After
+	}
+	if err = recordAudit(tx, actor, event.Action, event.TargetType, event.TargetID, event.Details, before, after); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// GetAuditEvents returns a page of the audit events matching the filter, most recent first.
+func (db *appdbimpl) GetAuditEvents(filter AuditFilter, page Page) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	err := db.queryAuditEvents(filter, "DESC LIMIT @limit OFFSET @offset", []interface{}{
+		sql.Named("limit", page.Limit), sql.Named("offset", page.Offset),
+	}, func(e AuditEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	return events, err
+}
+
+// ExportAuditEvents calls fn for each audit event matching the filter, oldest first, and stops at the first error.
+// Events are not loaded in memory all together, so the whole log can be exported.
+func (db *appdbimpl) ExportAuditEvents(filter AuditFilter, fn func(AuditEvent) error) error {
+	return db.queryAuditEvents(filter, "ASC", nil, fn)
+}
+
+func (db *appdbimpl) queryAuditEvents(filter AuditFilter, order string, args []interface{}, fn func(AuditEvent) error) error {
+	var since, until sql.NullTime
+	if !filter.Since.IsZero() {
+		since = sql.NullTime{Time: filter.Since.UTC(), Valid: true}
+	}
+	if !filter.Until.IsZero() {
+		until = sql.NullTime{Time: filter.Until.UTC(), Valid: true}
+	}
+	args = append(args, sql.Named("actor", filter.ActorID), sql.Named("action", filter.Action),
+		sql.Named("target_type", filter.TargetType), sql.Named("target_id", filter.TargetID),
+		sql.Named("since", since), sql.Named("until", until))
+
+	rows, err := db.c.Query(`SELECT event_id, created_at, actor_id, request_id, remote_ip, action, target_type,
+        target_id, details, before_state, after_state FROM audit_events
+        WHERE (@actor = '' OR actor_id = @actor) AND (@action = '' OR action = @action)
+        AND (@target_type = '' OR target_type = @target_type) AND (@target_id = '' OR target_id = @target_id)
+        AND (@since IS NULL OR created_at >= @since) AND (@until IS NULL OR created_at < @until)
+        ORDER BY created_at `+order, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query audit events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		var actorID, before, after sql.NullString
+		err = rows.Scan(&e.ID, &e.CreatedAt, &actorID, &e.RequestID, &e.RemoteIP, &e.Action, &e.TargetType,
+			&e.TargetID, &e.Details, &before, &after)
+		if err != nil {
+			return fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		e.ActorID = actorID.String
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iteration error: %w", err)
+	}
+	return nil
+}
+
+// recordAudit adds an event to the audit log within tx. before and after are the states of the target before and after
+// the action, encoded in JSON; nil means that the target did not exist (or that its state is not relevant).
+func recordAudit(tx *sql.Tx, actor Actor, action, targetType, targetID, details string, before, after interface{}) error {
+	eventID, err := generateRandomString(10)
+	if err != nil {
+		return fmt.Errorf("failed to generate event id: %w", err)
+	}
+	beforeState, err := snapshot(before)
+	if err != nil {
+		return err
+	}
+	afterState, err := snapshot(after)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO audit_events (event_id, created_at, actor_id, request_id, remote_ip, action,
+        target_type, target_id, details, before_state, after_state) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		eventID, globaltime.Now().UTC(), sql.NullString{String: actor.UserID, Valid: actor.UserID != ""},
+		actor.RequestID, actor.RemoteIP, action, targetType, targetID, details, beforeState, afterState)
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+// snapshot encodes the state of a target for the audit log, NULL for nil.
+func snapshot(state interface{}) (sql.NullString, error) {
+	if state == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to encode audit snapshot: %w", err)
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+func TestAuditEvents(t *testing.T) {
+	db := newTestDB(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+	events := []struct {
+		actor  string
+		action string
+		target string
+		id     string
+	}{
+		{"alice", "user.login", "user", "alice"},
+		{"bob", "photo.delete", "photo", "p1"},
+		{"alice", "photo.delete", "photo", "p2"},
+		{"", "user.login_failed", "user", "bob"},
+	}
+	for i, e := range events {
+		globaltime.FixedTime = start.Add(time.Duration(i) * time.Hour)
+		err := db.RecordAuditEvent(Actor{UserID: e.actor, RequestID: "r"},
+			AuditEvent{Action: e.action, TargetType: e.target, TargetID: e.id, After: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// targets lists the target IDs of events, which tell the events apart
+	targets := func(events []AuditEvent) []string {
+		ids := []string{}
+		for _, e := range events {
+			ids = append(ids, e.TargetID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		page   Page
+		want   []string
+	}{
+		{"all", AuditFilter{}, Page{Limit: 10}, []string{"bob", "p2", "p1", "alice"}},
+		{"page", AuditFilter{}, Page{Limit: 2, Offset: 1}, []string{"p2", "p1"}},
+		{"actor", AuditFilter{ActorID: "alice"}, Page{Limit: 10}, []string{"p2", "alice"}},
+		{"action", AuditFilter{Action: "photo.delete"}, Page{Limit: 10}, []string{"p2", "p1"}},
+		{"target", AuditFilter{TargetType: "photo", TargetID: "p1"}, Page{Limit: 10}, []string{"p1"}},
+		{"period", AuditFilter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, Page{Limit: 10},
+			[]string{"p2", "p1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.GetAuditEvents(tt.filter, tt.page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := targets(got); !equalStrings(ids, tt.want) {
+				t.Errorf("events = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	all, err := db.GetAuditEvents(AuditFilter{}, Page{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := all[0]; e.ActorID != "" || string(e.After) != `{"n":3}` || e.Before != nil || !e.CreatedAt.Equal(start.Add(3*time.Hour)) {
+		t.Errorf("event = %+v", e)
+	}
+
+	// The export goes from the oldest event, and stops at the first error
+	var exported []AuditEvent
+	stop := errors.New("stop")
+	err = db.ExportAuditEvents(AuditFilter{ActorID: "alice"}, func(e AuditEvent) error {
+		exported = append(exported, e)
+		return nil
+	})
+	if ids := targets(exported); err != nil || !equalStrings(ids, []string{"alice", "p2"}) {
+		t.Errorf("export = %v (%v), want [alice p2]", ids, err)
+	}
+	exported = nil
+	err = db.ExportAuditEvents(AuditFilter{}, func(e AuditEvent) error {
+		exported = append(exported, e)
+		return stop
+	})
+	if !errors.Is(err, stop) || len(exported) != 1 {
+		t.Errorf("export went on after an error: %d events (%v)", len(exported), err)
+	}
+
+	// The log is append-only
+	if _, err = db.c.Exec(`UPDATE audit_events SET action = 'nothing'`); err == nil {
+		t.Error("an audit event was changed")
+	}
+	if _, err = db.c.Exec(`DELETE FROM audit_events`); err == nil {
+		t.Error("audit events were deleted")
+	}
+}
+
+// equalStrings reports whether a and b hold the same strings in the same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
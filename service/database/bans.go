@@ -1,61 +1,89 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
-	"time"
-)
 
-func (db *appdbimpl) BanUser(bannedBy, bannedUser string) error {
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
 
-	exists, err := db.BanExists(bannedBy, bannedUser)
-	if err != nil {
-		return fmt.Errorf("error checking if ban exists: %w", err)
-	}
-	if exists {
-		return fmt.Errorf("user is already banned")
-	}
-	stmt, err := db.c.Prepare("INSERT INTO new_bans (ban_id,banned_by, banned_user, timestamp) VALUES (?,?, ?, ?)")
-	if err != nil {
-		return fmt.Errorf("failed to prepare ban statement: %w", err)
+// BanUser makes the actor ban bannedUser. Banning a user twice is not an error: the second call returns false.
+// ErrSelfTarget and ErrUserNotFound are returned for the actor itself and for unknown users.
+func (db *appdbimpl) BanUser(actor Actor, bannedUser string) (bool, error) {
+	if actor.UserID == bannedUser {
+		return false, ErrSelfTarget
 	}
-	defer stmt.Close()
 	//generate a unique ban id
 	banId, err := generateRandomString(10)
 	if err != nil {
-		return fmt.Errorf("failed to generate ban id: %w", err)
+		return false, fmt.Errorf("failed to generate ban id: %w", err)
 	}
-	_, err = stmt.Exec(banId, bannedBy, bannedUser, time.Now())
+	tx, err := db.c.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to execute ban statement: %w", err)
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	return nil
+	ban := Ban{ID: banId, BannedBy: actor.UserID, BannedUser: bannedUser, Timestamp: globaltime.Now().UTC()}
+	res, err := tx.Exec(`INSERT INTO new_bans (ban_id, banned_by, banned_user, timestamp)
+        SELECT ?, ?, user_id, ? FROM users WHERE user_id = ?
+        ON CONFLICT (banned_by, banned_user) DO NOTHING`, ban.ID, ban.BannedBy, ban.Timestamp, bannedUser)
+	if err != nil {
+		return false, fmt.Errorf("failed to execute ban statement: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		// Nothing was inserted: either the user is already banned, or it does not exist
+		return false, checkUserExistsTx(tx, bannedUser)
+	}
+	if err = recordAudit(tx, actor, "user.ban", "user", bannedUser, "", nil, ban); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+	return true, nil
 }
 
-func (db *appdbimpl) UnbanUser(bannerID, bannedUserID string) error {
-	stmt, err := db.c.Prepare("DELETE FROM new_bans WHERE banned_by = ? AND banned_user = ?")
+// UnbanUser lifts a ban of the actor. Unbanning a user who is not banned is not an error, and is not recorded.
+func (db *appdbimpl) UnbanUser(actor Actor, bannedUserID string) error {
+	tx, err := db.c.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to prepare unban statement: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer stmt.Close()
+	defer func() { _ = tx.Rollback() }()
 
-	_, err = stmt.Exec(bannerID, bannedUserID)
-	if err != nil {
+	ban := Ban{BannedBy: actor.UserID, BannedUser: bannedUserID}
+	err = tx.QueryRow(`DELETE FROM new_bans WHERE banned_by = ? AND banned_user = ? RETURNING ban_id, timestamp`,
+		actor.UserID, bannedUserID).Scan(&ban.ID, &ban.Timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
 		return fmt.Errorf("failed to execute unban statement: %w", err)
 	}
-
+	if err = recordAudit(tx, actor, "user.unban", "user", bannedUserID, "", ban, nil); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
 	return nil
 }
 
-// show all bans
-func (db *appdbimpl) GetBans() ([]Ban, error) {
-	rows, err := db.c.Query("SELECT * FROM new_bans")
+// GetBans returns a page of the bans of all the users, most recent first.
+func (db *appdbimpl) GetBans(page Page) ([]Ban, error) {
+	rows, err := db.c.Query(`SELECT ban_id, banned_by, banned_user, timestamp FROM new_bans
+        ORDER BY timestamp DESC, ban_id LIMIT ? OFFSET ?`, page.Limit, page.Offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query bans: %w", err)
 	}
 	defer rows.Close()
 
-	var bans []Ban
+	bans := []Ban{}
 	for rows.Next() {
 		var ban Ban
 		err = rows.Scan(&ban.ID, &ban.BannedBy, &ban.BannedUser, &ban.Timestamp)
@@ -0,0 +1,61 @@
+package database
+
+// Close friends. Each user keeps a list of close friends, the audience of the photos with the close friends visibility
+// (see photoAudienceSQL). The list is seen by its owner only: friends are not told when they are added or removed.
+
+import (
+	"database/sql"
+	"fmt"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// AddCloseFriend adds friendID to the close friends of userID, and reports whether it was not there already.
+// ErrSelfTarget and ErrUserNotFound are returned for the caller itself and for unknown users.
+func (db *appdbimpl) AddCloseFriend(userID string, friendID string) (bool, error) {
+	if userID == friendID {
+		return false, ErrSelfTarget
+	}
+	res, err := db.c.Exec(`INSERT INTO close_friends (user_id, friend_id, created_at)
+        SELECT ?, user_id, ? FROM users WHERE user_id = ? AND deleted_at IS NULL
+        ON CONFLICT (user_id, friend_id) DO NOTHING`, userID, globaltime.Now().UTC(), friendID)
+	if err != nil {
+		return false, fmt.Errorf("failed to add close friend: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil || ok {
+		return ok, err
+	}
+	// Nothing was inserted: either the user is in the list already, or it does not exist
+	return false, db.checkUserExists(friendID)
+}
+
+// RemoveCloseFriend removes friendID from the close friends of userID. Removing a user not in the list is not an error.
+func (db *appdbimpl) RemoveCloseFriend(userID string, friendID string) error {
+	_, err := db.c.Exec(`DELETE FROM close_friends WHERE user_id = ? AND friend_id = ?`, userID, friendID)
+	if err != nil {
+		return fmt.Errorf("failed to remove close friend: %w", err)
+	}
+	return nil
+}
+
+// GetCloseFriends returns the close friends of userID, most recently added first. Deleted accounts are left out.
+func (db *appdbimpl) GetCloseFriends(userID string, page Page) ([]CloseFriend, error) {
+	friends := []CloseFriend{}
+	err := db.scanRows(`SELECT f.friend_id, u.username, f.created_at
+        FROM close_friends f JOIN users u ON u.user_id = f.friend_id
+        WHERE f.user_id = ? AND u.deleted_at IS NULL
+        ORDER BY f.created_at DESC, f.friend_id
+        LIMIT ? OFFSET ?`, []interface{}{userID, page.Limit, page.Offset}, func(rows *sql.Rows) error {
+		var f CloseFriend
+		if err := rows.Scan(&f.UserID, &f.Username, &f.AddedAt); err != nil {
+			return err
+		}
+		friends = append(friends, f)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query close friends: %w", err)
+	}
+	return friends, nil
+}
@@ -1,32 +1,128 @@
 package database
 
-import "fmt"
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
 
+// AddComment stores a comment, and notifies the owner of the photo, the author of the comment it replies to and the
+// users it mentions. ErrPhotoNotFound is returned if the author cannot see the photo, and ErrCommentNotFound if the
+// comment it replies to is not a visible comment of the same photo.
 func (db *appdbimpl) AddComment(comment Comment) error {
-	stmt, err := db.c.Prepare("INSERT INTO comments (comment_id, user_id, photo_id, content, timestamp) VALUES (?, ?, ?, ?, ?)")
+	tx, err := db.c.Begin()
 	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var owner, repliedAuthor string
+	err = tx.QueryRow(`INSERT INTO comments (comment_id, user_id, photo_id, content, timestamp, reply_to)
+        SELECT @comment, @viewer, p.photo_id, @content, @timestamp, NULLIF(@reply, '') FROM new_photos p
+        WHERE p.photo_id = @photo AND `+photoVisibleSQL+` AND (@reply = '' OR EXISTS (
+            SELECT 1 FROM comments r WHERE r.comment_id = @reply AND r.photo_id = p.photo_id AND r.hidden_at IS NULL
+        ))
+        RETURNING (SELECT user_id FROM new_photos WHERE photo_id = @photo),
+            COALESCE((SELECT user_id FROM comments WHERE comment_id = @reply), '')`,
+		sql.Named("comment", comment.ID), sql.Named("viewer", comment.UserID), sql.Named("photo", comment.PhotoID),
+		sql.Named("content", comment.Content), sql.Named("timestamp", comment.Timestamp),
+		sql.Named("reply", comment.ReplyTo)).Scan(&owner, &repliedAuthor)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Nothing was inserted: either the photo cannot be seen, or the replied comment is not there
+		_ = tx.Rollback()
+		if err = db.checkPhotoVisible(comment.PhotoID, comment.UserID); err != nil {
+			return err
+		}
+		return ErrCommentNotFound
+	} else if err != nil {
+		return err
+	}
+
+	e := event{actorID: comment.UserID, photoID: comment.PhotoID, at: comment.Timestamp}
+	notified := []string{owner}
+	if repliedAuthor != "" {
+		// The reply notifies the author of the replied comment, even when it is the owner of the photo
+		reply := e
+		reply.userID, reply.kind, reply.commentID = repliedAuthor, NotifyReply, comment.ID
+		if err = notify(tx, reply); err != nil {
+			return err
+		}
+		notified = append(notified, repliedAuthor)
+	}
+	if owner != repliedAuthor {
+		commented := e
+		commented.userID, commented.kind = owner, NotifyComment
+		if err = notify(tx, commented); err != nil {
+			return err
+		}
+	}
+	mention := e
+	mention.kind, mention.commentID = NotifyMention, comment.ID
+	if err = notifyMentions(tx, comment.Content, mention, notified...); err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(comment.ID, comment.UserID, comment.PhotoID, comment.Content, comment.Timestamp)
-	return err
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
 }
 
-func (db *appdbimpl) DeleteComment(commentID string) error {
-	stmt, err := db.c.Prepare("DELETE FROM comments WHERE comment_id = ?")
+// DeleteComment removes a comment on behalf of the actor, who must be its author or the owner of the photo.
+// ErrCommentNotFound is returned if there is no such comment, and ErrNotOwner if the actor cannot delete it.
+func (db *appdbimpl) DeleteComment(actor Actor, commentID string) error {
+	tx, err := db.c.Begin()
 	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	comment, photoOwner, err := deleteComment(tx, commentID)
+	if err != nil {
+		return err
+	}
+	if actor.UserID != comment.UserID && actor.UserID != photoOwner {
+		return ErrNotOwner
+	}
+	if err = recordAudit(tx, actor, "comment.delete", "comment", commentID, "", comment, nil); err != nil {
 		return err
 	}
-	defer stmt.Close()
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
 
-	_, err = stmt.Exec(commentID)
-	return err
+// deleteComment removes a comment, and returns it with the ID of the owner of the photo. ErrCommentNotFound is
+// returned if there is no such comment.
+func deleteComment(tx *sql.Tx, commentID string) (*Comment, string, error) {
+	var c Comment
+	var photoOwner string
+	err := tx.QueryRow(`SELECT c.comment_id, c.user_id, c.photo_id, c.content, c.timestamp, p.user_id
+        FROM comments c JOIN new_photos p ON p.photo_id = c.photo_id WHERE c.comment_id = ?`, commentID).Scan(
+		&c.ID, &c.UserID, &c.PhotoID, &c.Content, &c.Timestamp, &photoOwner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", ErrCommentNotFound
+	} else if err != nil {
+		return nil, "", fmt.Errorf("failed to get comment: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM comments WHERE comment_id = ?", commentID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to delete comment: %w", err)
+	}
+	return &c, photoOwner, nil
 }
-func (db *appdbimpl) GetCommentsByPhotoId(photoId string) ([]Comment, error) {
+
+// GetCommentsByPhotoId returns the comments on a photo, newest first, except for those of the users muted by viewerID.
+// There are none if viewerID cannot see the photo.
+func (db *appdbimpl) GetCommentsByPhotoId(photoId string, viewerID string) ([]Comment, error) {
 	// SQL query to fetch all comments for a given photo ID
-	query := `SELECT comment_id, user_id, photo_id, content, timestamp FROM comments WHERE photo_id = ? ORDER BY timestamp DESC`
-	rows, err := db.c.Query(query, photoId)
+	query := `SELECT c.comment_id, c.user_id, c.photo_id, c.content, c.timestamp, COALESCE(c.reply_to, '')
+        FROM comments c JOIN new_photos p ON p.photo_id = c.photo_id
+        WHERE c.photo_id = @photo AND c.hidden_at IS NULL
+        AND c.user_id NOT IN (` + deletedUsersSQL + `) AND ` + commentNotMutedSQL + ` AND ` + photoVisibleSQL + `
+        ORDER BY c.timestamp DESC`
+	rows, err := db.c.Query(query, sql.Named("photo", photoId), sql.Named("viewer", viewerID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to query comments: %w", err)
 	}
@@ -35,7 +131,7 @@ func (db *appdbimpl) GetCommentsByPhotoId(photoId string) ([]Comment, error) {
 	var comments []Comment
 	for rows.Next() {
 		var c Comment
-		err := rows.Scan(&c.ID, &c.UserID, &c.PhotoID, &c.Content, &c.Timestamp)
+		err := rows.Scan(&c.ID, &c.UserID, &c.PhotoID, &c.Content, &c.Timestamp, &c.ReplyTo)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan comment: %w", err)
 		}
@@ -0,0 +1,180 @@
+package database
+
+// Passwords, sessions and password reset tokens. Passwords are hashed by the caller (see package password), while
+// tokens are stored as hashes computed by the caller too: this package never sees them in clear.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// GetCredentials returns the password hash, the e-mail address, the number of external identities and the suspension of
+// a user, or ErrUserNotFound.
+func (db *appdbimpl) GetCredentials(userID string) (*Credentials, error) {
+	var creds Credentials
+	var hash sql.NullString
+	err := db.c.QueryRow(`SELECT password_hash, email, (SELECT COUNT(*) FROM identities i WHERE i.user_id = u.user_id),
+        suspended_at IS NOT NULL, role = ? FROM users u WHERE user_id = ?`, RoleAdmin, userID).Scan(&hash, &creds.Email,
+		&creds.Identities, &creds.Suspended, &creds.Admin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+	creds.PasswordHash = hash.String
+	return &creds, nil
+}
+
+// SetPassword replaces the password hash of a user, and closes all the sessions of the user.
+func (db *appdbimpl) SetPassword(actor Actor, userID string, passwordHash string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = setPassword(tx, userID, passwordHash); err != nil {
+		return err
+	}
+	if err = recordAudit(tx, actor, "user.password_change", "user", userID, "", nil, nil); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func setPassword(tx *sql.Tx, userID string, passwordHash string) error {
+	res, err := tx.Exec(`UPDATE users SET password_hash = ? WHERE user_id = ?`, passwordHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserNotFound
+	}
+	_, err = tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to close sessions: %w", err)
+	}
+	return nil
+}
+
+// CreateSession opens a new session for a user, identified by the hash of its token. The login is recorded in the
+// audit log, with the method used to sign in (for example, "password"). Signing in cancels the deletion of the
+// account, if it was not purged yet.
+func (db *appdbimpl) CreateSession(actor Actor, userID string, tokenHash string, method string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec(`INSERT INTO sessions (token_hash, user_id, created_at) VALUES (?, ?, ?)`,
+		tokenHash, userID, globaltime.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	if err = restoreUser(tx, actor, userID); err != nil {
+		return err
+	}
+	if err = recordAudit(tx, actor, "user.login", "user", userID, method, nil, nil); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// GetSessionUser returns the user of the session with the given token hash, or nil if there is no such session or if
+// the user is suspended or deleted.
+func (db *appdbimpl) GetSessionUser(tokenHash string) (*User, error) {
+	var user User
+	err := db.c.QueryRow(`SELECT u.user_id, u.username, u.role FROM sessions s JOIN users u ON u.user_id = s.user_id
+        WHERE s.token_hash = ? AND u.suspended_at IS NULL AND u.deleted_at IS NULL`, tokenHash).Scan(&user.ID, &user.Username, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	return &user, nil
+}
+
+// GetLegacyUser returns the user with the given ID if it can use the name-only login (that is, it has no password, no
+// external identity and is not an administrator) and is neither suspended nor deleted, or nil otherwise.
+func (db *appdbimpl) GetLegacyUser(userID string) (*User, error) {
+	var user User
+	err := db.c.QueryRow(`SELECT user_id, username, role FROM users u WHERE user_id = ? AND password_hash IS NULL
+        AND role <> ? AND suspended_at IS NULL AND deleted_at IS NULL
+        AND NOT EXISTS (SELECT 1 FROM identities i WHERE i.user_id = u.user_id)`,
+		userID, RoleAdmin).Scan(&user.ID, &user.Username, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return &user, nil
+}
+
+// DeleteSession closes the session with the given token hash. Closing a session that does not exist is not an error.
+func (db *appdbimpl) DeleteSession(tokenHash string) error {
+	_, err := db.c.Exec(`DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+// CreatePasswordReset stores a password reset token for a user, valid until expiresAt.
+func (db *appdbimpl) CreatePasswordReset(userID string, tokenHash string, expiresAt time.Time) error {
+	_, err := db.c.Exec(`INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		tokenHash, userID, expiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to create password reset: %w", err)
+	}
+	return nil
+}
+
+// ResetPassword sets a new password for the user who requested the reset token, and returns the ID of the user.
+// All the reset tokens and all the sessions of the user are dropped. ErrResetTokenInvalid is returned if the token does
+// not exist or has expired.
+func (db *appdbimpl) ResetPassword(actor Actor, tokenHash string, passwordHash string) (string, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var userID string
+	err = tx.QueryRow(`SELECT user_id FROM password_resets WHERE token_hash = ? AND expires_at > ?`,
+		tokenHash, globaltime.Now().UTC()).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrResetTokenInvalid
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get password reset: %w", err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM password_resets WHERE user_id = ?`, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete password resets: %w", err)
+	}
+	if err = setPassword(tx, userID, passwordHash); err != nil {
+		return "", err
+	}
+	if err = recordAudit(tx, actor, "user.password_reset", "user", userID, "", nil, nil); err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit: %w", err)
+	}
+	return userID, nil
+}
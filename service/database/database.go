@@ -16,7 +16,7 @@ This is an example on how to migrate the DB and connect to it:
 
 	// Start Database
 	logger.Println("initializing database support")
-	db, err := sql.Open("sqlite3", "./foo.db")
+	db, err := sql.Open("sqlite3", database.DataSourceName("./foo.db"))
 	if err != nil {
 		logger.WithError(err).Error("error opening SQLite DB")
 		return fmt.Errorf("opening SQLite: %w", err)
@@ -32,20 +32,461 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
+var (
+	// ErrPhotoNotFound is returned when a photo does not exist or is not visible to the requesting user
+	ErrPhotoNotFound = errors.New("photo not found")
+	// ErrUserNotFound is returned when a user does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrAvatarNotFound is returned when a user has no avatar
+	ErrAvatarNotFound = errors.New("avatar not found")
+	// ErrCommentNotFound is returned when a comment does not exist
+	ErrCommentNotFound = errors.New("comment not found")
+	// ErrUsernameTaken is returned when a username is already used by another user
+	ErrUsernameTaken = errors.New("username already exists")
+	// ErrResetTokenInvalid is returned when a password reset token does not exist, was used or has expired
+	ErrResetTokenInvalid = errors.New("invalid password reset token")
+	// ErrOIDCLoginInvalid is returned when an OpenID Connect login does not exist, was completed or has expired
+	ErrOIDCLoginInvalid = errors.New("invalid OpenID Connect login")
+	// ErrIdentityLinked is returned when an external identity is already linked to another user
+	ErrIdentityLinked = errors.New("identity already linked to another user")
+	// ErrAccessTokenNotFound is returned when a personal access token does not exist
+	ErrAccessTokenNotFound = errors.New("access token not found")
+	// ErrSelfTarget is returned when a user tries to follow, ban or suspend themselves
+	ErrSelfTarget = errors.New("users cannot target themselves")
+	// ErrNotOwner is returned when a user tries to change something that belongs to another user
+	ErrNotOwner = errors.New("not the owner")
+	// ErrReportNotFound is returned when a report does not exist
+	ErrReportNotFound = errors.New("report not found")
+	// ErrReportResolved is returned when a report was already actioned or dismissed
+	ErrReportResolved = errors.New("report already resolved")
+	// ErrExportNotFound is returned when a data export does not exist, is not ready, or has expired
+	ErrExportNotFound = errors.New("export not found")
+	// ErrExportPending is returned when a user asks for a data export while another one is being built
+	ErrExportPending = errors.New("export already pending")
+	// ErrPrivateAccount is returned when a user asks for the followers of a private account it does not follow
+	ErrPrivateAccount = errors.New("account is private")
+	// ErrFollowRequestNotFound is returned when a follow request does not exist
+	ErrFollowRequestNotFound = errors.New("follow request not found")
+	// ErrNotificationNotFound is returned when a notification does not exist or belongs to another user
+	ErrNotificationNotFound = errors.New("notification not found")
+	// ErrSearchUnavailable is returned when photos are searched but SQLite was built without full-text search
+	ErrSearchUnavailable = errors.New("full-text search unavailable")
+)
+
+// Roles of users. Administrators can moderate the content and the accounts of any user.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// States of reports. Open reports wait in the moderation queue until an administrator actions or dismisses them.
+const (
+	ReportOpen      = "open"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+// States of data exports. Exports are built in the background: pending exports wait for their archive.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Outcomes of FollowUser. Users with a private account approve their followers: following them sends a follow
+// request instead.
+const (
+	FollowStarted   = "started"   // The user is followed from now on
+	FollowExisting  = "existing"  // The user was followed already
+	FollowRequested = "requested" // A follow request waits for the approval of the user
+)
+
+// Types of notifications. Likes, comments, follows and follow requests are aggregated: while a notification is
+// unread, new events of the same type about the same photo are added to it (see notify).
+const (
+	NotifyLike          = "like"           // A user liked a photo of the user
+	NotifyComment       = "comment"        // A user commented a photo of the user
+	NotifyReply         = "reply"          // A user replied to a comment of the user
+	NotifyMention       = "mention"        // A user mentioned the user in a caption or in a comment
+	NotifyFollow        = "follow"         // A user started following the user
+	NotifyFollowRequest = "follow_request" // A user asked to follow the user
+)
+
+// Where a photo found by SearchPhotos matched the query
+const (
+	MatchCaption = "caption"
+	MatchComment = "comment"
+)
+
+// Windows of the trending tags: a tag trends when it was used more in the last window than in the window before (see
+// ComputeTagTrends).
+const (
+	TrendHour = "1h"
+	TrendDay  = "24h"
+	TrendWeek = "7d"
+)
+
+// Orders of the photos of a tag page
+const (
+	TagSortRecent = "recent" // Most recent first
+	TagSortTop    = "top"    // Most liked first
+)
+
+// Visibility levels of photos, from the widest audience to the narrowest. Only-me photos are archived: nobody but
+// their owner sees them. Photos of private accounts are seen by approved followers at most (see photoVisibleSQL).
+const (
+	VisibilityPublic       = "public"
+	VisibilityFollowers    = "followers"
+	VisibilityCloseFriends = "close_friends"
+	VisibilityOnlyMe       = "only_me"
+)
+
+// Types of the targets of reports
+const (
+	TargetPhoto   = "photo"
+	TargetComment = "comment"
+	TargetUser    = "user"
+)
+
 type Error struct {
 	Error string `json:"error" db:"error"`
 }
 
+// User is a user account. Followers, followed users and photos are loaded on demand (see GetProfile).
 type User struct {
-	ID        string   `json:"userId" db:"user_id"` // Unique identifier
-	Username  string   `json:"username" db:"username"`
-	Followers []string `json:"followers"` // IDs of followers (handled separately in relational mapping)
-	Following []string `json:"following"` // IDs of users being followed (handled separately in relational mapping)
-	Photos    []string `json:"photos"`    // IDs of photos uploaded by the user (handled separately in relational mapping)
+	ID       string `json:"userId" db:"user_id"` // Unique identifier
+	Username string `json:"username" db:"username"`
+	Role     string `json:"-" db:"role"` // RoleUser or RoleAdmin; loaded only for the signed-in user
+}
+
+// Profile is the public profile of a user, seen from the point of view of the requesting user
+type Profile struct {
+	ID             string `json:"userId"`
+	Username       string `json:"username"`
+	DisplayName    string `json:"displayName"`
+	Bio            string `json:"bio"`
+	Website        string `json:"website"`
+	HasAvatar      bool   `json:"hasAvatar"`
+	FollowersCount int    `json:"followersCount"`
+	FollowingCount int    `json:"followingCount"`
+	PhotosCount    int    `json:"photosCount"`
+	FollowsYou     bool   `json:"followsYou"`   // Whether this user follows the requesting user
+	YouFollow      bool   `json:"youFollow"`    // Whether the requesting user follows this user
+	YouBanned      bool   `json:"youBanned"`    // Whether the requesting user banned this user
+	Private        bool   `json:"private"`      // Whether only approved followers see the photos and followers
+	YouRequested   bool   `json:"youRequested"` // Whether a follow request of the requesting user is pending
+}
+
+// ProfileUpdate lists the profile fields to change. Nil fields are left untouched.
+type ProfileUpdate struct {
+	DisplayName *string
+	Bio         *string
+	Website     *string
+	Email       *string // Private: it is never shown in the Profile
+	Private     *bool   // Going public approves the pending follow requests
+}
+
+// Mute is a user muted by the requesting user. Muted users are not told: their posts leave the stream of the muting
+// user, their comments leave the photos it views, or both.
+type Mute struct {
+	UserID    string    `json:"userId"` // The muted user
+	Username  string    `json:"username"`
+	Posts     bool      `json:"posts"`    // Whether the photos of the user are left out of the stream
+	Comments  bool      `json:"comments"` // Whether the comments of the user are left out of every photo
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UserMatch is a user found by SearchUsers
+type UserMatch struct {
+	UserSummary
+	DisplayName string `json:"displayName"`
+	score       int    // How well the user matches the query, see rankUserMatch
+}
+
+// PhotoMatch is a photo found by SearchPhotos, with an excerpt of the caption or of the comment that matched best
+type PhotoMatch struct {
+	PhotoID   string    `json:"photoId"`
+	UserID    string    `json:"userId"`
+	Username  string    `json:"username"`
+	Timestamp time.Time `json:"timestamp"`
+	Caption   string    `json:"caption"`
+	MatchedIn string    `json:"matchedIn"`           // MatchCaption or MatchComment
+	CommentID string    `json:"commentId,omitempty"` // The comment that matched, for MatchComment
+	Snippet   string    `json:"snippet"`             // HTML-escaped excerpt, with the matching words in <mark> elements
+}
+
+// Tag is the page of a hashtag, as seen by the requesting user. Tags exist as long as somebody uses them: the page of
+// an unused tag is empty.
+type Tag struct {
+	Tag       string `json:"tag"`       // Without the #, see hashtag.Key
+	Photos    int    `json:"photos"`    // Photos with the tag that the requesting user can see
+	Followers int    `json:"followers"` // Users following the tag
+	YouFollow bool   `json:"youFollow"`
+}
+
+// FollowedTag is a tag followed by the requesting user: the photos with the tag are in its stream
+type FollowedTag struct {
+	Tag        string    `json:"tag"`
+	FollowedAt time.Time `json:"followedAt"`
+}
+
+// TrendingTag is a tag whose usage grew in a trend window, as of the last run of ComputeTagTrends
+type TrendingTag struct {
+	Tag          string    `json:"tag"`
+	Uses         int       `json:"uses"`         // Public photos with the tag posted in the window
+	PreviousUses int       `json:"previousUses"` // Public photos with the tag posted in the window before
+	Growth       float64   `json:"growth"`       // How fast the usage grew, see trendGrowthSQL
+	ComputedAt   time.Time `json:"computedAt"`
+}
+
+// Notification tells a user that other users interacted with it. Aggregated notifications have several actors.
+type Notification struct {
+	ID         string              `json:"notificationId"`
+	Type       string              `json:"type"`                // One of the Notify types
+	PhotoID    string              `json:"photoId,omitempty"`   // The photo liked, commented or mentioned in
+	CommentID  string              `json:"commentId,omitempty"` // The reply, or the comment mentioning the user
+	Actors     []NotificationActor `json:"actors"`              // The most recent actors, at most two
+	ActorCount int                 `json:"actorCount"`          // All the actors
+	Message    string              `json:"message"`             // Set by the API, e.g. "alice and 5 others liked your photo"
+	Read       bool                `json:"read"`
+	UpdatedAt  time.Time           `json:"updatedAt"` // When the last actor acted
+}
+
+// NotificationActor is a user who caused a notification
+type NotificationActor struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+}
+
+// CloseFriend is a user in the close friends list of the requesting user. The list is seen by its owner only.
+type CloseFriend struct {
+	UserID   string    `json:"userId"`
+	Username string    `json:"username"`
+	AddedAt  time.Time `json:"addedAt"`
+}
+
+// Suggestion is a user the requesting user may want to follow, with the signals it was ranked by
+type Suggestion struct {
+	UserID          string `json:"userId"`
+	Username        string `json:"username"`
+	MutualFollowers int    `json:"mutualFollowers"` // Users followed by the requesting user who follow this user
+	MutualExample   string `json:"-"`               // Username of one of them, the first in alphabetical order
+	RecentPhotos    int    `json:"recentPhotos"`    // Photos posted lately
+	FollowersCount  int    `json:"followersCount"`
+	Explanation     string `json:"explanation"` // Why the user is suggested, for humans; set by the API
+}
+
+// FollowRequest is a pending request to follow a user with a private account
+type FollowRequest struct {
+	UserID    string    `json:"userId"` // The user asking to follow
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Credentials are the private sign-in data of a user
+type Credentials struct {
+	PasswordHash string // Empty if the user has no password (name-only login)
+	Email        string // Empty if the user gave no address
+	Identities   int    // Number of identities at external providers linked to the user
+	Suspended    bool   // Suspended users cannot sign in
+	Admin        bool   // Administrators cannot use the name-only login
+}
+
+// Actor is who performs an action recorded in the audit log, and from where. The zero value is the system itself (for
+// example, the administrators listed in the configuration).
+type Actor struct {
+	UserID    string // Empty for the system and for anonymous requests (for example, logins)
+	RequestID string
+	RemoteIP  string
+}
+
+// AuditEvent is a security-relevant action recorded in the audit log. Actions are named after their target:
+// user.login, user.login_failed, user.rename, user.password_change, user.password_reset, user.role, user.suspend,
+// user.unsuspend, user.delete, user.restore, user.purge, user.ban, user.unban, token.create, token.revoke,
+// photo.delete, photo.hide, photo.unhide, comment.delete, comment.hide, comment.unhide, report.action and
+// report.dismiss.
+type AuditEvent struct {
+	ID         string          `json:"eventId"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	ActorID    string          `json:"actorId"`
+	RequestID  string          `json:"requestId"`
+	RemoteIP   string          `json:"remoteIp"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType"` // user, token, photo or comment
+	TargetID   string          `json:"targetId"`
+	Details    string          `json:"details"`
+	Before     json.RawMessage `json:"before"` // State of the target before the action, or null
+	After      json.RawMessage `json:"after"`  // State of the target after the action, or null
+}
+
+// AuditFilter selects audit events. Empty fields match any event; Until is excluded.
+type AuditFilter struct {
+	ActorID    string
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      time.Time
+	Until      time.Time
+}
+
+// AccessToken is a personal access token, used by scripts to act on behalf of a user with limited permissions
+type AccessToken struct {
+	ID         string     `json:"tokenId"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`  // Nil if the token never expires
+	LastUsedAt *time.Time `json:"lastUsedAt"` // Nil if the token was never used
+}
+
+// ExternalIdentity is the identity of a user at an OpenID Connect provider
+type ExternalIdentity struct {
+	Issuer  string
+	Subject string
+}
+
+// OIDCLogin is a login started at an OpenID Connect provider, waiting for the browser to come back
+type OIDCLogin struct {
+	StateHash string // Hash of the state parameter, which identifies the login
+	Provider  string
+	Nonce     string
+	Verifier  string // PKCE code verifier
+	UserID    string // The user who links the identity to their account, or empty to sign in
+	ExpiresAt time.Time
+}
+
+// RenameLimitError is returned when a user changed username too many times recently
+type RenameLimitError struct {
+	RetryAt time.Time // When the user will be allowed to change username again
+}
+
+func (e *RenameLimitError) Error() string {
+	return "too many username changes"
+}
+
+// UserSummary is the short form of a user used in lists, seen from the point of view of the requesting user
+type UserSummary struct {
+	ID         string `json:"userId"`
+	Username   string `json:"username"`
+	YouFollow  bool   `json:"youFollow"`  // Whether the requesting user follows this user
+	FollowsYou bool   `json:"followsYou"` // Whether this user follows the requesting user
+}
+
+// RepairReport counts the rows removed by RepairDanglingRows, by table
+type RepairReport struct {
+	Followers int64 `json:"followers"`
+	Likes     int64 `json:"likes"`
+	Comments  int64 `json:"comments"`
+	Bans      int64 `json:"bans"`
+}
+
+// Report collects the reports of the users about a photo, a comment or a user. All the reports about a target are
+// collected in the same open Report, until it is resolved.
+type Report struct {
+	ID             string         `json:"reportId"`
+	TargetType     string         `json:"targetType"`    // TargetPhoto, TargetComment or TargetUser
+	TargetID       string         `json:"targetId"`      // ID of the photo, comment or user
+	TargetOwnerID  string         `json:"targetOwnerId"` // The user who posted the content, or the reported user
+	State          string         `json:"state"`
+	CreatedAt      time.Time      `json:"createdAt"` // Time of the first report
+	Reporters      int            `json:"reporters"`
+	Reasons        map[string]int `json:"reasons"` // Number of reports by reason
+	ResolvedAt     *time.Time     `json:"resolvedAt"`
+	ResolvedBy     string         `json:"resolvedBy"`
+	ResolutionNote string         `json:"resolutionNote"`
+}
+
+// ReportSubmission is the report of a single user
+type ReportSubmission struct {
+	ReporterID string    `json:"reporterId"`
+	Reason     string    `json:"reason"`
+	Comment    string    `json:"comment"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// ReportFilter selects reports. Empty fields match any report.
+type ReportFilter struct {
+	State      string
+	TargetType string
+}
+
+// Export is an archive with the personal data of a user, downloaded with a link valid until the export expires
+type Export struct {
+	ID        string     `json:"exportId"`
+	UserID    string     `json:"-"`
+	State     string     `json:"state"` // ExportPending, ExportReady or ExportFailed
+	CreatedAt time.Time  `json:"createdAt"`
+	ReadyAt   *time.Time `json:"readyAt"`   // Nil while pending
+	ExpiresAt *time.Time `json:"expiresAt"` // Nil while pending; the export is removed afterwards
+	Size      int        `json:"size"`      // Size of the archive in bytes
+}
+
+// Takeout is the personal data of a user written in the manifest of an export
+type Takeout struct {
+	Account   TakeoutAccount    `json:"account"`
+	Following []TakeoutRelation `json:"following"`
+	Followers []TakeoutRelation `json:"followers"`
+	Bans      []TakeoutRelation `json:"bans"`
+	Likes     []TakeoutLike     `json:"likes"`
+	Comments  []TakeoutComment  `json:"comments"`
+	Photos    []TakeoutPhoto    `json:"photos"`
+}
+
+// TakeoutAccount is the profile of a user, with its private fields
+type TakeoutAccount struct {
+	UserID      string `json:"userId"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Bio         string `json:"bio"`
+	Website     string `json:"website"`
+	Email       string `json:"email"`
+	Avatar      string `json:"avatar"` // Name of the avatar file in the archive; empty if the user has no avatar
+}
+
+// TakeoutRelation is a followed, following or banned user
+type TakeoutRelation struct {
+	UserID   string     `json:"userId"`
+	Username string     `json:"username"`
+	Since    *time.Time `json:"since,omitempty"` // Known for bans only
+}
+
+// TakeoutLike is a like of the user, on any photo
+type TakeoutLike struct {
+	PhotoID   string    `json:"photoId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TakeoutComment is a comment of the user, on any photo
+type TakeoutComment struct {
+	CommentID string    `json:"commentId"`
+	PhotoID   string    `json:"photoId"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TakeoutPhoto is a photo of the user. The image itself is a file of the archive.
+type TakeoutPhoto struct {
+	PhotoID    string    `json:"photoId"`
+	Timestamp  time.Time `json:"timestamp"`
+	Likes      int       `json:"likes"`
+	Comments   int       `json:"comments"`
+	Visibility string    `json:"visibility"`
+	Caption    string    `json:"caption"`
+	Hidden     bool      `json:"hidden"` // Hidden by the moderators
+	File       string    `json:"file"`   // Name of the image file in the archive
+}
+
+// Page selects a window of a list result
+type Page struct {
+	Limit  int
+	Offset int
 }
 
 // New Struct for handling followers relationship
@@ -66,6 +507,7 @@ type Comment struct {
 	PhotoID   string    `json:"photoId" db:"photo_id"`     // ID of the photo being commented on
 	Content   string    `json:"content" db:"content"`      // The comment itself
 	Timestamp time.Time `json:"timestamp" db:"timestamp"`  // Timestamp of when the comment was made
+	ReplyTo   string    `json:"replyTo,omitempty"`         // ID of the comment this one replies to, if any
 }
 
 type Like struct {
@@ -75,12 +517,14 @@ type Like struct {
 }
 
 type Photo struct {
-	ID        string    `json:"photoId" db:"photo_id"`     // Unique identifier
-	UserID    string    `json:"userId" db:"user_id"`       // ID of the user who uploaded the photo
-	ImageData []byte    `json:"imageData" db:"image_data"` // The photo data itself
-	Timestamp time.Time `json:"timestamp" db:"timestamp"`  // Timestamp of when the photo was uploaded
-	Likes     []Like    `json:"likes"`                     // Note: This requires a relational mapping and isn't directly mapped to a single column
-	Comments  []Comment `json:"comments"`                  // Note: This requires a relational mapping and isn't directly mapped to a single column
+	ID         string    `json:"photoId" db:"photo_id"`      // Unique identifier
+	UserID     string    `json:"userId" db:"user_id"`        // ID of the user who uploaded the photo
+	ImageData  []byte    `json:"imageData" db:"image_data"`  // The photo data itself
+	Timestamp  time.Time `json:"timestamp" db:"timestamp"`   // Timestamp of when the photo was uploaded
+	Visibility string    `json:"visibility" db:"visibility"` // Who can see the photo: one of the Visibility levels
+	Caption    string    `json:"caption" db:"caption"`       // Text written by the owner under the photo
+	Likes      []Like    `json:"likes"`                      // Note: This requires a relational mapping and isn't directly mapped to a single column
+	Comments   []Comment `json:"comments"`                   // Note: This requires a relational mapping and isn't directly mapped to a single column
 }
 
 type PhotoDetail struct {
@@ -89,6 +533,8 @@ type PhotoDetail struct {
 	Username   string    `json:"username"`
 	ImageData  []byte    `json:"imageData"`
 	Timestamp  time.Time `json:"timestamp"`
+	Visibility string    `json:"visibility"`
+	Caption    string    `json:"caption"`
 	LikesCount int       `json:"likesCount"`
 	Comments   []Comment `json:"comments"`
 }
@@ -104,37 +550,131 @@ type AppDatabase interface {
 	GetName() (string, error)
 	SetName(name string) error
 	AddUser(user *User) error
+	RegisterUser(user *User, passwordHash string, email string) error
+	GetCredentials(userID string) (*Credentials, error)
+	SetPassword(actor Actor, userID string, passwordHash string) error
+	CreateSession(actor Actor, userID string, tokenHash string, method string) error
+	GetSessionUser(tokenHash string) (*User, error)
+	GetLegacyUser(userID string) (*User, error)
+	DeleteSession(tokenHash string) error
+	CreatePasswordReset(userID string, tokenHash string, expiresAt time.Time) error
+	ResetPassword(actor Actor, tokenHash string, passwordHash string) (string, error)
+	RegisterExternalUser(user *User, identity ExternalIdentity, email string) error
+	GetExternalUser(identity ExternalIdentity) (*User, error)
+	LinkIdentity(userID string, identity ExternalIdentity) error
+	CreateOIDCLogin(login OIDCLogin) error
+	ConsumeOIDCLogin(stateHash string) (*OIDCLogin, error)
+	CreateAccessToken(actor Actor, token *AccessToken, tokenHash string) error
+	GetAccessTokens(userID string) ([]AccessToken, error)
+	DeleteAccessToken(actor Actor, tokenID string) error
+	UseAccessToken(tokenHash string) (*User, []string, error)
 	Ping() error
-	SetUsername(userId, newUsername string) error
-	GetUserProfile(username string) (*User, error)
-	LikePhoto(userID string, photoID string) error
+	SetUsername(actor Actor, newUsername string) error
+	LikePhoto(userID string, photoID string) (bool, error)
 	UnlikePhoto(userID string, photoID string) error
-	FollowUser(followerID string, followedID string) error
+	FollowUser(followerID string, followedID string) (string, error)
 	UnfollowUser(followerID string, followedID string) error
 	GetUserIDByUsername(username string) (string, error)
 	GetUserByUsername(username string) (*User, error)
+	ResolveUsername(username string) (*User, bool, error)
 	GetUser(userID string) (*User, error)
 	AddPhoto(photo Photo) error
-	GetPhotos() ([]Photo, error)
-	BanUser(bannedBy string, bannedUser string) error
-	UnbanUser(bannerID, bannedUserID string) error
-	GetBans() ([]Ban, error)
+	GetPhotos(viewerID string) ([]Photo, error)
+	BanUser(actor Actor, bannedUser string) (bool, error)
+	UnbanUser(actor Actor, bannedUserID string) error
+	GetBans(page Page) ([]Ban, error)
+	SetRole(actor Actor, userID string, role string) error
+	SuspendUser(actor Actor, userID string, reason string) error
+	UnsuspendUser(actor Actor, userID string) error
+	AdminDeletePhoto(actor Actor, photoID string) error
+	AdminDeleteComment(actor Actor, commentID string) error
+	ForceUsername(actor Actor, userID string, newUsername string) error
+	RecordAuditEvent(actor Actor, event AuditEvent) error
+	GetAuditEvents(filter AuditFilter, page Page) ([]AuditEvent, error)
+	ExportAuditEvents(filter AuditFilter, fn func(AuditEvent) error) error
+	CreateReport(reporterID string, targetType string, targetID string, submission ReportSubmission) (string, bool, error)
+	GetReports(filter ReportFilter, page Page) ([]Report, error)
+	GetReport(reportID string) (*Report, []ReportSubmission, error)
+	ResolveReport(actor Actor, reportID string, state string, note string) error
+	SetPhotoHidden(actor Actor, photoID string, hidden bool) error
+	SetCommentHidden(actor Actor, commentID string, hidden bool) error
 	GetAllUsers() ([]User, error)
 	GetMyStream(userID string) ([]string, error)
-	DeleteComment(commentID string) error
+	DeleteComment(actor Actor, commentID string) error
 	AddComment(comment Comment) error
-	DeletePhoto(photoID string) error
-	GetCommentsByPhotoId(photoId string) ([]Comment, error)
-	GetFollowersByUsername(username string) ([]string, error)
-	GetUserProfileByID(userID string) (*User, error)
-	GetPhoto(photoId string) (*PhotoDetail, error)
+	DeletePhoto(actor Actor, photoID string) error
+	GetCommentsByPhotoId(photoId string, viewerID string) ([]Comment, error)
+	GetFollowersByUsername(username string, viewerID string, page Page) ([]string, error)
+	GetProfile(userID string, viewerID string) (*Profile, error)
+	UpdateProfile(userID string, update ProfileUpdate) error
+	SetAvatar(userID string, imageData []byte) error
+	DeleteAvatar(userID string) error
+	GetAvatar(userID string) ([]byte, error)
+	GetUserPhotoIDs(userID string, viewerID string, page Page) ([]string, error)
+	GetPhoto(photoId string, viewerID string) (*PhotoDetail, error)
+	SetPhotoVisibility(userID string, photoID string, visibility string) error
 	GetUsername(userID string) (string, error)
 	IsLiked(photoID string, userID string) (bool, error)
+	GetLikers(photoID string, viewerID string, page Page) ([]UserSummary, error)
+	GetFollowers(userID string, viewerID string, page Page) ([]UserSummary, error)
+	GetFollowing(userID string, viewerID string, page Page) ([]UserSummary, error)
+	GetMutuals(userID string, viewerID string, page Page) ([]UserSummary, error)
+	SearchUsers(viewerID string, query string, page Page) ([]UserMatch, error)
+	SearchPhotos(viewerID string, query string, page Page) ([]PhotoMatch, error)
+	GetTag(tag string, viewerID string) (*Tag, error)
+	GetTagPhotoIDs(tag string, viewerID string, sort string, page Page) ([]string, error)
+	FollowTag(userID string, tag string) (bool, error)
+	UnfollowTag(userID string, tag string) error
+	GetFollowedTags(userID string, page Page) ([]FollowedTag, error)
+	ComputeTagTrends(now time.Time) error
+	GetTrendingTags(window string, page Page) ([]TrendingTag, error)
+	GetNotifications(userID string, page Page) ([]Notification, int, error)
+	MarkNotificationRead(userID string, notificationID string) error
+	MarkAllNotificationsRead(userID string) (int, error)
+	GetNotificationPreferences(userID string) (map[string]bool, error)
+	SetNotificationPreferences(userID string, preferences map[string]bool) error
 	IsUserFollowed(followerID, followedID string) (bool, error)
 	BanExists(bannedBy, bannedUser string) (bool, error)
+	RepairDanglingRows() (RepairReport, error)
+	DeleteUser(actor Actor, userID string) (time.Time, error)
+	RestoreUser(actor Actor, userID string) error
+	PurgeDeletedUsers(deletedBefore time.Time) ([]string, error)
+	CreateExport(userID string, tokenHash string) (*Export, error)
+	GetExports(userID string) ([]Export, error)
+	GetPendingExports() ([]Export, error)
+	GetTakeout(userID string) (*Takeout, error)
+	ExportImages(userID string, fn func(photoID string, imageData []byte) error) error
+	FinishExport(exportID string, archive []byte, expiresAt time.Time) error
+	FailExport(exportID string, expiresAt time.Time) error
+	GetExportArchive(exportID string, tokenHash string) ([]byte, error)
+	DeleteExpiredExports() (int, error)
+	GetFollowRequests(userID string, page Page) ([]FollowRequest, error)
+	ApproveFollowRequest(userID string, requesterID string) error
+	RejectFollowRequest(userID string, requesterID string) error
+	MuteUser(userID string, mutedID string, posts bool, comments bool) (bool, error)
+	UnmuteUser(userID string, mutedID string) error
+	GetMutes(userID string, page Page) ([]Mute, error)
+	AddCloseFriend(userID string, friendID string) (bool, error)
+	RemoveCloseFriend(userID string, friendID string) error
+	GetCloseFriends(userID string, page Page) ([]CloseFriend, error)
+	GetSuggestions(userID string, activeSince time.Time, page Page) ([]Suggestion, error)
+	DismissSuggestion(userID string, dismissedID string) error
 }
+
+// busyTimeout is how long a connection waits for the write lock held by another one, in milliseconds
+const busyTimeout = 5000
+
+// DataSourceName returns the data source name to open the SQLite database in filename with. Concurrent writes wait for
+// each other instead of failing with "database is locked": transactions take the write lock as soon as they begin, so
+// that two of them cannot deadlock upgrading their read locks, and wait for it up to busyTimeout.
+func DataSourceName(filename string) string {
+	return fmt.Sprintf("%s?_busy_timeout=%d&_txlock=immediate", filename, busyTimeout)
+}
+
 type appdbimpl struct {
 	c *sql.DB
+
+	photoSearch bool // Whether the full-text index of photos exists, see createPhotoSearchIndex
 }
 
 // New returns a new instance of AppDatabase based on the SQLite connection `db`.
@@ -161,6 +701,205 @@ func New(db *sql.DB) (AppDatabase, error) {
 		return nil, err
 	}
 
+	// Profile fields were added to the users table later on: they are added here to databases created before them
+	for _, column := range []struct{ name, definition string }{
+		{"display_name", "TEXT NOT NULL DEFAULT ''"},
+		{"bio", "TEXT NOT NULL DEFAULT ''"},
+		{"website", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err = ensureColumn(db, "users", column.name, column.definition); err != nil {
+			return nil, err
+		}
+	}
+
+	// Username history table: usernames released by a rename (or by the backfill of username_key, see below)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS username_history (
+        user_id TEXT NOT NULL,
+        username TEXT NOT NULL,
+        username_key TEXT NOT NULL,
+        released_at DATETIME NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS username_history_key ON username_history (username_key, released_at);`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS username_history_user ON username_history (user_id, released_at);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Usernames are unique regardless of case: username_key holds the normalized form that is compared
+	if err = ensureColumn(db, "users", "username_key", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err = backfillUsernameKeys(db); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON users (username_key);`)
+	if err != nil {
+		return nil, err
+	}
+	if err = createUserSearchIndex(db); err != nil {
+		return nil, err
+	}
+
+	// Credentials were added later on as well. Users without a password (NULL) can only use the name-only login.
+	if err = ensureColumn(db, "users", "password_hash", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "users", "email", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+
+	// Roles and suspensions, added later on too. Suspended users have a suspension time.
+	for _, column := range []struct{ name, definition string }{
+		{"role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"suspended_at", "DATETIME"},
+		{"suspension_reason", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err = ensureColumn(db, "users", column.name, column.definition); err != nil {
+			return nil, err
+		}
+	}
+
+	// Deleted accounts have a deletion time: they are purged, with all their data, after a grace period
+	if err = ensureColumn(db, "users", "deleted_at", "DATETIME"); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS users_deleted ON users (deleted_at) WHERE deleted_at IS NOT NULL;`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Audit log table: administrative actions, written in the same transaction as the action itself. The actor is
+	// NULL for actions of the system.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS audit_events (
+        event_id TEXT PRIMARY KEY,
+        created_at DATETIME NOT NULL,
+        actor_id TEXT,
+        action TEXT NOT NULL,
+        target_type TEXT NOT NULL,
+        target_id TEXT NOT NULL,
+        details TEXT NOT NULL DEFAULT ''
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	// The request and the states of the target were added later on
+	for _, column := range []struct{ name, definition string }{
+		{"request_id", "TEXT NOT NULL DEFAULT ''"},
+		{"remote_ip", "TEXT NOT NULL DEFAULT ''"},
+		{"before_state", "TEXT"},
+		{"after_state", "TEXT"},
+	} {
+		if err = ensureColumn(db, "audit_events", column.name, column.definition); err != nil {
+			return nil, err
+		}
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS audit_events_created ON audit_events (created_at);`)
+	if err != nil {
+		return nil, err
+	}
+	// The audit log is append-only: events cannot be changed or removed, not even by mistake
+	for _, trigger := range []string{"UPDATE", "DELETE"} {
+		_, err = db.Exec(fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS audit_events_no_%s BEFORE %s ON audit_events
+            BEGIN SELECT RAISE(ABORT, 'audit events cannot be changed'); END;`, strings.ToLower(trigger), trigger))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Sessions table: only a hash of the token is stored, so that a copy of the database cannot be used to sign in
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+        token_hash TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS sessions_user ON sessions (user_id);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Password reset tokens table, hashed like session tokens
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS password_resets (
+        token_hash TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        expires_at DATETIME NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Personal access tokens table, hashed like session tokens. Scopes are separated by spaces.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS access_tokens (
+        token_id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        token_hash TEXT UNIQUE NOT NULL,
+        scopes TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        expires_at DATETIME,
+        last_used_at DATETIME,
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS access_tokens_user ON access_tokens (user_id, created_at);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Identities table: users signed in with an OpenID Connect provider, by issuer and subject
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS identities (
+        issuer TEXT NOT NULL,
+        subject TEXT NOT NULL,
+        user_id TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (issuer, subject),
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS identities_user ON identities (user_id);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// OpenID Connect logins table: logins started at a provider, until the browser comes back
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS oidc_logins (
+        state_hash TEXT PRIMARY KEY,
+        provider TEXT NOT NULL,
+        nonce TEXT NOT NULL,
+        verifier TEXT NOT NULL,
+        user_id TEXT,
+        expires_at DATETIME NOT NULL
+    );`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Avatars table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS avatars (
+        user_id TEXT PRIMARY KEY,
+        image_data BLOB NOT NULL,
+        timestamp DATETIME NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+
 	// Followers table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS followers (
         user_id TEXT NOT NULL,
@@ -172,6 +911,36 @@ func New(db *sql.DB) (AppDatabase, error) {
 	if err != nil {
 		return nil, err
 	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS followers_follower ON followers (follower_id);`)
+	if err != nil {
+		return nil, err
+	}
+	// The primary key orders the followers of a user by ID: this index orders them by rowid, that is from the most
+	// recent, so that a page of followers does not sort them all
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS followers_user ON followers (user_id);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Private accounts: their followers need their approval, and wait in the follow requests table until then
+	if err = ensureColumn(db, "users", "private", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS follow_requests (
+        user_id TEXT NOT NULL,
+        requester_id TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (user_id, requester_id),
+        FOREIGN KEY (user_id) REFERENCES users(user_id),
+        FOREIGN KEY (requester_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS follow_requests_requester ON follow_requests (requester_id);`)
+	if err != nil {
+		return nil, err
+	}
 
 	// User Photos table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_photos (
@@ -211,6 +980,10 @@ func New(db *sql.DB) (AppDatabase, error) {
 	if err != nil {
 		return nil, err
 	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS likes_photo ON likes (photo_id);`)
+	if err != nil {
+		return nil, err
+	}
 
 	// Photo table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS new_photos (
@@ -223,6 +996,15 @@ func New(db *sql.DB) (AppDatabase, error) {
 	if err != nil {
 		return nil, err
 	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS new_photos_user ON new_photos (user_id, timestamp);`)
+	if err != nil {
+		return nil, err
+	}
+	// The latest photos of everybody, for the recently active users of the follow suggestions
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS new_photos_recent ON new_photos (timestamp);`)
+	if err != nil {
+		return nil, err
+	}
 
 	// Ban table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS new_bans (
@@ -237,11 +1019,314 @@ func New(db *sql.DB) (AppDatabase, error) {
 		return nil, err
 	}
 
+	// A user can ban another user only once. Older databases may hold duplicated bans, which are dropped before the
+	// unique index is built.
+	_, err = db.Exec(`DELETE FROM new_bans WHERE rowid NOT IN (
+        SELECT MIN(rowid) FROM new_bans GROUP BY banned_by, banned_user
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS new_bans_pair ON new_bans (banned_by, banned_user);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Photos and comments hidden by the moderators have a hiding time: nobody can see them anymore
+	for _, table := range []string{"new_photos", "comments"} {
+		if err = ensureColumn(db, table, "hidden_at", "DATETIME"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Photos have an audience chosen by their owner. Close friends are a list kept by each user, seen only by them.
+	if err = ensureColumn(db, "new_photos", "visibility", "TEXT NOT NULL DEFAULT 'public'"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "new_photos", "caption", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS close_friends (
+        user_id TEXT NOT NULL,
+        friend_id TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (user_id, friend_id),
+        FOREIGN KEY (user_id) REFERENCES users(user_id),
+        FOREIGN KEY (friend_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS close_friends_friend ON close_friends (friend_id);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Suggestions dismissed by each user: they are not suggested to it again
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS suggestion_dismissals (
+        user_id TEXT NOT NULL,
+        dismissed_id TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (user_id, dismissed_id),
+        FOREIGN KEY (user_id) REFERENCES users(user_id),
+        FOREIGN KEY (dismissed_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mutes table: a softer ban, seen only by the muting user. Posts and comments are muted separately.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS mutes (
+        user_id TEXT NOT NULL,
+        muted_id TEXT NOT NULL,
+        posts INTEGER NOT NULL,
+        comments INTEGER NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (user_id, muted_id),
+        FOREIGN KEY (user_id) REFERENCES users(user_id),
+        FOREIGN KEY (muted_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS mutes_muted ON mutes (muted_id);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reports table: the moderation queue. There is at most one open report for each target, which collects the
+	// submissions of all the users who report it.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS reports (
+        report_id TEXT PRIMARY KEY,
+        target_type TEXT NOT NULL,
+        target_id TEXT NOT NULL,
+        target_owner TEXT NOT NULL,
+        state TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        resolved_at DATETIME,
+        resolved_by TEXT,
+        resolution_note TEXT NOT NULL DEFAULT ''
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS reports_open_target ON reports (target_type, target_id)
+        WHERE state = 'open';`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS reports_state ON reports (state, created_at);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Report submissions table: a user can report the same target only once per report
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS report_submissions (
+        report_id TEXT NOT NULL,
+        reporter_id TEXT NOT NULL,
+        reason TEXT NOT NULL,
+        comment TEXT NOT NULL DEFAULT '',
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (report_id, reporter_id),
+        FOREIGN KEY (report_id) REFERENCES reports(report_id),
+        FOREIGN KEY (reporter_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Exports table: archives of personal data, built in the background. The download token is hashed like session
+	// tokens.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS exports (
+        export_id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        token_hash TEXT UNIQUE NOT NULL,
+        state TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        ready_at DATETIME,
+        expires_at DATETIME,
+        archive BLOB,
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS exports_user ON exports (user_id, created_at);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hashtags of the photos, taken from their captions when they are posted, and tags followed by each user
+	var tagged bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'photo_tags')`).Scan(&tagged)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS photo_tags (
+        tag TEXT NOT NULL,
+        photo_id TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (tag, photo_id),
+        FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id)
+    ) WITHOUT ROWID;`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS photo_tags_photo ON photo_tags (photo_id);`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS photo_tags_recent ON photo_tags (tag, created_at);`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS photo_tags_created ON photo_tags (created_at);`)
+	if err != nil {
+		return nil, err
+	}
+	if !tagged {
+		if err = tagPhotos(db); err != nil {
+			return nil, err
+		}
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS tag_follows (
+        user_id TEXT NOT NULL,
+        tag TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (user_id, tag),
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS tag_follows_tag ON tag_follows (tag);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trending tags of each window, replaced by every run of ComputeTagTrends
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS tag_trends (
+        trend_window TEXT NOT NULL,
+        tag TEXT NOT NULL,
+        uses INTEGER NOT NULL,
+        previous_uses INTEGER NOT NULL,
+        growth REAL NOT NULL,
+        computed_at DATETIME NOT NULL,
+        PRIMARY KEY (trend_window, tag)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS tag_trends_growth ON tag_trends (trend_window, growth);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replies are comments that answer another comment of the same photo
+	if err = ensureColumn(db, "comments", "reply_to", "TEXT"); err != nil {
+		return nil, err
+	}
+
+	// Notifications table. Each notification has one or more actors (see notify); at most one unread notification
+	// of each aggregated type collects the events about each photo.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS notifications (
+        notification_id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        type TEXT NOT NULL,
+        photo_id TEXT NOT NULL DEFAULT '',
+        comment_id TEXT NOT NULL DEFAULT '',
+        created_at DATETIME NOT NULL,
+        updated_at DATETIME NOT NULL,
+        read_at DATETIME,
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS notifications_user ON notifications (user_id, updated_at);`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS notifications_open_group ON notifications (user_id, type, photo_id)
+        WHERE read_at IS NULL AND type IN ('` + strings.Join(aggregatedNotifications, "', '") + `');`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS notification_actors (
+        notification_id TEXT NOT NULL,
+        actor_id TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (notification_id, actor_id),
+        FOREIGN KEY (notification_id) REFERENCES notifications(notification_id),
+        FOREIGN KEY (actor_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS notification_actors_actor ON notification_actors (actor_id);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Notification preferences: types turned off by each user. Every type is on until turned off.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS notification_preferences (
+        user_id TEXT NOT NULL,
+        type TEXT NOT NULL,
+        enabled INTEGER NOT NULL,
+        PRIMARY KEY (user_id, type),
+        FOREIGN KEY (user_id) REFERENCES users(user_id)
+    );`)
+	if err != nil {
+		return nil, err
+	}
+
+	photoSearch, err := createPhotoSearchIndex(db)
+	if err != nil {
+		return nil, err
+	}
+
 	return &appdbimpl{
-		c: db,
+		c:           db,
+		photoSearch: photoSearch,
 	}, nil
 }
 
 func (db *appdbimpl) Ping() error {
 	return db.c.Ping()
 }
+
+// ensureColumn adds a column to an existing table, unless the table has it already.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	if exists {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// changed reports whether a statement affected at least one row; for example, whether an
+// `INSERT ... ON CONFLICT DO NOTHING` actually inserted a row.
+func changed(res sql.Result) (bool, error) {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	return n > 0, nil
+}
+
+// affected returns the number of rows affected by a statement.
+func affected(res sql.Result) (int, error) {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	return int(n), nil
+}
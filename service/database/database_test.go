@@ -0,0 +1,61 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestDB returns a new database in a temporary directory, closed when the test ends.
+func newTestDB(tb testing.TB) *appdbimpl {
+	tb.Helper()
+	conn, err := sql.Open("sqlite3", DataSourceName(filepath.Join(tb.TempDir(), "test.db")))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+	db, err := New(conn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db.(*appdbimpl)
+}
+
+// seed runs a statement once for each set of arguments, in a single transaction.
+func seed(tb testing.TB, db *appdbimpl, query string, n int, args func(i int) []interface{}) {
+	tb.Helper()
+	tx, err := db.c.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer stmt.Close()
+	for i := 0; i < n; i++ {
+		if _, err = stmt.Exec(args(i)...); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// addUsers adds a user for each name, and returns their IDs by name.
+func addUsers(tb testing.TB, db *appdbimpl, names ...string) map[string]string {
+	tb.Helper()
+	ids := map[string]string{}
+	for _, name := range names {
+		user := &User{Username: name}
+		if err := db.AddUser(user); err != nil {
+			tb.Fatal(err)
+		}
+		ids[name] = user.ID
+	}
+	return ids
+}
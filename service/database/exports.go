@@ -0,0 +1,256 @@
+package database
+
+// Data exports: archives with the personal data of a user. The archives are built in the background by the API
+// package, and removed when they expire.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// CreateExport adds a pending export for a user, downloaded with the token of the given hash once ready.
+// ErrExportPending is returned if the user has a pending export already.
+func (db *appdbimpl) CreateExport(userID string, tokenHash string) (*Export, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var pending bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM exports WHERE user_id = ? AND state = ?)`,
+		userID, ExportPending).Scan(&pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check pending exports: %w", err)
+	}
+	if pending {
+		return nil, ErrExportPending
+	}
+
+	export := Export{UserID: userID, State: ExportPending, CreatedAt: globaltime.Now().UTC()}
+	if export.ID, err = generateRandomString(10); err != nil {
+		return nil, fmt.Errorf("failed to generate export id: %w", err)
+	}
+	_, err = tx.Exec(`INSERT INTO exports (export_id, user_id, token_hash, state, created_at) VALUES (?, ?, ?, ?, ?)`,
+		export.ID, userID, tokenHash, export.State, export.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return &export, nil
+}
+
+// GetExports returns the exports of a user that have not expired, newest first.
+func (db *appdbimpl) GetExports(userID string) ([]Export, error) {
+	return db.queryExports(`WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ?) ORDER BY created_at DESC`,
+		userID, globaltime.Now().UTC())
+}
+
+// GetPendingExports returns the exports waiting for their archive, oldest first.
+func (db *appdbimpl) GetPendingExports() ([]Export, error) {
+	return db.queryExports(`WHERE state = ? ORDER BY created_at`, ExportPending)
+}
+
+func (db *appdbimpl) queryExports(where string, args ...interface{}) ([]Export, error) {
+	rows, err := db.c.Query(`SELECT export_id, user_id, state, created_at, ready_at, expires_at,
+        COALESCE(LENGTH(archive), 0) FROM exports `+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query exports: %w", err)
+	}
+	defer rows.Close()
+
+	exports := []Export{}
+	for rows.Next() {
+		var e Export
+		var readyAt, expiresAt sql.NullTime
+		err = rows.Scan(&e.ID, &e.UserID, &e.State, &e.CreatedAt, &readyAt, &expiresAt, &e.Size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan export: %w", err)
+		}
+		e.ReadyAt, e.ExpiresAt = nullTime(readyAt), nullTime(expiresAt)
+		exports = append(exports, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iteration error: %w", err)
+	}
+	return exports, nil
+}
+
+// GetTakeout collects the personal data of a user, except the images and the names of their files in the archive.
+// Photos and comments hidden by the moderators are included, since they still belong to the user. ErrUserNotFound is
+// returned if there is no such user.
+func (db *appdbimpl) GetTakeout(userID string) (*Takeout, error) {
+	var t Takeout
+	err := db.c.QueryRow(`SELECT user_id, username, display_name, bio, website, email FROM users WHERE user_id = ?`,
+		userID).Scan(&t.Account.UserID, &t.Account.Username, &t.Account.DisplayName, &t.Account.Bio,
+		&t.Account.Website, &t.Account.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	relations := []struct {
+		list  *[]TakeoutRelation
+		query string
+	}{
+		{&t.Following, `SELECT u.user_id, u.username, NULL FROM followers f JOIN users u ON u.user_id = f.user_id
+            WHERE f.follower_id = ? ORDER BY f.rowid`},
+		{&t.Followers, `SELECT u.user_id, u.username, NULL FROM followers f JOIN users u ON u.user_id = f.follower_id
+            WHERE f.user_id = ? ORDER BY f.rowid`},
+		{&t.Bans, `SELECT u.user_id, u.username, b.timestamp FROM new_bans b JOIN users u ON u.user_id = b.banned_user
+            WHERE b.banned_by = ? ORDER BY b.timestamp`},
+	}
+	for _, rel := range relations {
+		*rel.list = []TakeoutRelation{}
+		err = db.scanRows(rel.query, []interface{}{userID}, func(rows *sql.Rows) error {
+			var r TakeoutRelation
+			var since sql.NullTime
+			if err := rows.Scan(&r.UserID, &r.Username, &since); err != nil {
+				return err
+			}
+			r.Since = nullTime(since)
+			*rel.list = append(*rel.list, r)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query relations: %w", err)
+		}
+	}
+
+	t.Likes = []TakeoutLike{}
+	err = db.scanRows(`SELECT photo_id, timestamp FROM likes WHERE user_id = ? ORDER BY timestamp`,
+		[]interface{}{userID}, func(rows *sql.Rows) error {
+			var l TakeoutLike
+			if err := rows.Scan(&l.PhotoID, &l.Timestamp); err != nil {
+				return err
+			}
+			t.Likes = append(t.Likes, l)
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query likes: %w", err)
+	}
+
+	t.Comments = []TakeoutComment{}
+	err = db.scanRows(`SELECT comment_id, photo_id, content, timestamp FROM comments WHERE user_id = ?
+        ORDER BY timestamp`, []interface{}{userID}, func(rows *sql.Rows) error {
+		var c TakeoutComment
+		if err := rows.Scan(&c.CommentID, &c.PhotoID, &c.Content, &c.Timestamp); err != nil {
+			return err
+		}
+		t.Comments = append(t.Comments, c)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query comments: %w", err)
+	}
+
+	t.Photos = []TakeoutPhoto{}
+	err = db.scanRows(`SELECT p.photo_id, p.timestamp,
+            (SELECT COUNT(*) FROM likes l WHERE l.photo_id = p.photo_id
+                AND l.user_id NOT IN (`+deletedUsersSQL+`)),
+            (SELECT COUNT(*) FROM comments c WHERE c.photo_id = p.photo_id),
+            p.visibility, p.caption, p.hidden_at IS NOT NULL
+        FROM new_photos p WHERE p.user_id = ? ORDER BY p.timestamp`, []interface{}{userID}, func(rows *sql.Rows) error {
+		var p TakeoutPhoto
+		if err := rows.Scan(&p.PhotoID, &p.Timestamp, &p.Likes, &p.Comments, &p.Visibility, &p.Caption, &p.Hidden); err != nil {
+			return err
+		}
+		t.Photos = append(t.Photos, p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query photos: %w", err)
+	}
+	return &t, nil
+}
+
+// scanRows runs a query and calls fn for each row, stopping at the first error.
+func (db *appdbimpl) scanRows(query string, args []interface{}, fn func(*sql.Rows) error) error {
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ExportImages calls fn with the image of each photo of a user, oldest first, and stops at the first error. Images are
+// loaded one at a time.
+func (db *appdbimpl) ExportImages(userID string, fn func(photoID string, imageData []byte) error) error {
+	return db.scanRows(`SELECT photo_id, image_data FROM new_photos WHERE user_id = ? ORDER BY timestamp`,
+		[]interface{}{userID}, func(rows *sql.Rows) error {
+			var photoID string
+			var imageData []byte
+			if err := rows.Scan(&photoID, &imageData); err != nil {
+				return fmt.Errorf("failed to scan image: %w", err)
+			}
+			return fn(photoID, imageData)
+		})
+}
+
+// FinishExport stores the archive of a pending export, which can be downloaded until expiresAt.
+//
+// The archive is a single BLOB, built in memory by the API and read back whole when downloaded, so an export needs as
+// much memory as all the images of the user together. This is fine at the size of the photos we accept, but users
+// with many photos should rather have their archive streamed to a file, and the file served from the disk.
+func (db *appdbimpl) FinishExport(exportID string, archive []byte, expiresAt time.Time) error {
+	return db.closeExport(exportID, ExportReady, archive, expiresAt)
+}
+
+// FailExport marks a pending export as failed. It is shown to the user until expiresAt.
+func (db *appdbimpl) FailExport(exportID string, expiresAt time.Time) error {
+	return db.closeExport(exportID, ExportFailed, nil, expiresAt)
+}
+
+func (db *appdbimpl) closeExport(exportID string, state string, archive []byte, expiresAt time.Time) error {
+	res, err := db.c.Exec(`UPDATE exports SET state = ?, archive = ?, ready_at = ?, expires_at = ?
+        WHERE export_id = ? AND state = ?`, state, archive, globaltime.Now().UTC(), expiresAt.UTC(), exportID,
+		ExportPending)
+	if err != nil {
+		return fmt.Errorf("failed to update export: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrExportNotFound
+	}
+	return nil
+}
+
+// GetExportArchive returns the archive of a ready export, if tokenHash is the hash of its download token and it has
+// not expired. ErrExportNotFound is returned otherwise.
+func (db *appdbimpl) GetExportArchive(exportID string, tokenHash string) ([]byte, error) {
+	var archive []byte
+	err := db.c.QueryRow(`SELECT archive FROM exports
+        WHERE export_id = ? AND token_hash = ? AND state = ? AND expires_at > ?`,
+		exportID, tokenHash, ExportReady, globaltime.Now().UTC()).Scan(&archive)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrExportNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get export: %w", err)
+	}
+	return archive, nil
+}
+
+// DeleteExpiredExports removes the exports that have expired, with their archives, and returns how many they were.
+func (db *appdbimpl) DeleteExpiredExports() (int, error) {
+	res, err := db.c.Exec(`DELETE FROM exports WHERE expires_at <= ?`, globaltime.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired exports: %w", err)
+	}
+	return affected(res)
+}
@@ -0,0 +1,102 @@
+package database
+
+// Follow requests. Following a user with a private account sends a follow request (see FollowUser), that the user
+// approves or rejects: until then, the requester does not see its photos and followers (see accountOpenSQL).
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// GetFollowRequests returns the pending follow requests sent to userID, oldest first. Requests of deleted accounts are
+// left out.
+func (db *appdbimpl) GetFollowRequests(userID string, page Page) ([]FollowRequest, error) {
+	requests := []FollowRequest{}
+	err := db.scanRows(`SELECT r.requester_id, u.username, r.created_at
+        FROM follow_requests r JOIN users u ON u.user_id = r.requester_id
+        WHERE r.user_id = ? AND u.deleted_at IS NULL
+        ORDER BY r.created_at, r.requester_id
+        LIMIT ? OFFSET ?`, []interface{}{userID, page.Limit, page.Offset}, func(rows *sql.Rows) error {
+		var request FollowRequest
+		if err := rows.Scan(&request.UserID, &request.Username, &request.CreatedAt); err != nil {
+			return err
+		}
+		requests = append(requests, request)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query follow requests: %w", err)
+	}
+	return requests, nil
+}
+
+// ApproveFollowRequest makes requesterID a follower of userID. ErrFollowRequestNotFound is returned if requesterID has
+// no pending request.
+func (db *appdbimpl) ApproveFollowRequest(userID string, requesterID string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = deleteFollowRequest(tx, userID, requesterID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO followers (user_id, follower_id) VALUES (?, ?)
+        ON CONFLICT (user_id, follower_id) DO NOTHING`, userID, requesterID)
+	if err != nil {
+		return fmt.Errorf("failed to add follower: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// RejectFollowRequest removes the pending follow request of requesterID. ErrFollowRequestNotFound is returned if
+// there is none.
+func (db *appdbimpl) RejectFollowRequest(userID string, requesterID string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = deleteFollowRequest(tx, userID, requesterID); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// deleteFollowRequest removes a pending follow request, or returns ErrFollowRequestNotFound.
+func deleteFollowRequest(tx *sql.Tx, userID string, requesterID string) error {
+	res, err := tx.Exec(`DELETE FROM follow_requests WHERE user_id = ? AND requester_id = ?`, userID, requesterID)
+	if err != nil {
+		return fmt.Errorf("failed to delete follow request: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrFollowRequestNotFound
+	}
+	return nil
+}
+
+// approveFollowRequests makes all the requesters of userID its followers, when the account goes public.
+func approveFollowRequests(tx *sql.Tx, userID string) error {
+	_, err := tx.Exec(`INSERT INTO followers (user_id, follower_id)
+        SELECT user_id, requester_id FROM follow_requests WHERE user_id = ? ORDER BY created_at
+        ON CONFLICT (user_id, follower_id) DO NOTHING`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to approve follow requests: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM follow_requests WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to delete follow requests: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPrivateAccount(t *testing.T) {
+	db := newTestDB(t)
+	ids := addUsers(t, db, "alice", "bob", "carol")
+	private := true
+	if err := db.UpdateProfile(ids["alice"], ProfileUpdate{Private: &private}); err != nil {
+		t.Fatal(err)
+	}
+	photo := Photo{ID: "photo", UserID: ids["alice"], Timestamp: time.Now(), Visibility: VisibilityPublic}
+	if err := db.AddPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.c.Exec(`INSERT INTO followers (user_id, follower_id) VALUES (?, ?)`, ids["alice"], ids["carol"]); err != nil {
+		t.Fatal(err)
+	}
+
+	// check returns whether the photos and the followers of alice can be seen by viewer, and fails if the queries
+	// disagree
+	check := func(viewer string) bool {
+		t.Helper()
+		photos, err := db.GetUserPhotoIDs(ids["alice"], ids[viewer], Page{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.GetFollowers(ids["alice"], ids[viewer], Page{Limit: 10})
+		if err != nil && !errors.Is(err, ErrPrivateAccount) {
+			t.Fatal(err)
+		}
+		visible := db.checkPhotoVisible("photo", ids[viewer])
+		if (len(photos) == 1) != (err == nil) || (visible == nil) != (err == nil) {
+			t.Fatalf("%s sees %d photos, followers refused with %v and the photo refused with %v", viewer, len(photos),
+				err, visible)
+		}
+		return err == nil
+	}
+	if !check("alice") || !check("carol") {
+		t.Error("the owner and the followers cannot see the account")
+	}
+	if check("bob") {
+		t.Error("bob sees the account without following it")
+	}
+
+	state, err := db.FollowUser(ids["bob"], ids["alice"])
+	if err != nil || state != FollowRequested {
+		t.Fatalf("follow: %s (%v), want %s", state, err, FollowRequested)
+	}
+	if check("bob") {
+		t.Error("bob sees the account before the follow request is accepted")
+	}
+	if err = db.ApproveFollowRequest(ids["alice"], ids["bob"]); err != nil {
+		t.Fatal(err)
+	}
+	if !check("bob") {
+		t.Error("bob cannot see the account once the follow request is accepted")
+	}
+	if err = db.ApproveFollowRequest(ids["alice"], ids["bob"]); !errors.Is(err, ErrFollowRequestNotFound) {
+		t.Errorf("second approval: %v, want ErrFollowRequestNotFound", err)
+	}
+}
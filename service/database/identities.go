@@ -0,0 +1,119 @@
+package database
+
+// External identities (OpenID Connect) and the logins started at a provider. See package oidc.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// GetExternalUser returns the user linked to an external identity, or nil if there is none.
+func (db *appdbimpl) GetExternalUser(identity ExternalIdentity) (*User, error) {
+	var user User
+	err := db.c.QueryRow(`SELECT u.user_id, u.username FROM identities i JOIN users u ON u.user_id = i.user_id
+        WHERE i.issuer = ? AND i.subject = ?`, identity.Issuer, identity.Subject).Scan(&user.ID, &user.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get identity: %w", err)
+	}
+	return &user, nil
+}
+
+// LinkIdentity links an external identity to a user. Linking it again to the same user is not an error;
+// ErrIdentityLinked is returned if it is linked to another user.
+func (db *appdbimpl) LinkIdentity(userID string, identity ExternalIdentity) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = linkIdentity(tx, userID, identity); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func linkIdentity(tx *sql.Tx, userID string, identity ExternalIdentity) error {
+	res, err := tx.Exec(`INSERT INTO identities (issuer, subject, user_id, created_at)
+        SELECT ?, ?, user_id, ? FROM users WHERE user_id = ?
+        ON CONFLICT (issuer, subject) DO NOTHING`,
+		identity.Issuer, identity.Subject, globaltime.Now().UTC(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil || ok {
+		return err
+	}
+
+	// Nothing was inserted: the identity is already linked, or the user does not exist
+	var owner string
+	err = tx.QueryRow(`SELECT user_id FROM identities WHERE issuer = ? AND subject = ?`,
+		identity.Issuer, identity.Subject).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to get identity: %w", err)
+	}
+	if owner != userID {
+		return ErrIdentityLinked
+	}
+	return nil
+}
+
+// CreateOIDCLogin stores a login started at a provider.
+func (db *appdbimpl) CreateOIDCLogin(login OIDCLogin) error {
+	// Logins abandoned by the browser are dropped here, as they are not needed anymore
+	_, err := db.c.Exec(`DELETE FROM oidc_logins WHERE expires_at <= ?`, globaltime.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired logins: %w", err)
+	}
+	_, err = db.c.Exec(`INSERT INTO oidc_logins (state_hash, provider, nonce, verifier, user_id, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?)`, login.StateHash, login.Provider, login.Nonce, login.Verifier,
+		sql.NullString{String: login.UserID, Valid: login.UserID != ""}, login.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to create login: %w", err)
+	}
+	return nil
+}
+
+// ConsumeOIDCLogin returns and deletes the login with the given state hash, so that it can be completed only once.
+// ErrOIDCLoginInvalid is returned if there is no such login, or if it has expired.
+func (db *appdbimpl) ConsumeOIDCLogin(stateHash string) (*OIDCLogin, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	login := OIDCLogin{StateHash: stateHash}
+	var userID sql.NullString
+	err = tx.QueryRow(`SELECT provider, nonce, verifier, user_id, expires_at FROM oidc_logins WHERE state_hash = ?`,
+		stateHash).Scan(&login.Provider, &login.Nonce, &login.Verifier, &userID, &login.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOIDCLoginInvalid
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get login: %w", err)
+	}
+	login.UserID = userID.String
+
+	_, err = tx.Exec(`DELETE FROM oidc_logins WHERE state_hash = ?`, stateHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete login: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	if !login.ExpiresAt.After(globaltime.Now()) {
+		return nil, ErrOIDCLoginInvalid
+	}
+	return &login, nil
+}
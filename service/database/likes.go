@@ -1,26 +1,50 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
 )
 
-func (db *appdbimpl) LikePhoto(userID string, photoID string) error {
-	// Check if the like already exists to avoid duplicates
-	var exists bool
-	err := db.c.QueryRow("SELECT EXISTS(SELECT 1 FROM likes WHERE user_id = ? AND photo_id = ?)", userID, photoID).Scan(&exists)
+// LikePhoto records that userID likes photoID, and notifies the owner of the photo. Liking a photo twice is not an
+// error: the second call leaves the existing like untouched and returns false. ErrPhotoNotFound is returned if the user
+// cannot see the photo.
+func (db *appdbimpl) LikePhoto(userID string, photoID string) (bool, error) {
+	tx, err := db.c.Begin()
 	if err != nil {
-		return fmt.Errorf("query error: %w", err)
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	if exists {
-		return fmt.Errorf("like already exists")
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`INSERT INTO likes (user_id, photo_id, timestamp)
+        SELECT @viewer, p.photo_id, CURRENT_TIMESTAMP FROM new_photos p WHERE p.photo_id = @photo AND `+photoVisibleSQL+`
+        ON CONFLICT (user_id, photo_id) DO NOTHING`, sql.Named("viewer", userID), sql.Named("photo", photoID))
+	if err != nil {
+		return false, fmt.Errorf("failed to execute insert statement: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		// Nothing was inserted: either the photo is already liked, or it cannot be seen
+		_ = tx.Rollback()
+		return false, db.checkPhotoVisible(photoID, userID)
 	}
 
-	// Insert the like into the database
-	_, err = db.c.Exec("INSERT INTO likes (user_id, photo_id, timestamp) VALUES (?, ?, CURRENT_TIMESTAMP)", userID, photoID)
+	var owner string
+	if err = tx.QueryRow(`SELECT user_id FROM new_photos WHERE photo_id = ?`, photoID).Scan(&owner); err != nil {
+		return false, fmt.Errorf("failed to get photo owner: %w", err)
+	}
+	err = notify(tx, event{userID: owner, actorID: userID, kind: NotifyLike, photoID: photoID, at: globaltime.Now()})
 	if err != nil {
-		return fmt.Errorf("failed to execute insert statement: %w", err)
+		return false, err
 	}
-	return nil
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+	return true, nil
 }
 
 func (db *appdbimpl) UnlikePhoto(userID string, photoID string) error {
@@ -40,3 +64,24 @@ func (db *appdbimpl) IsLiked(photoID string, userID string) (bool, error) {
 	}
 	return exists, nil
 }
+
+// GetLikers returns the users who liked a photo. Users banned by the viewer, or who banned the viewer, are left out.
+func (db *appdbimpl) GetLikers(photoID string, viewerID string, page Page) ([]UserSummary, error) {
+	if err := db.checkPhotoVisible(photoID, viewerID); err != nil {
+		return nil, err
+	}
+
+	likers, err := db.queryUserSummaries(`
+    SELECT `+userSummarySQL+`
+    FROM likes l
+    JOIN users u ON u.user_id = l.user_id
+    WHERE l.photo_id = @photo AND `+userListedSQL+`
+    ORDER BY l.timestamp DESC, u.user_id
+    LIMIT @limit OFFSET @offset
+    `, sql.Named("photo", photoID), sql.Named("viewer", viewerID),
+		sql.Named("limit", page.Limit), sql.Named("offset", page.Offset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query likers: %w", err)
+	}
+	return likers, nil
+}
@@ -0,0 +1,86 @@
+package database
+
+// Mutes. Muting a user is a softer alternative to banning it: the muted user is not told, and can still see and
+// interact with the content of the muting user. Only the stream and the comments seen by the muting user change.
+
+import (
+	"database/sql"
+	"fmt"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// postsNotMutedSQL is the predicate leaving out of the stream the photos of the users muted by the viewer. The query
+// must alias the photo table as `p` and bind the requesting user ID as the named parameter `viewer`.
+const postsNotMutedSQL = `NOT EXISTS (
+        SELECT 1 FROM mutes mp WHERE mp.user_id = @viewer AND mp.muted_id = p.user_id AND mp.posts
+    )`
+
+// commentNotMutedSQL is the predicate leaving out the comments of the users whose comments are muted by the viewer.
+// The query must alias the comment table as `c` and bind the requesting user ID as the named parameter `viewer`.
+const commentNotMutedSQL = `NOT EXISTS (
+        SELECT 1 FROM mutes mc WHERE mc.user_id = @viewer AND mc.muted_id = c.user_id AND mc.comments
+    )`
+
+// MuteUser makes userID mute the posts, the comments, or both, of mutedID, and reports whether the user was not muted
+// before. Muting a muted user again replaces what is muted. ErrSelfTarget and ErrUserNotFound are returned for the
+// caller itself and for unknown users.
+func (db *appdbimpl) MuteUser(userID string, mutedID string, posts bool, comments bool) (bool, error) {
+	if userID == mutedID {
+		return false, ErrSelfTarget
+	}
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = checkUserExistsTx(tx, mutedID); err != nil {
+		return false, err
+	}
+	var existed bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM mutes WHERE user_id = ? AND muted_id = ?)`, userID, mutedID).Scan(&existed)
+	if err != nil {
+		return false, fmt.Errorf("failed to check mute: %w", err)
+	}
+	_, err = tx.Exec(`INSERT INTO mutes (user_id, muted_id, posts, comments, created_at) VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT (user_id, muted_id) DO UPDATE SET posts = excluded.posts, comments = excluded.comments`,
+		userID, mutedID, posts, comments, globaltime.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to mute user: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+	return !existed, nil
+}
+
+// UnmuteUser lifts the mute of mutedID by userID. Unmuting a user who is not muted is not an error.
+func (db *appdbimpl) UnmuteUser(userID string, mutedID string) error {
+	_, err := db.c.Exec(`DELETE FROM mutes WHERE user_id = ? AND muted_id = ?`, userID, mutedID)
+	if err != nil {
+		return fmt.Errorf("failed to unmute user: %w", err)
+	}
+	return nil
+}
+
+// GetMutes returns the users muted by userID, most recent first. Deleted accounts are left out.
+func (db *appdbimpl) GetMutes(userID string, page Page) ([]Mute, error) {
+	mutes := []Mute{}
+	err := db.scanRows(`SELECT m.muted_id, u.username, m.posts, m.comments, m.created_at
+        FROM mutes m JOIN users u ON u.user_id = m.muted_id
+        WHERE m.user_id = ? AND u.deleted_at IS NULL
+        ORDER BY m.created_at DESC, m.muted_id
+        LIMIT ? OFFSET ?`, []interface{}{userID, page.Limit, page.Offset}, func(rows *sql.Rows) error {
+		var m Mute
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Posts, &m.Comments, &m.CreatedAt); err != nil {
+			return err
+		}
+		mutes = append(mutes, m)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mutes: %w", err)
+	}
+	return mutes, nil
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMutes(t *testing.T) {
+	db := newTestDB(t)
+	ids := addUsers(t, db, "alice", "bob", "carol", "dave")
+	now := time.Now()
+	for i, name := range []string{"bob", "carol", "dave"} {
+		if _, err := db.FollowUser(ids["alice"], ids[name]); err != nil {
+			t.Fatal(err)
+		}
+		photo := Photo{ID: name, UserID: ids[name], Timestamp: now.Add(time.Duration(i) * time.Minute),
+			Visibility: VisibilityPublic}
+		if err := db.AddPhoto(photo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, name := range []string{"bob", "carol"} {
+		comment := Comment{ID: name, UserID: ids[name], PhotoID: "dave", Content: "nice",
+			Timestamp: now.Add(time.Duration(i) * time.Second)}
+		if err := db.AddComment(comment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice mutes the posts of bob, and the comments of carol
+	if _, err := db.MuteUser(ids["alice"], ids["bob"], true, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.MuteUser(ids["alice"], ids["carol"], false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := db.GetMyStream(ids["alice"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(stream, []string{"dave", "carol"}) {
+		t.Errorf("stream %v, want the photos of dave and carol only", stream)
+	}
+
+	comments := func(viewer string) []string {
+		t.Helper()
+		photo, err := db.GetPhoto("dave", ids[viewer])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range photo.Comments {
+			got = append(got, c.ID)
+		}
+		return got
+	}
+	if got := comments("alice"); !equalStrings(got, []string{"bob"}) {
+		t.Errorf("alice sees the comments %v, want only the one of bob", got)
+	}
+	if got := comments("dave"); !equalStrings(got, []string{"carol", "bob"}) {
+		t.Errorf("dave sees the comments %v, want both", got)
+	}
+
+	if err = db.UnmuteUser(ids["alice"], ids["bob"]); err != nil {
+		t.Fatal(err)
+	}
+	if stream, err = db.GetMyStream(ids["alice"]); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(stream, []string{"dave", "carol", "bob"}) {
+		t.Errorf("stream after unmuting %v, want the photos of everybody", stream)
+	}
+}
@@ -0,0 +1,286 @@
+package database
+
+// Notifications. Likes, comments, replies, mentions, follows and follow requests notify the user they concern, in the
+// transaction that records them (see notify). Users are never notified by users they banned or who banned them, nor
+// about photos they cannot see, nor about the types they turned off; bans made later hide the notifications already
+// sent (see notificationVisibleSQL).
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/username"
+)
+
+// notificationTypes are all the types of notifications, each one with a preference
+var notificationTypes = []string{
+	NotifyLike, NotifyComment, NotifyReply, NotifyMention, NotifyFollow, NotifyFollowRequest,
+}
+
+// aggregatedNotifications are the types of notifications that collect the events about the same photo while unread
+var aggregatedNotifications = []string{NotifyLike, NotifyComment, NotifyFollow, NotifyFollowRequest}
+
+// maxNotificationActors is how many actors are returned with each notification, most recent first
+const maxNotificationActors = 2
+
+// notificationVisibleSQL is the predicate deciding whether the notification aliased as `n` is shown to the user bound
+// as `viewer`: notifications about photos it cannot see anymore, or about comments deleted or hidden since, are not.
+var notificationVisibleSQL = `n.user_id = @viewer
+        AND (n.photo_id = '' OR EXISTS (SELECT 1 FROM new_photos p WHERE p.photo_id = n.photo_id AND ` + photoVisibleSQL + `))
+        AND (n.comment_id = '' OR EXISTS (
+            SELECT 1 FROM comments c WHERE c.comment_id = n.comment_id AND c.hidden_at IS NULL
+        ))`
+
+// notificationActorsSQL joins the actors of the notification aliased as `n` as `a`, with their users as `u`, leaving
+// out the actors that the user bound as `viewer` does not see (see userListedSQL).
+const notificationActorsSQL = `notification_actors a JOIN users u ON u.user_id = a.actor_id
+        WHERE a.notification_id = n.notification_id AND ` + userListedSQL
+
+// event is something that actorID did which concerns userID, and may notify it
+type event struct {
+	userID    string
+	actorID   string
+	kind      string // One of the Notify types
+	photoID   string
+	commentID string
+	at        time.Time
+}
+
+// notify records an event within tx, unless userID is not to be notified about it: events of users about themselves,
+// events between users banned in either direction, events about photos the user cannot see, and events of the types
+// the user turned off are dropped. Aggregated events are added to the unread notification of the same type about the
+// same photo, if there is one.
+func notify(tx *sql.Tx, e event) error {
+	if e.userID == e.actorID {
+		return nil
+	}
+	var allowed bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE user_id = @viewer AND deleted_at IS NULL)
+        AND NOT EXISTS (
+            SELECT 1 FROM new_bans nb
+            WHERE (nb.banned_by = @viewer AND nb.banned_user = @actor) OR (nb.banned_by = @actor AND nb.banned_user = @viewer)
+        )
+        AND NOT EXISTS (SELECT 1 FROM notification_preferences WHERE user_id = @viewer AND type = @type AND NOT enabled)
+        AND (@photo = '' OR EXISTS (SELECT 1 FROM new_photos p WHERE p.photo_id = @photo AND `+photoVisibleSQL+`))`,
+		sql.Named("viewer", e.userID), sql.Named("actor", e.actorID), sql.Named("type", e.kind),
+		sql.Named("photo", e.photoID)).Scan(&allowed)
+	if err != nil {
+		return fmt.Errorf("failed to check notification: %w", err)
+	}
+	if !allowed {
+		return nil
+	}
+
+	at := e.at.UTC()
+	var notificationID string
+	if aggregated(e.kind) {
+		err = tx.QueryRow(`SELECT notification_id FROM notifications
+            WHERE user_id = ? AND type = ? AND photo_id = ? AND read_at IS NULL`, e.userID, e.kind, e.photoID).Scan(&notificationID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to get notification: %w", err)
+		}
+	}
+	if notificationID == "" {
+		if notificationID, err = generateRandomString(10); err != nil {
+			return fmt.Errorf("failed to generate notification id: %w", err)
+		}
+		_, err = tx.Exec(`INSERT INTO notifications (notification_id, user_id, type, photo_id, comment_id, created_at, updated_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?)`, notificationID, e.userID, e.kind, e.photoID, e.commentID, at, at)
+	} else {
+		_, err = tx.Exec(`UPDATE notifications SET updated_at = ? WHERE notification_id = ?`, at, notificationID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save notification: %w", err)
+	}
+	_, err = tx.Exec(`INSERT INTO notification_actors (notification_id, actor_id, created_at) VALUES (?, ?, ?)
+        ON CONFLICT (notification_id, actor_id) DO UPDATE SET created_at = excluded.created_at`, notificationID, e.actorID, at)
+	if err != nil {
+		return fmt.Errorf("failed to save notification actor: %w", err)
+	}
+	return nil
+}
+
+// notifyMentions notifies the users mentioned in text by actorID, except for those in skip, which were notified about
+// the same event already.
+func notifyMentions(tx *sql.Tx, text string, e event, skip ...string) error {
+	for _, key := range username.Mentions(text) {
+		var userID string
+		err := tx.QueryRow(`SELECT user_id FROM users WHERE username_key = ?`, key).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to get mentioned user: %w", err)
+		}
+		if contains(skip, userID) {
+			continue
+		}
+		e.userID = userID
+		if err = notify(tx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregated reports whether notifications of type kind collect several events.
+func aggregated(kind string) bool {
+	return contains(aggregatedNotifications, kind)
+}
+
+// contains reports whether s is in list.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNotifications returns the notifications of userID, most recently updated first, and how many of them are unread.
+// Actors that userID does not see (see userListedSQL) are left out, and so are the notifications left without actors.
+func (db *appdbimpl) GetNotifications(userID string, page Page) ([]Notification, int, error) {
+	var unread int
+	err := db.c.QueryRow(`SELECT COUNT(*) FROM notifications n
+        WHERE `+notificationVisibleSQL+` AND n.read_at IS NULL AND EXISTS (SELECT 1 FROM `+notificationActorsSQL+`)`,
+		sql.Named("viewer", userID)).Scan(&unread)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count unread notifications: %w", err)
+	}
+
+	notifications := []Notification{}
+	byID := map[string]int{}
+	err = db.scanRows(`SELECT * FROM (
+            SELECT n.notification_id, n.type, n.photo_id, n.comment_id, n.read_at IS NOT NULL, n.updated_at,
+                   (SELECT COUNT(*) FROM `+notificationActorsSQL+`) AS actors
+            FROM notifications n
+            WHERE `+notificationVisibleSQL+`
+        )
+        WHERE actors > 0
+        ORDER BY updated_at DESC, notification_id
+        LIMIT @limit OFFSET @offset`, []interface{}{
+		sql.Named("viewer", userID), sql.Named("limit", page.Limit), sql.Named("offset", page.Offset),
+	}, func(rows *sql.Rows) error {
+		n := Notification{Actors: []NotificationActor{}}
+		if err := rows.Scan(&n.ID, &n.Type, &n.PhotoID, &n.CommentID, &n.Read, &n.UpdatedAt, &n.ActorCount); err != nil {
+			return err
+		}
+		byID[n.ID] = len(notifications)
+		notifications = append(notifications, n)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query notifications: %w", err)
+	}
+	if len(notifications) == 0 {
+		return notifications, unread, nil
+	}
+
+	ids := make([]string, 0, len(notifications))
+	for _, n := range notifications {
+		ids = append(ids, n.ID)
+	}
+	encoded, err := json.Marshal(ids)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encode notification ids: %w", err)
+	}
+	err = db.scanRows(`SELECT notification_id, user_id, username FROM (
+            SELECT a.notification_id, u.user_id, u.username,
+                   ROW_NUMBER() OVER (PARTITION BY a.notification_id ORDER BY a.created_at DESC, u.user_id) AS n
+            FROM notification_actors a JOIN users u ON u.user_id = a.actor_id
+            WHERE a.notification_id IN (SELECT value FROM json_each(@ids)) AND `+userListedSQL+`
+        )
+        WHERE n <= @max
+        ORDER BY notification_id, n`, []interface{}{
+		sql.Named("ids", string(encoded)), sql.Named("viewer", userID), sql.Named("max", maxNotificationActors),
+	}, func(rows *sql.Rows) error {
+		var notificationID string
+		var actor NotificationActor
+		if err := rows.Scan(&notificationID, &actor.UserID, &actor.Username); err != nil {
+			return err
+		}
+		n := &notifications[byID[notificationID]]
+		n.Actors = append(n.Actors, actor)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query notification actors: %w", err)
+	}
+	return notifications, unread, nil
+}
+
+// MarkNotificationRead marks a notification of userID as read; marking it again is not an error. Later events start a
+// new notification. ErrNotificationNotFound is returned if userID has no such notification.
+func (db *appdbimpl) MarkNotificationRead(userID string, notificationID string) error {
+	res, err := db.c.Exec(`UPDATE notifications SET read_at = COALESCE(read_at, ?) WHERE notification_id = ? AND user_id = ?`,
+		globaltime.Now().UTC(), notificationID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to mark notification read: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotificationNotFound
+	}
+	return nil
+}
+
+// MarkAllNotificationsRead marks all the notifications of userID as read, and returns how many were unread.
+func (db *appdbimpl) MarkAllNotificationsRead(userID string) (int, error) {
+	res, err := db.c.Exec(`UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL`,
+		globaltime.Now().UTC(), userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark notifications read: %w", err)
+	}
+	return affected(res)
+}
+
+// GetNotificationPreferences returns whether userID is notified, for every type of notification.
+func (db *appdbimpl) GetNotificationPreferences(userID string) (map[string]bool, error) {
+	preferences := make(map[string]bool, len(notificationTypes))
+	for _, kind := range notificationTypes {
+		preferences[kind] = true
+	}
+	err := db.scanRows(`SELECT type, enabled FROM notification_preferences WHERE user_id = ?`, []interface{}{userID},
+		func(rows *sql.Rows) error {
+			var kind string
+			var enabled bool
+			if err := rows.Scan(&kind, &enabled); err != nil {
+				return err
+			}
+			preferences[kind] = enabled
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notification preferences: %w", err)
+	}
+	return preferences, nil
+}
+
+// SetNotificationPreferences turns on or off the types of notifications in preferences for userID. The other types
+// are left as they are.
+func (db *appdbimpl) SetNotificationPreferences(userID string, preferences map[string]bool) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for kind, enabled := range preferences {
+		_, err = tx.Exec(`INSERT INTO notification_preferences (user_id, type, enabled) VALUES (?, ?, ?)
+            ON CONFLICT (user_id, type) DO UPDATE SET enabled = excluded.enabled`, userID, kind, enabled)
+		if err != nil {
+			return fmt.Errorf("failed to set notification preference: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
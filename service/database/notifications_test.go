@@ -0,0 +1,81 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+func TestNotifications(t *testing.T) {
+	db := newTestDB(t)
+	ids := addUsers(t, db, "alice", "bob", "carol", "dave")
+	photo := Photo{ID: "photo", UserID: ids["alice"], Timestamp: time.Now(), Visibility: VisibilityPublic}
+	if err := db.AddPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	defer func() { globaltime.FixedTime = time.Time{} }()
+	like := func(name string, minutes int) {
+		t.Helper()
+		globaltime.FixedTime = start.Add(time.Duration(minutes) * time.Minute)
+		if _, err := db.LikePhoto(ids[name], "photo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifications := func(wantUnread int) []Notification {
+		t.Helper()
+		notifications, unread, err := db.GetNotifications(ids["alice"], Page{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unread != wantUnread {
+			t.Errorf("%d unread notifications, want %d", unread, wantUnread)
+		}
+		return notifications
+	}
+
+	// The likes of an unread notification are merged into it, most recent actor first
+	like("bob", 1)
+	like("carol", 2)
+	list := notifications(1)
+	if len(list) != 1 || list[0].Type != NotifyLike || list[0].ActorCount != 2 || len(list[0].Actors) != 2 ||
+		list[0].Actors[0].UserID != ids["carol"] || list[0].Actors[1].UserID != ids["bob"] {
+		t.Fatalf("notifications %+v, want a like of carol and bob", list)
+	}
+	merged := list[0].ID
+
+	// Once it is read, the next like starts a new notification
+	if err := db.MarkNotificationRead(ids["alice"], merged); err != nil {
+		t.Fatal(err)
+	}
+	like("dave", 3)
+	list = notifications(1)
+	if len(list) != 2 || list[0].ID == merged || list[0].ActorCount != 1 || list[1].ID != merged || !list[1].Read {
+		t.Fatalf("notifications %+v, want a new like of dave before the one read", list)
+	}
+
+	// Events of the types turned off are dropped
+	if err := db.SetNotificationPreferences(ids["alice"], map[string]bool{NotifyComment: false}); err != nil {
+		t.Fatal(err)
+	}
+	comment := Comment{ID: "comment", UserID: ids["bob"], PhotoID: "photo", Content: "nice", Timestamp: time.Now()}
+	if err := db.AddComment(comment); err != nil {
+		t.Fatal(err)
+	}
+	if list = notifications(1); len(list) != 2 {
+		t.Errorf("notifications %+v, want the comment left out", list)
+	}
+
+	// Bans hide the actors banned, and the notifications left without actors
+	if _, err := db.BanUser(Actor{UserID: ids["alice"]}, ids["dave"]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BanUser(Actor{UserID: ids["carol"]}, ids["alice"]); err != nil {
+		t.Fatal(err)
+	}
+	list = notifications(0)
+	if len(list) != 1 || list[0].ID != merged || list[0].ActorCount != 1 || list[0].Actors[0].UserID != ids["bob"] {
+		t.Errorf("notifications %+v, want only the like of bob", list)
+	}
+}
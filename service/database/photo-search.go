@@ -0,0 +1,210 @@
+package database
+
+// Photo search. Captions and comments are indexed by two FTS5 tables, photo_captions_fts and comment_contents_fts,
+// which read their text from new_photos and comments (external content tables) and are kept up to date by triggers.
+// The index rows have the rowid of the rows they index, which SQLite may renumber on VACUUM: run
+// `INSERT INTO photo_captions_fts (photo_captions_fts) VALUES ('rebuild')`, and the same for comments, after it.
+//
+// FTS5 is part of SQLite only when the server is built with the sqlite_fts5 tag. Without it, the triggers are dropped,
+// so that photos and comments can still be written, and SearchPhotos returns ErrSearchUnavailable. The index is
+// rebuilt the next time the server starts with FTS5.
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Marks wrapped around the matching words by snippet(): control characters, which do not appear in written text, so
+// that they are told apart from the text when the snippet is escaped (see highlight).
+const (
+	snippetOpen  = "\x02"
+	snippetClose = "\x03"
+)
+
+// snippetTokens is how many words are kept around the match in snippets
+const snippetTokens = 12
+
+// textSearchIndexes are the FTS5 tables indexing photos and comments, with the triggers keeping each of them in sync
+// with its content table
+var textSearchIndexes = []struct {
+	name, content, column string
+}{
+	{"photo_captions_fts", "new_photos", "caption"},
+	{"comment_contents_fts", "comments", "content"},
+}
+
+// createPhotoSearchIndex creates the full-text indexes used by SearchPhotos, and reports whether SQLite supports them.
+func createPhotoSearchIndex(db *sql.DB) (bool, error) {
+	var available bool
+	err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&available)
+	if err != nil {
+		return false, err
+	}
+
+	for _, index := range textSearchIndexes {
+		triggers := map[string]string{
+			index.content + "_fts_insert": `AFTER INSERT ON ` + index.content + ` BEGIN
+            INSERT INTO ` + index.name + ` (rowid, ` + index.column + `) VALUES (NEW.rowid, NEW.` + index.column + `);
+        END`,
+			index.content + "_fts_delete": `AFTER DELETE ON ` + index.content + ` BEGIN
+            INSERT INTO ` + index.name + ` (` + index.name + `, rowid, ` + index.column + `)
+                VALUES ('delete', OLD.rowid, OLD.` + index.column + `);
+        END`,
+			index.content + "_fts_update": `AFTER UPDATE OF ` + index.column + ` ON ` + index.content + ` BEGIN
+            INSERT INTO ` + index.name + ` (` + index.name + `, rowid, ` + index.column + `)
+                VALUES ('delete', OLD.rowid, OLD.` + index.column + `);
+            INSERT INTO ` + index.name + ` (rowid, ` + index.column + `) VALUES (NEW.rowid, NEW.` + index.column + `);
+        END`,
+		}
+
+		if !available {
+			for name := range triggers {
+				if _, err = db.Exec(`DROP TRIGGER IF EXISTS ` + name); err != nil {
+					return false, err
+				}
+			}
+			continue
+		}
+
+		_, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS ` + index.name + ` USING fts5 (
+            ` + index.column + `, content='` + index.content + `', tokenize='unicode61 remove_diacritics 2'
+        );`)
+		if err != nil {
+			return false, err
+		}
+
+		// Rows written while the triggers were missing are not indexed: the index is built again from scratch
+		var synced bool
+		err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'trigger' AND name = ?)`,
+			index.content+"_fts_insert").Scan(&synced)
+		if err != nil {
+			return false, err
+		}
+		for name, body := range triggers {
+			if _, err = db.Exec(`CREATE TRIGGER IF NOT EXISTS ` + name + ` ` + body); err != nil {
+				return false, err
+			}
+		}
+		if !synced {
+			_, err = db.Exec(`INSERT INTO ` + index.name + ` (` + index.name + `) VALUES ('rebuild')`)
+			if err != nil {
+				return false, fmt.Errorf("failed to index %s: %w", index.content, err)
+			}
+		}
+	}
+	return available, nil
+}
+
+// SearchPhotos returns the photos whose caption, or one of whose comments, matches query, best match first. Words of
+// the query must all appear, in any order; words between double quotes must appear in that order, and words ending
+// with * match any word they are a prefix of. Only the photos viewerID can see are returned (see photoVisibleSQL),
+// and neither photos of the users it banned nor comments of users banned in either direction or muted by it are
+// matched.
+func (db *appdbimpl) SearchPhotos(viewerID string, query string, page Page) ([]PhotoMatch, error) {
+	if !db.photoSearch {
+		return nil, ErrSearchUnavailable
+	}
+	matches := []PhotoMatch{}
+	match := ftsQuery(query)
+	if match == "" {
+		return matches, nil
+	}
+
+	err := db.scanRows(`
+    WITH hits AS (
+        SELECT rowid AS photo_row, '`+MatchCaption+`' AS matched_in, '' AS comment_id,
+               snippet(photo_captions_fts, 0, @open, @close, '…', @tokens) AS snippet,
+               bm25(photo_captions_fts) AS rank
+        FROM photo_captions_fts
+        WHERE photo_captions_fts MATCH @query
+        UNION ALL
+        SELECT p.rowid, '`+MatchComment+`', c.comment_id,
+               snippet(comment_contents_fts, 0, @open, @close, '…', @tokens),
+               bm25(comment_contents_fts)
+        FROM comment_contents_fts
+        JOIN comments c ON c.rowid = comment_contents_fts.rowid
+        JOIN new_photos p ON p.photo_id = c.photo_id
+        JOIN users u ON u.user_id = c.user_id
+        WHERE comment_contents_fts MATCH @query AND c.hidden_at IS NULL AND `+userListedSQL+`
+            AND `+commentNotMutedSQL+`
+    ), best AS (
+        SELECT *, ROW_NUMBER() OVER (PARTITION BY photo_row ORDER BY rank, matched_in) AS n FROM hits
+    )
+    SELECT p.photo_id, p.user_id, u.username, p.timestamp, p.caption, b.matched_in, b.comment_id, b.snippet
+    FROM best b
+    JOIN new_photos p ON p.rowid = b.photo_row
+    JOIN users u ON u.user_id = p.user_id
+    WHERE b.n = 1 AND `+photoVisibleSQL+`
+        AND NOT EXISTS (SELECT 1 FROM new_bans sb WHERE sb.banned_by = @viewer AND sb.banned_user = p.user_id)
+    ORDER BY b.rank, p.timestamp DESC
+    LIMIT @limit OFFSET @offset`, []interface{}{
+		sql.Named("query", match), sql.Named("viewer", viewerID),
+		sql.Named("open", snippetOpen), sql.Named("close", snippetClose), sql.Named("tokens", snippetTokens),
+		sql.Named("limit", page.Limit), sql.Named("offset", page.Offset),
+	}, func(rows *sql.Rows) error {
+		var m PhotoMatch
+		if err := rows.Scan(&m.PhotoID, &m.UserID, &m.Username, &m.Timestamp, &m.Caption, &m.MatchedIn, &m.CommentID,
+			&m.Snippet); err != nil {
+			return err
+		}
+		m.Snippet = highlight(m.Snippet)
+		matches = append(matches, m)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search photos: %w", err)
+	}
+	return matches, nil
+}
+
+// ftsQuery translates a search query into an FTS5 query: phrases between double quotes and single words, each one
+// optionally followed by * to match it as a prefix. Every term is quoted, so that users cannot write FTS5 operators
+// or column filters, and terms without letters or digits are left out. An empty string is returned if no term is
+// left.
+func ftsQuery(query string) string {
+	var terms []string
+	rest := query
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" {
+			break
+		}
+
+		var term string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				term, rest = rest[1:], ""
+			} else {
+				term, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(rest, func(r rune) bool { return unicode.IsSpace(r) || r == '"' })
+			if end < 0 {
+				end = len(rest)
+			}
+			term, rest = rest[:end], rest[end:]
+		}
+		prefix := strings.HasSuffix(term, "*") || strings.HasPrefix(rest, "*")
+		term = strings.TrimRight(term, "*")
+		rest = strings.TrimLeft(rest, "*")
+
+		if strings.IndexFunc(term, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+			continue
+		}
+		term = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+// highlight escapes a snippet for HTML, and turns the marks around the matching words into <mark> elements.
+func highlight(snippet string) string {
+	return strings.NewReplacer(snippetOpen, "<mark>", snippetClose, "</mark>").Replace(html.EscapeString(snippet))
+}
@@ -0,0 +1,94 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSearchPhotos(t *testing.T) {
+	db := newTestDB(t)
+	if !db.photoSearch {
+		t.Fatal("the search index was not created")
+	}
+	ids := addUsers(t, db, "alice", "bob", "carol", "dave")
+	now := time.Now()
+	photos := []struct {
+		id, owner, caption string
+	}{
+		{"morning", "alice", "Morning espresso at the café"},
+		{"sunset", "alice", "Sunset over the bay"},
+		{"hidden", "alice", "Espresso nobody sees"},
+		{"banned", "dave", "Espresso of someone who banned carol"},
+	}
+	for i, p := range photos {
+		photo := Photo{ID: p.id, UserID: ids[p.owner], Timestamp: now.Add(time.Duration(i) * time.Minute),
+			Visibility: VisibilityPublic, Caption: p.caption}
+		if err := db.AddPhoto(photo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comment := Comment{ID: "comment", UserID: ids["bob"], PhotoID: "sunset", Content: "Delicious croissants & coffee",
+		Timestamp: now}
+	if err := db.AddComment(comment); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.c.Exec(`UPDATE new_photos SET hidden_at = ? WHERE photo_id = 'hidden'`, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BanUser(Actor{UserID: ids["dave"]}, ids["carol"]); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(query string) []PhotoMatch {
+		t.Helper()
+		matches, err := db.SearchPhotos(ids["carol"], query, Page{Limit: 10})
+		if err != nil {
+			t.Fatalf("search of %q: %v", query, err)
+		}
+		return matches
+	}
+	tests := []struct {
+		query     string
+		photoID   string // The only photo found, or "" for none
+		matchedIn string
+	}{
+		{"morning", "morning", MatchCaption},
+		{"cafe", "morning", MatchCaption}, // Diacritics are ignored
+		{"croissants", "sunset", MatchComment},
+		{"espress*", "morning", MatchCaption},
+		{`"morning espresso"`, "morning", MatchCaption},
+		{`"espresso morning"`, "", ""},
+		{"espresso sunset", "", ""}, // All the words must match
+		{"nobody", "", ""},          // Hidden by the moderators
+		{"someone", "", ""},         // Its owner banned the viewer
+		{`NEAR(morning espresso)`, "", ""},
+		{`caption:morning`, "", ""},
+		{`"a`, "", ""},
+		{`*`, "", ""},
+	}
+	for _, tt := range tests {
+		matches := search(tt.query)
+		if tt.photoID == "" {
+			if len(matches) != 0 {
+				t.Errorf("search of %q found %v, want nothing", tt.query, matches)
+			}
+			continue
+		}
+		if len(matches) != 1 || matches[0].PhotoID != tt.photoID || matches[0].MatchedIn != tt.matchedIn {
+			t.Errorf("search of %q found %v, want %s in its %s", tt.query, matches, tt.photoID, tt.matchedIn)
+		}
+	}
+
+	if matches := search("croissants"); len(matches) == 1 &&
+		(matches[0].CommentID != "comment" || matches[0].Snippet != "Delicious <mark>croissants</mark> &amp; coffee") {
+		t.Errorf("comment match %s with snippet %q", matches[0].CommentID, matches[0].Snippet)
+	}
+
+	// The photo of dave is found by the users dave did not ban
+	if matches, err := db.SearchPhotos(ids["bob"], "someone", Page{Limit: 10}); err != nil || len(matches) != 1 {
+		t.Errorf("search of bob found %v (%v), want the photo of dave", matches, err)
+	}
+}
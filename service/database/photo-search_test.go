@@ -0,0 +1,36 @@
+package database
+
+import "testing"
+
+func TestFTSQuery(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{`morning espresso`, `"morning" "espresso"`},
+		{`"morning espresso" cafe`, `"morning espresso" "cafe"`},
+		{`espress* caf *`, `"espress"* "caf"`},
+		{`"morning espresso"*`, `"morning espresso"*`},
+		{`espress *`, `"espress"`},
+
+		// Unbalanced quotes end the phrase at the end of the query
+		{`"a`, `"a"`},
+		{`say "hi there`, `"say" "hi there"`},
+		{`a"b`, `"a" "b"`},
+
+		// Terms without letters or digits are left out
+		{`*`, ``},
+		{`"" * - ...`, ``},
+		{``, ``},
+
+		// Operators and column filters are searched as words
+		{`NEAR(x)`, `"NEAR(x)"`},
+		{`col:x`, `"col:x"`},
+		{`a OR b NOT c`, `"a" "OR" "b" "NOT" "c"`},
+		{`^start`, `"^start"`},
+	}
+	for _, tt := range tests {
+		if got := ftsQuery(tt.query); got != tt.want {
+			t.Errorf("ftsQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
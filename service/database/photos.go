@@ -1,28 +1,43 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 )
 
-// AddPhoto stores metadata about a photo in the database.
+// AddPhoto stores metadata about a photo in the database, with the hashtags of its caption, and notifies the users
+// mentioned in the caption who can see it.
 func (db *appdbimpl) AddPhoto(photo Photo) error {
-	stmt, err := db.c.Prepare("INSERT INTO new_photos (photo_id, user_id, image_data, timestamp) VALUES (?, ?, ?, ?)")
+	tx, err := db.c.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to prepare the photo insert statement: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer stmt.Close()
+	defer func() { _ = tx.Rollback() }()
 
-	_, err = stmt.Exec(photo.ID, photo.UserID, photo.ImageData, photo.Timestamp)
+	_, err = tx.Exec("INSERT INTO new_photos (photo_id, user_id, image_data, timestamp, visibility, caption) VALUES (?, ?, ?, ?, ?, ?)",
+		photo.ID, photo.UserID, photo.ImageData, photo.Timestamp, photo.Visibility, photo.Caption)
 	if err != nil {
 		return fmt.Errorf("failed to execute the photo insert statement: %w", err)
 	}
-
+	if err = tagPhoto(tx, photo.ID, photo.Caption, photo.Timestamp); err != nil {
+		return err
+	}
+	mention := event{actorID: photo.UserID, kind: NotifyMention, photoID: photo.ID, at: photo.Timestamp}
+	if err = notifyMentions(tx, photo.Caption, mention); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
 	return nil
 }
 
-// function to get all photos
-func (db *appdbimpl) GetPhotos() ([]Photo, error) {
-	rows, err := db.c.Query("SELECT * FROM new_photos")
+// GetPhotos returns all the photos that viewerID can see (see photoVisibleSQL).
+func (db *appdbimpl) GetPhotos(viewerID string) ([]Photo, error) {
+	rows, err := db.c.Query(`SELECT p.photo_id, p.user_id, p.image_data, p.timestamp, p.visibility, p.caption FROM new_photos p
+        WHERE `+photoVisibleSQL, sql.Named("viewer", viewerID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to query photos: %w", err)
 	}
@@ -31,7 +46,7 @@ func (db *appdbimpl) GetPhotos() ([]Photo, error) {
 	var photos []Photo
 	for rows.Next() {
 		var photo Photo
-		err = rows.Scan(&photo.ID, &photo.UserID, &photo.ImageData, &photo.Timestamp)
+		err = rows.Scan(&photo.ID, &photo.UserID, &photo.ImageData, &photo.Timestamp, &photo.Visibility, &photo.Caption)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan photo: %w", err)
 		}
@@ -41,46 +56,108 @@ func (db *appdbimpl) GetPhotos() ([]Photo, error) {
 	return photos, nil
 }
 
-func (db *appdbimpl) DeletePhoto(photoID string) error {
+// DeletePhoto removes a photo of the actor, with its comments and likes. ErrPhotoNotFound is returned if there is no
+// such photo, and ErrNotOwner if it belongs to another user.
+func (db *appdbimpl) DeletePhoto(actor Actor, photoID string) error {
 	tx, err := db.c.Begin()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	// Delete comments
-	_, err = tx.Exec("DELETE FROM comments WHERE photo_id = ?", photoID)
+	photo, err := deletePhoto(tx, photoID)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-
-	// Delete likes
-	_, err = tx.Exec("DELETE FROM likes WHERE photo_id = ?", photoID)
-	if err != nil {
-		tx.Rollback()
+	if photo.UserID != actor.UserID {
+		return ErrNotOwner
+	}
+	if err = recordAudit(tx, actor, "photo.delete", "photo", photoID, "", photo, nil); err != nil {
 		return err
 	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// deletedPhoto is the state of a deleted photo recorded in the audit log: the image itself is not kept.
+type deletedPhoto struct {
+	PhotoID   string    `json:"photoId"`
+	UserID    string    `json:"userId"`
+	Timestamp time.Time `json:"timestamp"`
+	Likes     int       `json:"likes"`
+	Comments  int       `json:"comments"`
+}
 
-	// Delete the photo
-	_, err = tx.Exec("DELETE FROM new_photos WHERE photo_id = ?", photoID)
+// deletePhoto removes a photo with its comments and likes, and returns what was deleted. ErrPhotoNotFound is returned
+// if there is no such photo.
+func deletePhoto(tx *sql.Tx, photoID string) (*deletedPhoto, error) {
+	photo := deletedPhoto{PhotoID: photoID}
+	err := tx.QueryRow("DELETE FROM new_photos WHERE photo_id = ? RETURNING user_id, timestamp",
+		photoID).Scan(&photo.UserID, &photo.Timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPhotoNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to delete photo: %w", err)
+	}
+	if _, err = tx.Exec("DELETE FROM photo_tags WHERE photo_id = ?", photoID); err != nil {
+		return nil, fmt.Errorf("failed to delete tags: %w", err)
+	}
+	res, err := tx.Exec("DELETE FROM comments WHERE photo_id = ?", photoID)
 	if err != nil {
-		tx.Rollback()
-		return err
+		return nil, fmt.Errorf("failed to delete comments: %w", err)
 	}
+	if photo.Comments, err = affected(res); err != nil {
+		return nil, err
+	}
+	res, err = tx.Exec("DELETE FROM likes WHERE photo_id = ?", photoID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete likes: %w", err)
+	}
+	if photo.Likes, err = affected(res); err != nil {
+		return nil, err
+	}
+	return &photo, nil
+}
 
-	return tx.Commit()
+// SetPhotoVisibility changes the visibility level of a photo of userID. ErrPhotoNotFound is returned if there is no
+// such photo, and ErrNotOwner if it belongs to another user.
+func (db *appdbimpl) SetPhotoVisibility(userID string, photoID string, visibility string) error {
+	var owner string
+	err := db.c.QueryRow(`SELECT user_id FROM new_photos WHERE photo_id = ?`, photoID).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrPhotoNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to get photo: %w", err)
+	}
+	if owner != userID {
+		return ErrNotOwner
+	}
+	_, err = db.c.Exec(`UPDATE new_photos SET visibility = ? WHERE photo_id = ?`, visibility, photoID)
+	if err != nil {
+		return fmt.Errorf("failed to set photo visibility: %w", err)
+	}
+	return nil
 }
 
+// GetMyStream returns the IDs of the photos of the users followed by userID, and of the photos with the tags it
+// follows, that it can see, most recent first. The photos of the users whose posts it muted, and of the users it
+// banned, are left out.
 func (db *appdbimpl) GetMyStream(userID string) ([]string, error) {
 	var photoIds []string
 	query := `
     SELECT p.photo_id
     FROM new_photos p
-    JOIN followers f ON p.user_id = f.user_id
-    LEFT JOIN new_bans b ON p.user_id = b.banned_by AND b.banned_user = ?
-    WHERE f.follower_id = ? AND b.ban_id IS NULL
-    `
-	rows, err := db.c.Query(query, userID, userID)
+    WHERE (p.user_id IN (SELECT f.user_id FROM followers f WHERE f.follower_id = @viewer)
+        OR p.photo_id IN (
+            SELECT t.photo_id FROM tag_follows tf JOIN photo_tags t ON t.tag = tf.tag WHERE tf.user_id = @viewer
+        ))
+        AND p.user_id <> @viewer
+        AND p.user_id NOT IN (SELECT b.banned_user FROM new_bans b WHERE b.banned_by = @viewer)
+        AND ` + photoVisibleSQL + ` AND ` + postsNotMutedSQL + `
+    ORDER BY p.timestamp DESC`
+	rows, err := db.c.Query(query, sql.Named("viewer", userID))
 	if err != nil {
 		return nil, err
 	}
@@ -96,31 +173,36 @@ func (db *appdbimpl) GetMyStream(userID string) ([]string, error) {
 	return photoIds, nil
 }
 
-func (db *appdbimpl) GetPhoto(photoId string) (*PhotoDetail, error) {
+// GetPhoto returns a photo with its likes count and comments, except for the comments of the users muted by viewerID.
+// ErrPhotoNotFound is returned if there is no such photo, or if viewerID cannot see it (see photoVisibleSQL).
+func (db *appdbimpl) GetPhoto(photoId string, viewerID string) (*PhotoDetail, error) {
 	var photo PhotoDetail
 
 	// First, fetch the basic photo details and count of likes
 	err := db.c.QueryRow(`
-    SELECT p.photo_id, p.user_id, u.username, p.image_data, p.timestamp,
-           (SELECT COUNT(*) FROM likes WHERE photo_id = p.photo_id) AS likes_count
+    SELECT p.photo_id, p.user_id, u.username, p.image_data, p.timestamp, p.visibility, p.caption,
+           (SELECT COUNT(*) FROM likes WHERE photo_id = p.photo_id
+                AND user_id NOT IN (`+deletedUsersSQL+`)) AS likes_count
     FROM new_photos p
     JOIN users u ON p.user_id = u.user_id
-    WHERE p.photo_id = ?`, photoId).Scan(
-		&photo.PhotoID, &photo.UserID, &photo.Username, &photo.ImageData, &photo.Timestamp, &photo.LikesCount,
+    WHERE p.photo_id = @photo AND `+photoVisibleSQL, sql.Named("photo", photoId), sql.Named("viewer", viewerID)).Scan(
+		&photo.PhotoID, &photo.UserID, &photo.Username, &photo.ImageData, &photo.Timestamp, &photo.Visibility, &photo.Caption, &photo.LikesCount,
 	)
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPhotoNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
 	// Query for comments related to the photo
 	commentsQuery := `
-    SELECT c.comment_id, c.user_id, u.username, c.content, c.timestamp
+    SELECT c.comment_id, c.user_id, u.username, c.content, c.timestamp, COALESCE(c.reply_to, '')
     FROM comments c
     JOIN users u ON u.user_id = c.user_id
-    WHERE c.photo_id = ?
+    WHERE c.photo_id = @photo AND c.hidden_at IS NULL AND u.deleted_at IS NULL AND ` + commentNotMutedSQL + `
     ORDER BY c.timestamp DESC
     `
-	rows, err := db.c.Query(commentsQuery, photoId)
+	rows, err := db.c.Query(commentsQuery, sql.Named("photo", photoId), sql.Named("viewer", viewerID))
 	if err != nil {
 		return nil, err
 	}
@@ -131,7 +213,7 @@ func (db *appdbimpl) GetPhoto(photoId string) (*PhotoDetail, error) {
 	// Iterate over the results and populate the comments slice
 	for rows.Next() {
 		var comment Comment
-		if err := rows.Scan(&comment.ID, &comment.UserID, &comment.PhotoID, &comment.Content, &comment.Timestamp); err != nil {
+		if err := rows.Scan(&comment.ID, &comment.UserID, &comment.PhotoID, &comment.Content, &comment.Timestamp, &comment.ReplyTo); err != nil {
 			return nil, err
 		}
 		photo.Comments = append(photo.Comments, comment)
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// GetProfile returns the profile of userID as seen by viewerID. The viewer can be empty for anonymous requests, in
+// which case all relationship flags are false. Counts are computed in the same query; the lists behind them
+// (followers, photos, ...) are loaded on demand, one page at a time, by their own methods. Deleted accounts have no
+// profile: ErrUserNotFound is returned.
+func (db *appdbimpl) GetProfile(userID string, viewerID string) (*Profile, error) {
+	var p Profile
+	err := db.c.QueryRow(`
+    SELECT u.user_id, u.username, u.display_name, u.bio, u.website,
+           EXISTS(SELECT 1 FROM avatars a WHERE a.user_id = u.user_id),
+           (SELECT COUNT(*) FROM followers WHERE user_id = u.user_id AND follower_id NOT IN (`+deletedUsersSQL+`)),
+           (SELECT COUNT(*) FROM followers WHERE follower_id = u.user_id AND user_id NOT IN (`+deletedUsersSQL+`)),
+           (SELECT COUNT(*) FROM new_photos p WHERE p.user_id = u.user_id AND `+photoVisibleSQL+`),
+           EXISTS(SELECT 1 FROM followers WHERE user_id = @viewer AND follower_id = u.user_id),
+           EXISTS(SELECT 1 FROM followers WHERE user_id = u.user_id AND follower_id = @viewer),
+           EXISTS(SELECT 1 FROM new_bans WHERE banned_by = @viewer AND banned_user = u.user_id),
+           u.private,
+           EXISTS(SELECT 1 FROM follow_requests WHERE user_id = u.user_id AND requester_id = @viewer)
+    FROM users u
+    WHERE u.user_id = @user AND u.deleted_at IS NULL`, sql.Named("user", userID), sql.Named("viewer", viewerID)).Scan(
+		&p.ID, &p.Username, &p.DisplayName, &p.Bio, &p.Website, &p.HasAvatar,
+		&p.FollowersCount, &p.FollowingCount, &p.PhotosCount,
+		&p.FollowsYou, &p.YouFollow, &p.YouBanned, &p.Private, &p.YouRequested,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load profile: %w", err)
+	}
+	return &p, nil
+}
+
+// UpdateProfile changes the profile fields set in update. Values are stored as they are: validation is up to the
+// caller. When the account goes public, its pending follow requests are approved.
+func (db *appdbimpl) UpdateProfile(userID string, update ProfileUpdate) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var private sql.NullBool
+	if update.Private != nil {
+		private = sql.NullBool{Bool: *update.Private, Valid: true}
+	}
+	res, err := tx.Exec(`UPDATE users SET
+        display_name = COALESCE(@display_name, display_name),
+        bio = COALESCE(@bio, bio),
+        website = COALESCE(@website, website),
+        email = COALESCE(@email, email),
+        private = COALESCE(@private, private)
+    WHERE user_id = @user`,
+		sql.Named("display_name", nullString(update.DisplayName)),
+		sql.Named("bio", nullString(update.Bio)),
+		sql.Named("website", nullString(update.Website)),
+		sql.Named("email", nullString(update.Email)),
+		sql.Named("private", private),
+		sql.Named("user", userID))
+	if err != nil {
+		return fmt.Errorf("failed to update profile: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserNotFound
+	}
+	if update.Private != nil && !*update.Private {
+		if err = approveFollowRequests(tx, userID); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// GetUserPhotoIDs returns the IDs of the photos uploaded by userID that viewerID can see, newest first.
+func (db *appdbimpl) GetUserPhotoIDs(userID string, viewerID string, page Page) ([]string, error) {
+	if err := db.checkUserExists(userID); err != nil {
+		return nil, err
+	}
+
+	photoIDs, err := db.queryIDs(`
+    SELECT p.photo_id
+    FROM new_photos p
+    WHERE p.user_id = @user AND `+photoVisibleSQL+`
+    ORDER BY p.timestamp DESC, p.photo_id
+    LIMIT @limit OFFSET @offset`,
+		sql.Named("user", userID), sql.Named("viewer", viewerID),
+		sql.Named("limit", page.Limit), sql.Named("offset", page.Offset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query photos: %w", err)
+	}
+	return photoIDs, nil
+}
+
+// SetAvatar stores the avatar image of a user, replacing the previous one.
+func (db *appdbimpl) SetAvatar(userID string, imageData []byte) error {
+	_, err := db.c.Exec(`INSERT INTO avatars (user_id, image_data, timestamp) VALUES (?, ?, ?)
+        ON CONFLICT (user_id) DO UPDATE SET image_data = excluded.image_data, timestamp = excluded.timestamp`,
+		userID, imageData, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store avatar: %w", err)
+	}
+	return nil
+}
+
+// DeleteAvatar removes the avatar image of a user. Removing a missing avatar is not an error.
+func (db *appdbimpl) DeleteAvatar(userID string) error {
+	_, err := db.c.Exec("DELETE FROM avatars WHERE user_id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete avatar: %w", err)
+	}
+	return nil
+}
+
+// GetAvatar returns the avatar image of a user, or ErrAvatarNotFound if the user has none.
+func (db *appdbimpl) GetAvatar(userID string) ([]byte, error) {
+	var imageData []byte
+	err := db.c.QueryRow("SELECT image_data FROM avatars WHERE user_id = ?", userID).Scan(&imageData)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAvatarNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load avatar: %w", err)
+	}
+	return imageData, nil
+}
+
+// queryIDs runs a query selecting a single text column, and returns its values.
+func (db *appdbimpl) queryIDs(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// nullString maps a nil string pointer to SQL NULL.
+func nullString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	// benchUsers and benchFollowsPerUser make the follow graph of the profile benchmarks: 100k follows
+	benchUsers          = 10000
+	benchFollowsPerUser = 10
+	// benchPhotos is how many photos the profile of the benchmarks has
+	benchPhotos = 1000
+)
+
+// seedProfiles fills db with benchUsers users, each one following benchFollowsPerUser others: everybody follows the
+// first user, whose profile is loaded by the benchmarks, and who posted benchPhotos photos. It returns the IDs of the
+// first user and of a viewer following it.
+func seedProfiles(b *testing.B, db *appdbimpl) (string, string) {
+	b.Helper()
+	id := func(i int) string { return fmt.Sprintf("user%06d", i) }
+	seed(b, db, `INSERT INTO users (user_id, username, username_key) VALUES (?, ?, ?)`, benchUsers,
+		func(i int) []interface{} { return []interface{}{id(i), id(i), id(i)} })
+	seed(b, db, `INSERT INTO followers (user_id, follower_id) VALUES (?, ?)`, benchUsers*benchFollowsPerUser,
+		func(i int) []interface{} {
+			follower, k := i/benchFollowsPerUser, i%benchFollowsPerUser
+			followed := 0
+			if k > 0 || follower == 0 {
+				followed = 1 + (follower+k)%(benchUsers-1)
+			}
+			return []interface{}{id(followed), id(follower)}
+		})
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	seed(b, db, `INSERT INTO new_photos (photo_id, user_id, image_data, timestamp, visibility) VALUES (?, ?, ?, ?, ?)`,
+		benchPhotos, func(i int) []interface{} {
+			return []interface{}{fmt.Sprintf("photo%05d", i), id(0), []byte{}, start.Add(time.Duration(i) * time.Minute),
+				VisibilityPublic}
+		})
+	return id(0), id(1)
+}
+
+func BenchmarkGetProfile(b *testing.B) {
+	db := newTestDB(b)
+	userID, viewerID := seedProfiles(b, db)
+	p, err := db.GetProfile(userID, viewerID)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if p.FollowersCount != benchUsers-1 || p.PhotosCount != benchPhotos || !p.YouFollow {
+		b.Fatalf("unexpected profile %+v", p)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.GetProfile(userID, viewerID); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetUserPhotoIDs(b *testing.B) {
+	db := newTestDB(b)
+	userID, viewerID := seedProfiles(b, db)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ids, err := db.GetUserPhotoIDs(userID, viewerID, Page{Limit: 20, Offset: 100})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(ids) != 20 {
+			b.Fatalf("%d photos, want 20", len(ids))
+		}
+	}
+}
+
+func BenchmarkGetFollowers(b *testing.B) {
+	db := newTestDB(b)
+	userID, viewerID := seedProfiles(b, db)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		users, err := db.GetFollowers(userID, viewerID, Page{Limit: 20, Offset: 100})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(users) != 20 {
+			b.Fatalf("%d followers, want 20", len(users))
+		}
+	}
+}
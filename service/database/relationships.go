@@ -0,0 +1,96 @@
+package database
+
+// Lists of users related to a user: its followers, the users it follows, and the mutuals (its followers followed by
+// the requesting user). Every list is seen from the point of view of the requesting user: the lists of private
+// accounts are seen only by their followers (see accountOpenSQL), and users banned in either direction are left out.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// userSummarySQL selects the columns of a UserSummary for the users aliased as `u`, as seen by the user bound as the
+// named parameter `viewer`.
+const userSummarySQL = `u.user_id, u.username,
+           EXISTS(SELECT 1 FROM followers yf WHERE yf.user_id = u.user_id AND yf.follower_id = @viewer),
+           EXISTS(SELECT 1 FROM followers fy WHERE fy.user_id = @viewer AND fy.follower_id = u.user_id)`
+
+// userListedSQL is the predicate deciding whether the users aliased as `u` appear in the lists seen by the user bound
+// as `viewer`: deleted accounts and users banned in either direction do not.
+const userListedSQL = `u.deleted_at IS NULL AND NOT EXISTS (
+        SELECT 1 FROM new_bans lb
+        WHERE (lb.banned_by = u.user_id AND lb.banned_user = @viewer)
+           OR (lb.banned_by = @viewer AND lb.banned_user = u.user_id)
+    )`
+
+// GetFollowers returns the followers of userID, most recent first, as seen by viewerID.
+func (db *appdbimpl) GetFollowers(userID string, viewerID string, page Page) ([]UserSummary, error) {
+	return db.getRelatedUsers(userID, viewerID, page, `
+    SELECT `+userSummarySQL+`
+    FROM followers f JOIN users u ON u.user_id = f.follower_id
+    WHERE f.user_id = @user AND `+userListedSQL+`
+    ORDER BY f.rowid DESC
+    LIMIT @limit OFFSET @offset`)
+}
+
+// GetFollowing returns the users followed by userID, most recently followed first, as seen by viewerID.
+func (db *appdbimpl) GetFollowing(userID string, viewerID string, page Page) ([]UserSummary, error) {
+	return db.getRelatedUsers(userID, viewerID, page, `
+    SELECT `+userSummarySQL+`
+    FROM followers f JOIN users u ON u.user_id = f.user_id
+    WHERE f.follower_id = @user AND `+userListedSQL+`
+    ORDER BY f.rowid DESC
+    LIMIT @limit OFFSET @offset`)
+}
+
+// GetMutuals returns the followers of userID that viewerID follows ("followed by people you follow"), in alphabetical
+// order.
+func (db *appdbimpl) GetMutuals(userID string, viewerID string, page Page) ([]UserSummary, error) {
+	return db.getRelatedUsers(userID, viewerID, page, `
+    SELECT `+userSummarySQL+`
+    FROM followers f
+    JOIN followers vf ON vf.user_id = f.follower_id AND vf.follower_id = @viewer
+    JOIN users u ON u.user_id = f.follower_id
+    WHERE f.user_id = @user AND `+userListedSQL+`
+    ORDER BY u.username_key
+    LIMIT @limit OFFSET @offset`)
+}
+
+// getRelatedUsers checks that viewerID can see the lists of userID, and runs the query of one of them. The query binds
+// the named parameters `user`, `viewer`, `limit` and `offset`. ErrUserNotFound is returned if there is no such user, or
+// if it banned viewerID; ErrPrivateAccount if its account is private and viewerID does not follow it.
+func (db *appdbimpl) getRelatedUsers(userID string, viewerID string, page Page, query string) ([]UserSummary, error) {
+	var banned bool
+	err := db.c.QueryRow(`SELECT EXISTS(SELECT 1 FROM new_bans WHERE banned_by = u.user_id AND banned_user = ?)
+        FROM users u WHERE u.user_id = ? AND u.deleted_at IS NULL`, viewerID, userID).Scan(&banned)
+	if errors.Is(err, sql.ErrNoRows) || banned {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if err = db.checkAccountOpen(userID, viewerID); err != nil {
+		return nil, err
+	}
+
+	users, err := db.queryUserSummaries(query, sql.Named("user", userID), sql.Named("viewer", viewerID),
+		sql.Named("limit", page.Limit), sql.Named("offset", page.Offset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	return users, nil
+}
+
+// queryUserSummaries runs a query selecting userSummarySQL, and returns the users.
+func (db *appdbimpl) queryUserSummaries(query string, args ...interface{}) ([]UserSummary, error) {
+	users := []UserSummary{}
+	err := db.scanRows(query, args, func(rows *sql.Rows) error {
+		var u UserSummary
+		if err := rows.Scan(&u.ID, &u.Username, &u.YouFollow, &u.FollowsYou); err != nil {
+			return err
+		}
+		users = append(users, u)
+		return nil
+	})
+	return users, err
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"fmt"
+)
+
+// RepairDanglingRows removes follower, like, comment and ban rows that point to users or photos that no longer
+// exist, as well as users following or banning themselves. These rows were accepted by older versions of the API.
+func (db *appdbimpl) RepairDanglingRows() (RepairReport, error) {
+	var report RepairReport
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	steps := []struct {
+		count *int64
+		query string
+	}{
+		{&report.Followers, `DELETE FROM followers
+            WHERE user_id = follower_id
+               OR user_id NOT IN (SELECT user_id FROM users)
+               OR follower_id NOT IN (SELECT user_id FROM users)`},
+		{&report.Likes, `DELETE FROM likes
+            WHERE user_id NOT IN (SELECT user_id FROM users)
+               OR photo_id NOT IN (SELECT photo_id FROM new_photos)`},
+		{&report.Comments, `DELETE FROM comments
+            WHERE user_id NOT IN (SELECT user_id FROM users)
+               OR photo_id NOT IN (SELECT photo_id FROM new_photos)`},
+		{&report.Bans, `DELETE FROM new_bans
+            WHERE banned_by = banned_user
+               OR banned_by NOT IN (SELECT user_id FROM users)
+               OR banned_user NOT IN (SELECT user_id FROM users)`},
+	}
+	for _, step := range steps {
+		res, err := tx.Exec(step.query)
+		if err != nil {
+			return report, fmt.Errorf("failed to remove dangling rows: %w", err)
+		}
+		*step.count, err = res.RowsAffected()
+		if err != nil {
+			return report, fmt.Errorf("failed to read affected rows: %w", err)
+		}
+	}
+
+	return report, tx.Commit()
+}
@@ -0,0 +1,340 @@
+package database
+
+// Reports of abusive content and accounts, and the moderation queue in which administrators resolve them.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// CreateReport adds the report of a user about a photo, a comment or a user to the open report of the target, opening
+// one if there is none. It returns the ID of the report and whether the submission is new: a user who reported the
+// same target already is not counted twice. Targets that the reporter cannot see are not found (ErrPhotoNotFound,
+// ErrCommentNotFound or ErrUserNotFound), and users cannot report themselves or their own content (ErrSelfTarget).
+func (db *appdbimpl) CreateReport(reporterID string, targetType string, targetID string, submission ReportSubmission) (string, bool, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return "", false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	ownerID, err := reportTargetOwner(tx, reporterID, targetType, targetID)
+	if err != nil {
+		return "", false, err
+	}
+	if ownerID == reporterID {
+		return "", false, ErrSelfTarget
+	}
+
+	now := globaltime.Now().UTC()
+	var reportID string
+	err = tx.QueryRow(`SELECT report_id FROM reports WHERE target_type = ? AND target_id = ? AND state = ?`,
+		targetType, targetID, ReportOpen).Scan(&reportID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if reportID, err = generateRandomString(10); err != nil {
+			return "", false, fmt.Errorf("failed to generate report id: %w", err)
+		}
+		_, err = tx.Exec(`INSERT INTO reports (report_id, target_type, target_id, target_owner, state, created_at)
+            VALUES (?, ?, ?, ?, ?, ?)`, reportID, targetType, targetID, ownerID, ReportOpen, now)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to open report: %w", err)
+		}
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to get open report: %w", err)
+	}
+
+	res, err := tx.Exec(`INSERT INTO report_submissions (report_id, reporter_id, reason, comment, created_at)
+        VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`, reportID, reporterID, submission.Reason, submission.Comment, now)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to add report submission: %w", err)
+	}
+	created, err := changed(res)
+	if err != nil {
+		return "", false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", false, fmt.Errorf("failed to commit: %w", err)
+	}
+	return reportID, created, nil
+}
+
+// reportTargetOwner returns the user who posted the reported content, or the reported user, as long as the reporter
+// can see it: accounts being deleted are seen by nobody.
+func reportTargetOwner(tx *sql.Tx, reporterID string, targetType string, targetID string) (string, error) {
+	var query string
+	var notFound error
+	args := []interface{}{sql.Named("target", targetID), sql.Named("viewer", reporterID)}
+	switch targetType {
+	case TargetPhoto:
+		query = `SELECT p.user_id FROM new_photos p WHERE p.photo_id = @target AND ` + photoVisibleSQL
+		notFound = ErrPhotoNotFound
+	case TargetComment:
+		query = `SELECT c.user_id FROM comments c JOIN new_photos p ON p.photo_id = c.photo_id
+            WHERE c.comment_id = @target AND c.hidden_at IS NULL AND ` + photoVisibleSQL
+		notFound = ErrCommentNotFound
+	case TargetUser:
+		query = `SELECT user_id FROM users WHERE user_id = @target AND deleted_at IS NULL`
+		notFound = ErrUserNotFound
+		args = args[:1]
+	default:
+		return "", fmt.Errorf("unknown report target type %q", targetType)
+	}
+	var ownerID string
+	err := tx.QueryRow(query, args...).Scan(&ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", notFound
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get report target: %w", err)
+	}
+	return ownerID, nil
+}
+
+// GetReports returns a page of the reports matching the filter. The most reported targets come first, and targets
+// reported by the same number of users in the order they were first reported.
+func (db *appdbimpl) GetReports(filter ReportFilter, page Page) ([]Report, error) {
+	rows, err := db.c.Query(`SELECT r.report_id, r.target_type, r.target_id, r.target_owner, r.state, r.created_at,
+            r.resolved_at, r.resolved_by, r.resolution_note,
+            (SELECT COUNT(*) FROM report_submissions s WHERE s.report_id = r.report_id) AS reporters
+        FROM reports r
+        WHERE (@state = '' OR r.state = @state) AND (@target_type = '' OR r.target_type = @target_type)
+        ORDER BY reporters DESC, r.created_at, r.report_id
+        LIMIT @limit OFFSET @offset`,
+		sql.Named("state", filter.State), sql.Named("target_type", filter.TargetType),
+		sql.Named("limit", page.Limit), sql.Named("offset", page.Offset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reports: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iteration error: %w", err)
+	}
+	for i := range reports {
+		if reports[i].Reasons, err = db.getReportReasons(reports[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return reports, nil
+}
+
+// GetReport returns a report with the submissions of the single users, oldest first, or ErrReportNotFound.
+func (db *appdbimpl) GetReport(reportID string) (*Report, []ReportSubmission, error) {
+	r, err := scanReport(db.c.QueryRow(`SELECT r.report_id, r.target_type, r.target_id, r.target_owner, r.state,
+            r.created_at, r.resolved_at, r.resolved_by, r.resolution_note,
+            (SELECT COUNT(*) FROM report_submissions s WHERE s.report_id = r.report_id)
+        FROM reports r WHERE r.report_id = ?`, reportID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrReportNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if r.Reasons, err = db.getReportReasons(reportID); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := db.c.Query(`SELECT reporter_id, reason, comment, created_at FROM report_submissions
+        WHERE report_id = ? ORDER BY created_at, reporter_id`, reportID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query report submissions: %w", err)
+	}
+	defer rows.Close()
+
+	submissions := []ReportSubmission{}
+	for rows.Next() {
+		var s ReportSubmission
+		if err = rows.Scan(&s.ReporterID, &s.Reason, &s.Comment, &s.CreatedAt); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan report submission: %w", err)
+		}
+		submissions = append(submissions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("iteration error: %w", err)
+	}
+	return &r, submissions, nil
+}
+
+// scanReport reads a report, without its reasons, from a row of GetReports or GetReport.
+func scanReport(row interface{ Scan(...interface{}) error }) (Report, error) {
+	var r Report
+	var resolvedAt sql.NullTime
+	var resolvedBy sql.NullString
+	err := row.Scan(&r.ID, &r.TargetType, &r.TargetID, &r.TargetOwnerID, &r.State, &r.CreatedAt, &resolvedAt,
+		&resolvedBy, &r.ResolutionNote, &r.Reporters)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, err
+	} else if err != nil {
+		return r, fmt.Errorf("failed to scan report: %w", err)
+	}
+	r.ResolvedAt = nullTime(resolvedAt)
+	r.ResolvedBy = resolvedBy.String
+	return r, nil
+}
+
+// getReportReasons counts the submissions of a report by reason.
+func (db *appdbimpl) getReportReasons(reportID string) (map[string]int, error) {
+	rows, err := db.c.Query(`SELECT reason, COUNT(*) FROM report_submissions WHERE report_id = ? GROUP BY reason`,
+		reportID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count report reasons: %w", err)
+	}
+	defer rows.Close()
+
+	reasons := map[string]int{}
+	for rows.Next() {
+		var reason string
+		var count int
+		if err = rows.Scan(&reason, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan report reason: %w", err)
+		}
+		reasons[reason] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iteration error: %w", err)
+	}
+	return reasons, nil
+}
+
+// reportResolution is the state of a report recorded in the audit log
+type reportResolution struct {
+	State string `json:"state"`
+	Note  string `json:"note,omitempty"`
+}
+
+// ResolveReport closes an open report as ReportActioned or ReportDismissed. Actioning a report hides the reported
+// photo or comment, or suspends the reported user; a target deleted in the meantime is left alone. ErrReportNotFound
+// is returned if there is no such report, and ErrReportResolved if it is not open anymore.
+func (db *appdbimpl) ResolveReport(actor Actor, reportID string, state string, note string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var targetType, targetID, oldState string
+	err = tx.QueryRow(`SELECT target_type, target_id, state FROM reports WHERE report_id = ?`,
+		reportID).Scan(&targetType, &targetID, &oldState)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrReportNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to get report: %w", err)
+	}
+	if oldState != ReportOpen {
+		return ErrReportResolved
+	}
+
+	action := "report.dismiss"
+	if state == ReportActioned {
+		action = "report.action"
+		switch targetType {
+		case TargetPhoto:
+			err = setHidden(tx, actor, "new_photos", "photo_id", TargetPhoto, targetID, true)
+		case TargetComment:
+			err = setHidden(tx, actor, "comments", "comment_id", TargetComment, targetID, true)
+		case TargetUser:
+			reason := "Report " + reportID
+			if note != "" {
+				reason += ": " + note
+			}
+			err = suspendUser(tx, actor, targetID, reason)
+		}
+		if errors.Is(err, ErrPhotoNotFound) || errors.Is(err, ErrCommentNotFound) || errors.Is(err, ErrUserNotFound) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE reports SET state = ?, resolved_at = ?, resolved_by = ?, resolution_note = ?
+        WHERE report_id = ?`, state, globaltime.Now().UTC(),
+		sql.NullString{String: actor.UserID, Valid: actor.UserID != ""}, note, reportID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve report: %w", err)
+	}
+	err = recordAudit(tx, actor, action, "report", reportID, targetType+":"+targetID,
+		reportResolution{State: oldState}, reportResolution{State: state, Note: note})
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// SetPhotoHidden hides a photo from everybody, its owner included, or shows it again. ErrPhotoNotFound is returned if
+// there is no such photo.
+func (db *appdbimpl) SetPhotoHidden(actor Actor, photoID string, hidden bool) error {
+	return db.setHiddenTx(actor, "new_photos", "photo_id", TargetPhoto, photoID, hidden)
+}
+
+// SetCommentHidden hides a comment from everybody, its author included, or shows it again. ErrCommentNotFound is
+// returned if there is no such comment.
+func (db *appdbimpl) SetCommentHidden(actor Actor, commentID string, hidden bool) error {
+	return db.setHiddenTx(actor, "comments", "comment_id", TargetComment, commentID, hidden)
+}
+
+func (db *appdbimpl) setHiddenTx(actor Actor, table, idColumn, targetType, targetID string, hidden bool) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = setHidden(tx, actor, table, idColumn, targetType, targetID, hidden); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// visibility is the state of a photo or a comment recorded in the audit log
+type visibility struct {
+	HiddenAt *time.Time `json:"hiddenAt"` // Nil if the content is visible
+}
+
+// setHidden hides or shows a photo or a comment. Hiding content already hidden (or showing visible content) is not
+// recorded.
+func setHidden(tx *sql.Tx, actor Actor, table, idColumn, targetType, targetID string, hidden bool) error {
+	var hiddenAt sql.NullTime
+	err := tx.QueryRow(`SELECT hidden_at FROM `+table+` WHERE `+idColumn+` = ?`, targetID).Scan(&hiddenAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		if targetType == TargetPhoto {
+			return ErrPhotoNotFound
+		}
+		return ErrCommentNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to get %s: %w", targetType, err)
+	}
+	if hiddenAt.Valid == hidden {
+		return nil
+	}
+
+	var before, after visibility
+	before.HiddenAt = nullTime(hiddenAt)
+	action := targetType + ".unhide"
+	if hidden {
+		action = targetType + ".hide"
+		now := globaltime.Now().UTC()
+		after.HiddenAt = &now
+	}
+	_, err = tx.Exec(`UPDATE `+table+` SET hidden_at = ? WHERE `+idColumn+` = ?`, after.HiddenAt, targetID)
+	if err != nil {
+		return fmt.Errorf("failed to hide %s: %w", targetType, err)
+	}
+	return recordAudit(tx, actor, action, targetType, targetID, "", before, after)
+}
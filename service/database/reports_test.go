@@ -0,0 +1,49 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCreateReport(t *testing.T) {
+	db := newTestDB(t)
+	ids := addUsers(t, db, "alice", "bob", "carol", "dave")
+	report := func(reporter string, target string, reason string) (string, bool, error) {
+		return db.CreateReport(ids[reporter], TargetUser, ids[target], ReportSubmission{Reason: reason})
+	}
+
+	reportID, created, err := report("alice", "bob", "spam")
+	if err != nil || !created {
+		t.Fatalf("first report: created %v (%v)", created, err)
+	}
+	again, created, err := report("alice", "bob", "harassment")
+	if err != nil || created || again != reportID {
+		t.Errorf("second report by the same user: %s, created %v (%v), want %s not created", again, created, err, reportID)
+	}
+	other, created, err := report("carol", "bob", "harassment")
+	if err != nil || !created || other != reportID {
+		t.Errorf("report by another user: %s, created %v (%v), want %s created", other, created, err, reportID)
+	}
+
+	r, submissions, err := db.GetReport(reportID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Reporters != 2 || r.Reasons["spam"] != 1 || r.Reasons["harassment"] != 1 || r.TargetOwnerID != ids["bob"] {
+		t.Errorf("report = %+v", *r)
+	}
+	// The second submission of alice did not replace the first one
+	if len(submissions) != 2 || submissions[0].ReporterID != ids["alice"] || submissions[0].Reason != "spam" {
+		t.Errorf("submissions = %+v", submissions)
+	}
+
+	if _, _, err = report("alice", "alice", "spam"); !errors.Is(err, ErrSelfTarget) {
+		t.Errorf("self report: %v, want ErrSelfTarget", err)
+	}
+	if _, err = db.DeleteUser(Actor{}, ids["dave"]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = report("alice", "dave", "spam"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("report of a deleted account: %v, want ErrUserNotFound", err)
+	}
+}
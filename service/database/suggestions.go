@@ -0,0 +1,102 @@
+package database
+
+// Follow suggestions. Users not followed by the requesting user are ranked by the users they have in common with it
+// (friends of friends), by how active they are lately, and by how popular they are. Users banned in either direction,
+// dismissed suggestions, suspended and deleted accounts are never suggested.
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// suggestionScoreSQL weighs the signals of a suggestion. Mutual followers count most; activity and popularity are
+// capped, so that they break ties between friends of friends rather than bury them under celebrities.
+const suggestionScoreSQL = `mutuals * 10 + MIN(recent, 5) * 2 + MIN(followers, 50) / 5`
+
+// Besides friends of friends, the candidates are the users who posted the most among the latest suggestionSample
+// photos and gained the most followers among the latest suggestionSample follows, suggestionPool of each: ranking
+// every user would not scale.
+const (
+	suggestionSample = 5000
+	suggestionPool   = 200
+)
+
+// GetSuggestions returns the users userID may want to follow, best first. Photos posted after activeSince count as
+// recent activity.
+func (db *appdbimpl) GetSuggestions(userID string, activeSince time.Time, page Page) ([]Suggestion, error) {
+	suggestions := []Suggestion{}
+	err := db.scanRows(`
+    WITH mutual AS (
+        SELECT f2.user_id AS candidate, COUNT(*) AS n, MIN(u2.username) AS example
+        FROM followers f1
+        JOIN followers f2 ON f2.follower_id = f1.user_id
+        JOIN users u2 ON u2.user_id = f1.user_id AND u2.deleted_at IS NULL
+        WHERE f1.follower_id = @viewer
+        GROUP BY f2.user_id
+    ), active AS (
+        SELECT user_id FROM (
+            SELECT p.user_id FROM new_photos p
+            WHERE p.timestamp > @since AND p.hidden_at IS NULL AND p.visibility = '`+VisibilityPublic+`'
+            ORDER BY p.timestamp DESC LIMIT @sample)
+        GROUP BY user_id ORDER BY COUNT(*) DESC LIMIT @pool
+    ), popular AS (
+        SELECT user_id FROM (SELECT user_id FROM followers ORDER BY rowid DESC LIMIT @sample)
+        GROUP BY user_id ORDER BY COUNT(*) DESC LIMIT @pool
+    ), pool AS (
+        SELECT candidate AS user_id FROM mutual
+        UNION SELECT user_id FROM active
+        UNION SELECT user_id FROM popular
+    ), candidates AS (
+        SELECT u.user_id, u.username,
+               COALESCE(m.n, 0) AS mutuals, COALESCE(m.example, '') AS example,
+               (SELECT COUNT(*) FROM new_photos p WHERE p.user_id = u.user_id AND p.timestamp > @since
+                    AND p.hidden_at IS NULL AND p.visibility = '`+VisibilityPublic+`') AS recent,
+               (SELECT COUNT(*) FROM followers f WHERE f.user_id = u.user_id) AS followers
+        FROM pool JOIN users u ON u.user_id = pool.user_id LEFT JOIN mutual m ON m.candidate = u.user_id
+        WHERE u.user_id != @viewer AND u.deleted_at IS NULL AND u.suspended_at IS NULL
+          AND NOT EXISTS (SELECT 1 FROM followers f WHERE f.user_id = u.user_id AND f.follower_id = @viewer)
+          AND NOT EXISTS (SELECT 1 FROM follow_requests r WHERE r.user_id = u.user_id AND r.requester_id = @viewer)
+          AND NOT EXISTS (SELECT 1 FROM new_bans b WHERE (b.banned_by = u.user_id AND b.banned_user = @viewer)
+                                                      OR (b.banned_by = @viewer AND b.banned_user = u.user_id))
+          AND NOT EXISTS (SELECT 1 FROM suggestion_dismissals d WHERE d.user_id = @viewer AND d.dismissed_id = u.user_id)
+    )
+    SELECT user_id, username, mutuals, example, recent, followers
+    FROM candidates
+    ORDER BY `+suggestionScoreSQL+` DESC, followers DESC, user_id
+    LIMIT @limit OFFSET @offset`,
+		[]interface{}{sql.Named("viewer", userID), sql.Named("since", activeSince.UTC()),
+			sql.Named("sample", suggestionSample), sql.Named("pool", suggestionPool),
+			sql.Named("limit", page.Limit), sql.Named("offset", page.Offset)},
+		func(rows *sql.Rows) error {
+			var s Suggestion
+			if err := rows.Scan(&s.UserID, &s.Username, &s.MutualFollowers, &s.MutualExample, &s.RecentPhotos,
+				&s.FollowersCount); err != nil {
+				return err
+			}
+			suggestions = append(suggestions, s)
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query suggestions: %w", err)
+	}
+	return suggestions, nil
+}
+
+// DismissSuggestion stops suggesting dismissedID to userID. Dismissing a suggestion twice is not an error.
+// ErrUserNotFound is returned for unknown users.
+func (db *appdbimpl) DismissSuggestion(userID string, dismissedID string) error {
+	res, err := db.c.Exec(`INSERT INTO suggestion_dismissals (user_id, dismissed_id, created_at)
+        SELECT ?, user_id, ? FROM users WHERE user_id = ?
+        ON CONFLICT (user_id, dismissed_id) DO NOTHING`, userID, globaltime.Now().UTC(), dismissedID)
+	if err != nil {
+		return fmt.Errorf("failed to dismiss suggestion: %w", err)
+	}
+	ok, err := changed(res)
+	if err != nil || ok {
+		return err
+	}
+	return db.checkUserExists(dismissedID)
+}
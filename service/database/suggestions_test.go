@@ -0,0 +1,50 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetSuggestions(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC()
+	names := []string{"viewer", "friend", "followed", "fof", "active", "stale", "popular", "dismissed", "lonely"}
+	seed(t, db, `INSERT INTO users (user_id, username, username_key) VALUES (?, ?, ?)`, len(names),
+		func(i int) []interface{} { return []interface{}{names[i], names[i], names[i]} })
+	follows := [][2]string{
+		{"friend", "viewer"}, {"followed", "viewer"}, {"fof", "friend"},
+		{"popular", "fof"}, {"popular", "stale"}, {"dismissed", "stale"},
+	}
+	seed(t, db, `INSERT INTO followers (user_id, follower_id) VALUES (?, ?)`, len(follows),
+		func(i int) []interface{} { return []interface{}{follows[i][0], follows[i][1]} })
+	photos := []struct {
+		owner string
+		age   time.Duration
+	}{{"active", time.Hour}, {"followed", time.Hour}, {"stale", 30 * 24 * time.Hour}}
+	seed(t, db, `INSERT INTO new_photos (photo_id, user_id, image_data, timestamp) VALUES (?, ?, ?, ?)`, len(photos),
+		func(i int) []interface{} {
+			return []interface{}{photos[i].owner + "-photo", photos[i].owner, []byte{}, now.Add(-photos[i].age)}
+		})
+	if err := db.DismissSuggestion("viewer", "dismissed"); err != nil {
+		t.Fatal(err)
+	}
+
+	suggestions, err := db.GetSuggestions("viewer", now.Add(-7*24*time.Hour), Page{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Users who are not friends of friends, not recently active and not gaining followers are not candidates
+	want := []Suggestion{
+		{UserID: "fof", Username: "fof", MutualFollowers: 1, MutualExample: "friend", FollowersCount: 1},
+		{UserID: "active", Username: "active", RecentPhotos: 1},
+		{UserID: "popular", Username: "popular", FollowersCount: 2},
+	}
+	if len(suggestions) != len(want) {
+		t.Fatalf("suggestions = %+v, want %+v", suggestions, want)
+	}
+	for i := range want {
+		if suggestions[i] != want[i] {
+			t.Errorf("suggestion %d = %+v, want %+v", i, suggestions[i], want[i])
+		}
+	}
+}
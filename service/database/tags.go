@@ -0,0 +1,222 @@
+package database
+
+// Hashtags. The tags of a photo are taken from its caption when it is posted (see package hashtag) and stored in
+// photo_tags, with the time of the photo. Users follow tags to get their photos in the stream (see GetMyStream).
+// Trending tags are computed in the background by ComputeTagTrends, which compares how many public photos used each
+// tag in the last window with the window before, and stored in tag_trends until the next run.
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/hashtag"
+)
+
+// trendWindows are the windows tags trend over, by name
+var trendWindows = []struct {
+	name   string
+	length time.Duration
+}{
+	{TrendHour, time.Hour},
+	{TrendDay, 24 * time.Hour},
+	{TrendWeek, 7 * 24 * time.Hour},
+}
+
+const (
+	// minTrendUses is how many times a tag must be used in a window to trend
+	minTrendUses = 2
+	// maxTrendingTags is how many tags are kept for each window
+	maxTrendingTags = 100
+)
+
+// trendGrowthSQL is how fast the usage of a tag grew, from the columns uses and previous_uses: the new uses relative to
+// the previous ones, plus three so that tags used a couple of times more than nothing do not rank above every
+// established tag that doubled.
+const trendGrowthSQL = `(uses - previous_uses) * 1.0 / (previous_uses + 3)`
+
+// tagPhoto stores the tags in the caption of a photo within tx.
+func tagPhoto(tx *sql.Tx, photoID string, caption string, createdAt time.Time) error {
+	for _, tag := range hashtag.Extract(caption) {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO photo_tags (tag, photo_id, created_at) VALUES (?, ?, ?)`,
+			tag, photoID, createdAt.UTC())
+		if err != nil {
+			return fmt.Errorf("failed to tag photo: %w", err)
+		}
+	}
+	return nil
+}
+
+// tagPhotos stores the tags of the photos posted before tags were stored.
+func tagPhotos(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	type captioned struct {
+		photoID, caption string
+		timestamp        time.Time
+	}
+	var photos []captioned
+	rows, err := tx.Query(`SELECT photo_id, caption, timestamp FROM new_photos WHERE caption LIKE '%#%'`)
+	if err != nil {
+		return fmt.Errorf("failed to query captions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p captioned
+		if err = rows.Scan(&p.photoID, &p.caption, &p.timestamp); err != nil {
+			return fmt.Errorf("failed to scan caption: %w", err)
+		}
+		photos = append(photos, p)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to query captions: %w", err)
+	}
+
+	for _, p := range photos {
+		if err = tagPhoto(tx, p.photoID, p.caption, p.timestamp); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// GetTag returns the page of a tag as seen by viewerID. Only the photos viewerID can see are counted, except for the
+// photos of the users it banned.
+func (db *appdbimpl) GetTag(tag string, viewerID string) (*Tag, error) {
+	t := Tag{Tag: tag}
+	err := db.c.QueryRow(`SELECT
+        (SELECT COUNT(*) FROM photo_tags t JOIN new_photos p ON p.photo_id = t.photo_id
+            WHERE t.tag = @tag AND `+photoVisibleSQL+`
+                AND p.user_id NOT IN (SELECT b.banned_user FROM new_bans b WHERE b.banned_by = @viewer)),
+        (SELECT COUNT(*) FROM tag_follows tf JOIN users u ON u.user_id = tf.user_id
+            WHERE tf.tag = @tag AND u.deleted_at IS NULL),
+        EXISTS(SELECT 1 FROM tag_follows WHERE tag = @tag AND user_id = @viewer)`,
+		sql.Named("tag", tag), sql.Named("viewer", viewerID)).Scan(&t.Photos, &t.Followers, &t.YouFollow)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tag: %w", err)
+	}
+	return &t, nil
+}
+
+// GetTagPhotoIDs returns the IDs of the photos with a tag that viewerID can see, in the order given by sort
+// (TagSortRecent or TagSortTop). The photos of the users viewerID banned are left out.
+func (db *appdbimpl) GetTagPhotoIDs(tag string, viewerID string, sort string, page Page) ([]string, error) {
+	order := `t.created_at DESC, t.photo_id`
+	if sort == TagSortTop {
+		order = `(SELECT COUNT(*) FROM likes l WHERE l.photo_id = p.photo_id
+            AND l.user_id NOT IN (` + deletedUsersSQL + `)) DESC, ` + order
+	}
+	ids, err := db.queryIDs(`SELECT p.photo_id FROM photo_tags t JOIN new_photos p ON p.photo_id = t.photo_id
+        WHERE t.tag = @tag AND `+photoVisibleSQL+`
+            AND p.user_id NOT IN (SELECT b.banned_user FROM new_bans b WHERE b.banned_by = @viewer)
+        ORDER BY `+order+`
+        LIMIT @limit OFFSET @offset`, sql.Named("tag", tag), sql.Named("viewer", viewerID),
+		sql.Named("limit", page.Limit), sql.Named("offset", page.Offset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tag photos: %w", err)
+	}
+	return ids, nil
+}
+
+// FollowTag makes userID follow a tag, and reports whether it did not follow it already.
+func (db *appdbimpl) FollowTag(userID string, tag string) (bool, error) {
+	res, err := db.c.Exec(`INSERT INTO tag_follows (user_id, tag, created_at) VALUES (?, ?, ?)
+        ON CONFLICT (user_id, tag) DO NOTHING`, userID, tag, globaltime.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to follow tag: %w", err)
+	}
+	return changed(res)
+}
+
+// UnfollowTag makes userID stop following a tag. Unfollowing a tag not followed is not an error.
+func (db *appdbimpl) UnfollowTag(userID string, tag string) error {
+	_, err := db.c.Exec(`DELETE FROM tag_follows WHERE user_id = ? AND tag = ?`, userID, tag)
+	if err != nil {
+		return fmt.Errorf("failed to unfollow tag: %w", err)
+	}
+	return nil
+}
+
+// GetFollowedTags returns the tags followed by userID, most recently followed first.
+func (db *appdbimpl) GetFollowedTags(userID string, page Page) ([]FollowedTag, error) {
+	tags := []FollowedTag{}
+	err := db.scanRows(`SELECT tag, created_at FROM tag_follows WHERE user_id = ?
+        ORDER BY created_at DESC, tag
+        LIMIT ? OFFSET ?`, []interface{}{userID, page.Limit, page.Offset}, func(rows *sql.Rows) error {
+		var t FollowedTag
+		if err := rows.Scan(&t.Tag, &t.FollowedAt); err != nil {
+			return err
+		}
+		tags = append(tags, t)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query followed tags: %w", err)
+	}
+	return tags, nil
+}
+
+// ComputeTagTrends replaces the trending tags of every window with those trending at now. A tag trends in a window
+// when it was used at least minTrendUses times, and more than in the window before; tags are ranked by growth (see
+// trendGrowthSQL). Only the photos that everybody can see are counted (see photoVisibleSQL).
+func (db *appdbimpl) ComputeTagTrends(now time.Time) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now = now.UTC()
+	for _, window := range trendWindows {
+		if _, err = tx.Exec(`DELETE FROM tag_trends WHERE trend_window = ?`, window.name); err != nil {
+			return fmt.Errorf("failed to delete trends: %w", err)
+		}
+		_, err = tx.Exec(`INSERT INTO tag_trends (trend_window, tag, uses, previous_uses, growth, computed_at)
+            SELECT @window, tag, uses, previous_uses, `+trendGrowthSQL+`, @now FROM (
+                SELECT t.tag, SUM(t.created_at >= @start) AS uses, SUM(t.created_at < @start) AS previous_uses
+                FROM photo_tags t JOIN new_photos p ON p.photo_id = t.photo_id
+                WHERE t.created_at >= @previous AND t.created_at < @now AND `+photoVisibleSQL+`
+                GROUP BY t.tag
+            )
+            WHERE uses >= @min AND uses > previous_uses
+            ORDER BY `+trendGrowthSQL+` DESC, uses DESC
+            LIMIT @max`,
+			sql.Named("window", window.name), sql.Named("now", now), sql.Named("viewer", ""),
+			sql.Named("start", now.Add(-window.length)), sql.Named("previous", now.Add(-2*window.length)),
+			sql.Named("min", minTrendUses), sql.Named("max", maxTrendingTags))
+		if err != nil {
+			return fmt.Errorf("failed to compute %s trends: %w", window.name, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// GetTrendingTags returns the tags trending in a window (TrendHour, TrendDay or TrendWeek), fastest growing first.
+func (db *appdbimpl) GetTrendingTags(window string, page Page) ([]TrendingTag, error) {
+	tags := []TrendingTag{}
+	err := db.scanRows(`SELECT tag, uses, previous_uses, growth, computed_at FROM tag_trends WHERE trend_window = ?
+        ORDER BY growth DESC, uses DESC, tag
+        LIMIT ? OFFSET ?`, []interface{}{window, page.Limit, page.Offset}, func(rows *sql.Rows) error {
+		var t TrendingTag
+		if err := rows.Scan(&t.Tag, &t.Uses, &t.PreviousUses, &t.Growth, &t.ComputedAt); err != nil {
+			return err
+		}
+		tags = append(tags, t)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trending tags: %w", err)
+	}
+	return tags, nil
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeTagTrends(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	seed(t, db, `INSERT INTO users (user_id, username, username_key) VALUES (?, ?, ?)`, 1,
+		func(i int) []interface{} { return []interface{}{"owner", "owner", "owner"} })
+
+	hour, day := time.Hour, 24*time.Hour
+	uses := []struct {
+		tag        string
+		age        time.Duration // Before now
+		visibility string
+	}{
+		{"espresso", 10 * time.Minute, VisibilityPublic},
+		{"espresso", 20 * time.Minute, VisibilityPublic},
+		{"espresso", 30 * time.Minute, VisibilityPublic},
+		{"latte", 10 * time.Minute, VisibilityPublic},
+		{"latte", 20 * time.Minute, VisibilityPublic},
+		{"latte", 90 * time.Minute, VisibilityPublic},
+		{"mocha", 3 * hour, VisibilityPublic},
+		{"mocha", 3 * hour, VisibilityPublic},
+		{"mocha", 3 * hour, VisibilityPublic},
+		{"mocha", 3 * hour, VisibilityPublic},
+		{"mocha", 3 * hour, VisibilityPublic},
+		{"tea", 5 * hour, VisibilityPublic},
+		{"tea", 5 * hour, VisibilityPublic},
+		{"tea", 30 * hour, VisibilityPublic},
+		{"tea", 30 * hour, VisibilityPublic},
+		{"tea", 30 * hour, VisibilityPublic},
+		{"decaf", 3 * day, VisibilityPublic},
+		{"decaf", 3 * day, VisibilityPublic},
+		{"decaf", 3 * day, VisibilityPublic},
+		{"decaf", 3 * day, VisibilityPublic},
+		{"decaf", 10 * day, VisibilityPublic},
+		{"once", 10 * time.Minute, VisibilityPublic},
+		{"private", 10 * time.Minute, VisibilityFollowers},
+		{"private", 20 * time.Minute, VisibilityFollowers},
+		{"future", -10 * time.Minute, VisibilityPublic},
+		{"future", -20 * time.Minute, VisibilityPublic},
+	}
+	seed(t, db, `INSERT INTO new_photos (photo_id, user_id, image_data, timestamp, visibility)
+        VALUES (?, 'owner', ?, ?, ?)`, len(uses), func(i int) []interface{} {
+		return []interface{}{string(rune('a' + i)), []byte{}, now.Add(-uses[i].age), uses[i].visibility}
+	})
+	seed(t, db, `INSERT INTO photo_tags (tag, photo_id, created_at) VALUES (?, ?, ?)`, len(uses),
+		func(i int) []interface{} {
+			return []interface{}{uses[i].tag, string(rune('a' + i)), now.Add(-uses[i].age)}
+		})
+
+	trending := func(window string) []string {
+		t.Helper()
+		trends, err := db.GetTrendingTags(window, Page{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := []string{}
+		for _, trend := range trends {
+			tags = append(tags, trend.Tag)
+		}
+		return tags
+	}
+	if err := db.ComputeTagTrends(now); err != nil {
+		t.Fatal(err)
+	}
+	// Tags used less than twice, less than in the window before, in photos not everybody can see, or after now do
+	// not trend. Ties of growth are broken by uses, then by name.
+	want := map[string][]string{
+		TrendHour: {"espresso", "latte"},                          // latte was used once in the hour before
+		TrendDay:  {"mocha", "espresso", "latte"},                 // tea was used more the day before
+		TrendWeek: {"mocha", "tea", "espresso", "latte", "decaf"}, // decaf was used once the week before
+	}
+	for window, tags := range want {
+		if got := trending(window); !equalStrings(got, tags) {
+			t.Errorf("trending in %s: %v, want %v", window, got, tags)
+		}
+	}
+
+	// Every run replaces the trends of the previous one
+	if err := db.ComputeTagTrends(now.Add(2 * hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := trending(TrendHour); len(got) != 0 {
+		t.Errorf("trending in the hour after: %v", got)
+	}
+}
+
+func TestStreamOfFollowedTags(t *testing.T) {
+	db := newTestDB(t)
+	ids := addUsers(t, db, "viewer", "followed", "stranger", "banned")
+	if _, err := db.FollowUser(ids["viewer"], ids["followed"]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FollowTag(ids["viewer"], "espresso"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BanUser(Actor{UserID: ids["viewer"]}, ids["banned"]); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	photos := []struct {
+		id, owner, visibility, caption string
+	}{
+		{"followed-user", "followed", VisibilityPublic, "no tags"},
+		{"followed-both", "followed", VisibilityPublic, "#espresso"},
+		{"followed-tag", "stranger", VisibilityPublic, "Morning #Espresso"},
+		{"other-tag", "stranger", VisibilityPublic, "#latte"},
+		{"not-audience", "stranger", VisibilityFollowers, "#espresso"},
+		{"banned", "banned", VisibilityPublic, "#espresso"},
+		{"own", "viewer", VisibilityPublic, "#espresso"},
+	}
+	for i, p := range photos {
+		photo := Photo{ID: p.id, UserID: ids[p.owner], Timestamp: now.Add(-time.Duration(i) * time.Minute),
+			Visibility: p.visibility, Caption: p.caption}
+		if err := db.AddPhoto(photo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream, err := db.GetMyStream(ids["viewer"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The photos of the followed users and those with followed tags come once each, newest first
+	if want := []string{"followed-user", "followed-both", "followed-tag"}; !equalStrings(stream, want) {
+		t.Errorf("stream %v, want %v", stream, want)
+	}
+
+	if err = db.UnfollowTag(ids["viewer"], "espresso"); err != nil {
+		t.Fatal(err)
+	}
+	if stream, err = db.GetMyStream(ids["viewer"]); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"followed-user", "followed-both"}; !equalStrings(stream, want) {
+		t.Errorf("stream after unfollowing the tag %v, want %v", stream, want)
+	}
+}
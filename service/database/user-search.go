@@ -0,0 +1,319 @@
+package database
+
+// User search. Users are found by the prefix of their username or display name, compared case-insensitively, and by
+// names within a few typos of the query. Both are backed by indexes, so that searching does not scan the users table:
+// prefixes by the username key index and by an index on the lowercase display name, typos by user_trigrams, which
+// holds the three-character substrings of the names of each user and is kept up to date by triggers on users. The
+// users followed by the viewer and its followers are matched as well, as they rank higher. Candidates found by the
+// indexes are then ranked in Go (see rankUserMatch).
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/username"
+)
+
+// maxNameLength is the length of the longest name that is indexed by trigrams: display names are up to 50 characters
+const maxNameLength = 50
+
+// userSearchCandidates is how many users each index contributes at most to the candidates of a search, besides the
+// users needed to fill the requested page
+const userSearchCandidates = 100
+
+// userTrigramCap is how many users can share a trigram for it to be used: trigrams common to many names (like those of
+// "user") would cost a scan of a large part of the index, and tell little about the query
+const userTrigramCap = 5000
+
+// userSearchRelated is how many of the users followed by the viewer, and of its followers (the most recent ones), are
+// matched against the query in any case, so that they rank even when their names sort after the other candidates
+const userSearchRelated = 1000
+
+// userTrigramsSQL inserts the trigrams of the names of the user in the row `NEW` of a trigger. Names are padded with
+// two spaces at the start (see trigrams).
+const userTrigramsSQL = `INSERT OR IGNORE INTO user_trigrams (trigram, user_id)
+        SELECT substr('  ' || t.name, o.n, 3), NEW.user_id
+        FROM (SELECT COALESCE(NEW.username_key, lower(NEW.username)) AS name UNION SELECT lower(NEW.display_name)) t
+        JOIN trigram_offsets o ON o.n <= length(t.name);`
+
+// createUserSearchIndex creates the indexes used by SearchUsers, and fills the trigrams of the existing users the
+// first time.
+func createUserSearchIndex(db *sql.DB) error {
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS users_display_name_key ON users (lower(display_name));`)
+	if err != nil {
+		return err
+	}
+	// trigram_offsets numbers the positions of the trigrams in a name: triggers cannot use recursive queries
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS trigram_offsets (n INTEGER PRIMARY KEY);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT OR IGNORE INTO trigram_offsets (n)
+        WITH RECURSIVE o(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM o WHERE n < ?) SELECT n FROM o`, maxNameLength)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_trigrams (
+        trigram TEXT NOT NULL,
+        user_id TEXT NOT NULL,
+        PRIMARY KEY (trigram, user_id)
+    ) WITHOUT ROWID;`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS user_trigrams_user ON user_trigrams (user_id);`)
+	if err != nil {
+		return err
+	}
+
+	var indexed bool
+	if err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_trigrams)`).Scan(&indexed); err != nil {
+		return err
+	}
+	if !indexed {
+		_, err = db.Exec(`INSERT OR IGNORE INTO user_trigrams (trigram, user_id)
+            SELECT substr('  ' || t.name, o.n, 3), t.user_id
+            FROM (SELECT user_id, COALESCE(username_key, lower(username)) AS name FROM users
+                  UNION SELECT user_id, lower(display_name) FROM users) t
+            JOIN trigram_offsets o ON o.n <= length(t.name)`)
+		if err != nil {
+			return fmt.Errorf("failed to index users: %w", err)
+		}
+	}
+
+	for _, trigger := range []string{
+		`CREATE TRIGGER IF NOT EXISTS users_trigrams_insert AFTER INSERT ON users BEGIN
+        ` + userTrigramsSQL + `
+    END;`,
+		`CREATE TRIGGER IF NOT EXISTS users_trigrams_update AFTER UPDATE OF username, username_key, display_name ON users
+    BEGIN
+        DELETE FROM user_trigrams WHERE user_id = OLD.user_id;
+        ` + userTrigramsSQL + `
+    END;`,
+		`CREATE TRIGGER IF NOT EXISTS users_trigrams_delete AFTER DELETE ON users BEGIN
+        DELETE FROM user_trigrams WHERE user_id = OLD.user_id;
+    END;`,
+	} {
+		if _, err = db.Exec(trigger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchUsers returns the users whose username or display name starts with query, or is within a few typos of it,
+// best match first. Users followed by viewerID, and users who follow it back, rank higher. Users who banned viewerID
+// and deleted accounts are left out.
+func (db *appdbimpl) SearchUsers(viewerID string, query string, page Page) ([]UserMatch, error) {
+	q := username.Key(query)
+	grams := trigrams(q)
+	gramsJSON, err := json.Marshal(grams)
+	if err != nil {
+		return nil, err
+	}
+	// Names sharing too few trigrams with the query cannot be within maxTypos of it: each typo changes 3 trigrams. The
+	// trigrams skipped for being too common (see userTrigramCap) lower the threshold, as names may share them too.
+	shared := len(grams) - 3*maxTypos(q)
+	if shared < 1 {
+		shared = 1
+	}
+
+	// Filters go before the limits, so that the candidates left out cannot leave a page empty
+	const searchableSQL = `u.deleted_at IS NULL
+          AND NOT EXISTS (SELECT 1 FROM new_bans b WHERE b.banned_by = u.user_id AND b.banned_user = @viewer)`
+	var matches []UserMatch
+	err = db.scanRows(`
+    WITH grams(trigram) AS (
+        SELECT value FROM json_each(@grams)
+        WHERE (SELECT COUNT(*) FROM (SELECT 1 FROM user_trigrams t WHERE t.trigram = value LIMIT @cap + 1)) <= @cap
+    ), related(user_id) AS (
+        SELECT user_id FROM (SELECT user_id FROM followers WHERE follower_id = @viewer ORDER BY rowid DESC LIMIT @related)
+        UNION SELECT follower_id FROM (SELECT follower_id FROM followers WHERE user_id = @viewer
+                                       ORDER BY rowid DESC LIMIT @related)
+    ), candidates(user_id) AS (
+        SELECT u.user_id FROM related r JOIN users u ON u.user_id = r.user_id
+        WHERE (u.username_key >= @q AND u.username_key < @end)
+           OR (lower(u.display_name) >= @q AND lower(u.display_name) < @end)
+           OR (SELECT COUNT(*) FROM user_trigrams t WHERE t.user_id = u.user_id
+                   AND t.trigram IN (SELECT value FROM json_each(@grams))) >= @shared
+        UNION SELECT user_id FROM (
+            SELECT u.user_id FROM users u WHERE u.username_key >= @q AND u.username_key < @end AND `+searchableSQL+`
+            ORDER BY u.username_key LIMIT @n
+        )
+        UNION SELECT user_id FROM (
+            SELECT u.user_id FROM users u
+            WHERE lower(u.display_name) >= @q AND lower(u.display_name) < @end AND `+searchableSQL+`
+            ORDER BY lower(u.display_name) LIMIT @n
+        )
+        UNION SELECT user_id FROM (
+            SELECT u.user_id FROM (
+                SELECT user_id, COUNT(*) AS n FROM user_trigrams WHERE trigram IN (SELECT trigram FROM grams)
+                GROUP BY user_id HAVING n >= MAX(1, @shared - (@total - (SELECT COUNT(*) FROM grams)))
+            ) g JOIN users u ON u.user_id = g.user_id
+            WHERE `+searchableSQL+`
+            ORDER BY g.n DESC LIMIT @n
+        )
+    )
+    SELECT `+userSummarySQL+`, u.display_name, COALESCE(u.username_key, lower(u.username))
+    FROM candidates c JOIN users u ON u.user_id = c.user_id
+    WHERE `+searchableSQL,
+		[]interface{}{sql.Named("q", q), sql.Named("end", q+"\U0010FFFF"),
+			sql.Named("n", userSearchCandidates+page.Offset+page.Limit), sql.Named("grams", string(gramsJSON)),
+			sql.Named("total", len(grams)), sql.Named("shared", shared), sql.Named("cap", userTrigramCap),
+			sql.Named("related", userSearchRelated), sql.Named("viewer", viewerID)},
+		func(rows *sql.Rows) error {
+			var m UserMatch
+			var key string
+			if err := rows.Scan(&m.ID, &m.Username, &m.YouFollow, &m.FollowsYou, &m.DisplayName, &key); err != nil {
+				return err
+			}
+			var ok bool
+			if m.score, ok = rankUserMatch(q, key, m); ok {
+				matches = append(matches, m)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].Username < matches[j].Username
+	})
+	if page.Offset >= len(matches) {
+		return []UserMatch{}, nil
+	}
+	matches = matches[page.Offset:]
+	if len(matches) > page.Limit {
+		matches = matches[:page.Limit]
+	}
+	return matches, nil
+}
+
+// rankUserMatch scores how well a user matches the query q, given its username key, and reports whether it matches at
+// all. Exact usernames score most, then prefixes of the username or of a word of the display name, then names within
+// maxTypos of the query (the closer, the better); following the user, and being followed back, add to the score.
+func rankUserMatch(q string, key string, m UserMatch) (int, bool) {
+	names := append([]string{key}, strings.Fields(strings.ToLower(m.DisplayName))...)
+	score := 0
+	switch {
+	case key == q:
+		score = 100
+	case hasPrefix(names, q) || strings.HasPrefix(strings.ToLower(m.DisplayName), q):
+		score = 80
+	default:
+		best := maxTypos(q) + 1
+		for _, name := range names {
+			if d := typos(q, name); d < best {
+				best = d
+			}
+		}
+		if best > maxTypos(q) {
+			return 0, false
+		}
+		score = 60 - 15*best
+	}
+	if m.YouFollow {
+		score += 25
+	}
+	if m.FollowsYou {
+		score += 10
+	}
+	return score, true
+}
+
+// hasPrefix reports whether one of names starts with q.
+func hasPrefix(names []string, q string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(name, q) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxTypos is how many typos a name can have to match the query q: none for very short queries, up to two for long
+// ones.
+func maxTypos(q string) int {
+	switch n := utf8.RuneCountInString(q); {
+	case n < 3:
+		return 0
+	case n < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// typos returns the number of typos between the query q and a name, counted as the edit distance between q and the
+// name, or its prefix as long as q if that is closer: users type names from the start.
+func typos(q string, name string) int {
+	a, b := []rune(q), []rune(name)
+	d := editDistance(a, b)
+	if len(b) > len(a) {
+		if p := editDistance(a, b[:len(a)]); p < d {
+			d = p
+		}
+	}
+	return d
+}
+
+// editDistance returns the number of insertions, deletions, substitutions and transpositions of adjacent characters
+// that turn a into b (optimal string alignment distance).
+func editDistance(a, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// trigrams returns the distinct three-character substrings of s, as stored in user_trigrams. s is padded with two
+// spaces at the start, so that its first characters make trigrams as well: a typo in a short name changes all of its
+// inner trigrams, but rarely its first character.
+func trigrams(s string) []string {
+	r := []rune("  " + s)
+	seen := map[string]bool{}
+	grams := []string{}
+	for i := 0; i+3 <= len(r); i++ {
+		g := string(r[i : i+3])
+		if !seen[g] {
+			seen[g] = true
+			grams = append(grams, g)
+		}
+	}
+	return grams
+}
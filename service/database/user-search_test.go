@@ -0,0 +1,50 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSearchUsersPages(t *testing.T) {
+	const users, banning = 500, 150
+	db := newTestDB(t)
+	id := func(i int) string { return fmt.Sprintf("user%03d", i) }
+	seed(t, db, `INSERT INTO users (user_id, username, username_key) VALUES (?, ?, ?)`, users+1,
+		func(i int) []interface{} {
+			if i == users {
+				return []interface{}{"viewer", "viewer", "viewer"}
+			}
+			return []interface{}{id(i), id(i), id(i)}
+		})
+	// The first users banned the viewer: they must not take the place of the others among the candidates
+	seed(t, db, `INSERT INTO new_bans (ban_id, banned_by, banned_user, timestamp) VALUES (?, ?, 'viewer', ?)`, banning,
+		func(i int) []interface{} { return []interface{}{fmt.Sprintf("ban%03d", i), id(i), time.Now()} })
+	if _, err := db.c.Exec(`INSERT INTO followers (user_id, follower_id) VALUES (?, 'viewer')`, id(users-1)); err != nil {
+		t.Fatal(err)
+	}
+
+	var found []UserMatch
+	for offset := 0; ; offset += 100 {
+		matches, err := db.SearchUsers("viewer", "user", Page{Limit: 100, Offset: offset})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) == 0 {
+			break
+		}
+		found = append(found, matches...)
+	}
+	if len(found) != users-banning {
+		t.Fatalf("found %d users, want %d", len(found), users-banning)
+	}
+	// The followed user sorts after all the others, but ranks first
+	if found[0].ID != id(users-1) || !found[0].YouFollow {
+		t.Errorf("first match = %+v, want %s", found[0], id(users-1))
+	}
+	for i, m := range found[1:] {
+		if want := id(banning + i); m.ID != want {
+			t.Fatalf("match %d = %s, want %s", i+1, m.ID, want)
+		}
+	}
+}
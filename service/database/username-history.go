@@ -0,0 +1,143 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/username"
+)
+
+// SetUsername renames the actor, and records the old username in the history (see package username for the rules on
+// released usernames). ErrUsernameTaken is returned if the new name (compared case-insensitively) belongs to another
+// user or was released by another user too recently, ErrUserNotFound if there is no such user, and a
+// *RenameLimitError if the user renamed too many times recently.
+func (db *appdbimpl) SetUsername(actor Actor, newUsername string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = setUsername(tx, actor, actor.UserID, newUsername, true); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setUsername renames a user as described in SetUsername, on behalf of the actor. The rename limit is checked only if
+// limited is true.
+func setUsername(tx *sql.Tx, actor Actor, userId, newUsername string, limited bool) error {
+	now := globaltime.Now().UTC()
+	newUsername = username.Normalize(newUsername)
+	newKey := username.Key(newUsername)
+
+	var oldUsername, oldKey string
+	err := tx.QueryRow("SELECT username, username_key FROM users WHERE user_id = ?", userId).Scan(&oldUsername, &oldKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to load user: %w", err)
+	}
+
+	// A change of case only is not a rename: the username stays the same
+	renamed := newKey != oldKey
+	if renamed {
+		if limited {
+			if err = checkRenameLimit(tx, userId, now); err != nil {
+				return err
+			}
+		}
+
+		var cooling bool
+		err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM username_history
+            WHERE username_key = ? AND user_id != ? AND released_at > ?)`,
+			newKey, userId, now.Add(-username.Cooldown)).Scan(&cooling)
+		if err != nil {
+			return fmt.Errorf("failed to check username history: %w", err)
+		}
+		if cooling {
+			return fmt.Errorf("%w: released recently", ErrUsernameTaken)
+		}
+	}
+
+	_, err = tx.Exec("UPDATE users SET username = ?, username_key = ? WHERE user_id = ?", newUsername, newKey, userId)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return fmt.Errorf("%w: %v", ErrUsernameTaken, err)
+		}
+		return fmt.Errorf("failed to execute statement: %w", err)
+	}
+
+	if renamed {
+		_, err = tx.Exec(`INSERT INTO username_history (user_id, username, username_key, released_at)
+            VALUES (?, ?, ?, ?)`, userId, oldUsername, oldKey, now)
+		if err != nil {
+			return fmt.Errorf("failed to record username history: %w", err)
+		}
+	}
+	if newUsername != oldUsername {
+		err = recordAudit(tx, actor, "user.rename", "user", userId, "",
+			map[string]string{"username": oldUsername}, map[string]string{"username": newUsername})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRenameLimit returns a *RenameLimitError if the user already renamed username.MaxRenames times in the last
+// username.RenameWindow.
+func checkRenameLimit(tx *sql.Tx, userID string, now time.Time) error {
+	rows, err := tx.Query(`SELECT released_at FROM username_history
+        WHERE user_id = ? AND released_at > ? ORDER BY released_at`, userID, now.Add(-username.RenameWindow))
+	if err != nil {
+		return fmt.Errorf("failed to query username history: %w", err)
+	}
+	defer rows.Close()
+
+	var renames []time.Time
+	for rows.Next() {
+		var releasedAt time.Time
+		if err := rows.Scan(&releasedAt); err != nil {
+			return fmt.Errorf("failed to scan username history: %w", err)
+		}
+		renames = append(renames, releasedAt)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iteration error: %w", err)
+	}
+
+	if len(renames) >= username.MaxRenames {
+		// The oldest rename in the window has to leave it before another one is allowed
+		return &RenameLimitError{RetryAt: renames[len(renames)-username.MaxRenames].Add(username.RenameWindow)}
+	}
+	return nil
+}
+
+// ResolveUsername returns the user with the given username. If no user has it now, but a user released it less than
+// username.GracePeriod ago, that user is returned and the second return value is true: the caller should redirect to
+// the current username. The user is nil if the username cannot be resolved.
+func (db *appdbimpl) ResolveUsername(name string) (*User, bool, error) {
+	user, err := db.GetUserByUsername(name)
+	if err != nil || user != nil {
+		return user, false, err
+	}
+
+	var u User
+	err = db.c.QueryRow(`SELECT u.user_id, u.username
+        FROM username_history h
+        JOIN users u ON u.user_id = h.user_id
+        WHERE h.username_key = ? AND h.released_at > ?
+        ORDER BY h.released_at DESC
+        LIMIT 1`, username.Key(name), globaltime.Now().Add(-username.GracePeriod).UTC()).Scan(&u.ID, &u.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to query username history: %w", err)
+	}
+	return &u, true, nil
+}
@@ -5,8 +5,13 @@ package database
 import (
 	"crypto/rand"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/username"
 )
 
 func generateRandomString(length int) (string, error) {
@@ -39,6 +44,18 @@ func (db *appdbimpl) GetUser(userID string) (*User, error) {
 	return &user, nil
 }
 
+// checkUserExists returns ErrUserNotFound if there is no user with the given ID
+func (db *appdbimpl) checkUserExists(userID string) error {
+	exists, err := db.checkUserIDExists(userID)
+	if err != nil {
+		return fmt.Errorf("failed to check user existence: %w", err)
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
 // checkUserIDExists now returns an error as well
 func (db *appdbimpl) checkUserIDExists(userID string) (bool, error) {
 	var exists bool
@@ -65,189 +82,141 @@ func (db *appdbimpl) generateUniqueID() (string, error) {
 	}
 }
 
-// AddUser uses the generateUniqueID method of appdbimpl
+// AddUser uses the generateUniqueID method of appdbimpl. The username is stored normalized (see package username);
+// ErrUsernameTaken is returned if it only differs by case from an existing one.
 func (db *appdbimpl) AddUser(user *User) error {
+	return db.addUser(user, sql.NullString{}, "", nil)
+}
+
+// RegisterUser adds a user like AddUser, with a password (hashed by the caller) and an e-mail address.
+func (db *appdbimpl) RegisterUser(user *User, passwordHash string, email string) error {
+	return db.addUser(user, sql.NullString{String: passwordHash, Valid: true}, email, nil)
+}
+
+// RegisterExternalUser adds a user like AddUser, linked to an identity at an external provider.
+func (db *appdbimpl) RegisterExternalUser(user *User, identity ExternalIdentity, email string) error {
+	return db.addUser(user, sql.NullString{}, email, &identity)
+}
+
+func (db *appdbimpl) addUser(user *User, passwordHash sql.NullString, email string, identity *ExternalIdentity) error {
 	userID, err := db.generateUniqueID()
 	if err != nil {
 		return fmt.Errorf("failed to generate user ID: %w", err)
 	}
 	user.ID = userID
+	user.Username = username.Normalize(user.Username)
 
-	stmt, err := db.c.Prepare("INSERT INTO users (user_id, username) VALUES (?, ?)")
+	tx, err := db.c.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer stmt.Close()
+	defer func() { _ = tx.Rollback() }()
 
-	_, err = stmt.Exec(user.ID, user.Username)
+	// Usernames released by a rename cannot be claimed until their cooldown is over
+	key := username.Key(user.Username)
+	res, err := tx.Exec(`INSERT INTO users (user_id, username, username_key, password_hash, email) SELECT ?, ?, ?, ?, ?
+        WHERE NOT EXISTS (SELECT 1 FROM username_history WHERE username_key = ? AND released_at > ?)`,
+		user.ID, user.Username, key, passwordHash, email, key, globaltime.Now().Add(-username.Cooldown).UTC())
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			return fmt.Errorf("username already exists: %w", err)
+			return fmt.Errorf("%w: %v", ErrUsernameTaken, err)
 		}
 		return fmt.Errorf("failed to execute statement: %w", err)
 	}
-
-	return nil
-}
-
-func (db *appdbimpl) SetUsername(userId, newUsername string) error {
-	stmt, err := db.c.Prepare("UPDATE users SET username = ? WHERE user_id = ?")
+	ok, err := changed(res)
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %w", err)
+		return err
 	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(newUsername, userId)
-	if err != nil {
-		return fmt.Errorf("failed to execute statement: %w", err)
+	if !ok {
+		return fmt.Errorf("%w: released recently", ErrUsernameTaken)
 	}
 
+	if identity != nil {
+		if err = linkIdentity(tx, user.ID, *identity); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
 	return nil
 }
 
-func (db *appdbimpl) GetUserByUsername(username string) (*User, error) {
+// GetUserByUsername returns the user with the given username (compared case-insensitively), or nil if there is none.
+func (db *appdbimpl) GetUserByUsername(name string) (*User, error) {
 	var user User
-	err := db.c.QueryRow("SELECT user_id, username FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username)
+	err := db.c.QueryRow("SELECT user_id, username FROM users WHERE username_key = ?", username.Key(name)).Scan(&user.ID, &user.Username)
 	if err == sql.ErrNoRows {
 		return nil, nil // User not found is not an error here
 	}
 	return &user, err
 }
 
-func (db *appdbimpl) GetUserProfile(username string) (*User, error) {
-	var user User
-
-	// Fetch basic user info
-	err := db.c.QueryRow("SELECT user_id, username FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found")
-		}
-		return nil, fmt.Errorf("query error: %w", err)
-	}
-
-	// Fetch followers
-	rows, err := db.c.Query("SELECT follower_id FROM followers WHERE user_id = ?", user.ID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch followers: %w", err)
+// FollowUser makes followerID follow followedID, notifies it, and returns FollowStarted. If followedID has a private
+// account, a follow request is sent instead and FollowRequested is returned. Following a user twice is not an error:
+// the second call returns FollowExisting, or FollowRequested again while the request is pending. ErrSelfTarget and
+// ErrUserNotFound are returned for the caller itself and for unknown users.
+func (db *appdbimpl) FollowUser(followerID, followedID string) (string, error) {
+	if followerID == followedID {
+		return "", ErrSelfTarget
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var followerID string
-		if err := rows.Scan(&followerID); err != nil {
-			return nil, fmt.Errorf("failed to read follower row: %w", err)
-		}
-		user.Followers = append(user.Followers, followerID)
-	}
-
-	// Fetch following
-	rows, err = db.c.Query("SELECT user_id FROM followers WHERE follower_id = ?", user.ID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch following: %w", err)
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var followingID string
-		if err := rows.Scan(&followingID); err != nil {
-			return nil, fmt.Errorf("failed to read following row: %w", err)
-		}
-		user.Following = append(user.Following, followingID)
-	}
-
-	// Fetch photos
-	rows, err = db.c.Query("SELECT photo_id FROM new_photos WHERE user_id = ?", user.ID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch photos: %w", err)
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var photoID string
-		if err := rows.Scan(&photoID); err != nil {
-			return nil, fmt.Errorf("failed to read photo row: %w", err)
-		}
-		user.Photos = append(user.Photos, photoID)
-	}
-
-	return &user, nil
-}
-
-func (db *appdbimpl) GetUserProfileByID(userID string) (*User, error) {
-	// Fetch basic user info
-	var user User
-	err := db.c.QueryRow("SELECT user_id, username FROM users WHERE user_id = ?", userID).Scan(&user.ID, &user.Username)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found")
-		}
-		return nil, fmt.Errorf("query error: %w", err)
-	}
-	// Fetch followers
-	rows, err := db.c.Query("SELECT follower_id FROM followers WHERE user_id = ?", user.ID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch followers: %w", err)
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var followerID string
-		if err := rows.Scan(&followerID); err != nil {
-			return nil, fmt.Errorf("failed to read follower row: %w", err)
-		}
-		user.Followers = append(user.Followers, followerID)
-	}
-
-	// Fetch following
-	rows, err = db.c.Query("SELECT user_id FROM followers WHERE follower_id = ?", user.ID)
+	tx, err := db.c.Begin()
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch following: %w", err)
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var private, followed bool
+	err = tx.QueryRow(`SELECT private, EXISTS(SELECT 1 FROM followers WHERE user_id = @user AND follower_id = @follower)
+        FROM users WHERE user_id = @user AND deleted_at IS NULL`, sql.Named("user", followedID), sql.Named("follower", followerID)).Scan(&private, &followed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("error following user: %w", err)
+	}
+
+	state, kind := FollowStarted, NotifyFollow
+	switch {
+	case followed:
+		return FollowExisting, nil
+	case private:
+		state, kind = FollowRequested, NotifyFollowRequest
+		_, err = tx.Exec(`INSERT INTO follow_requests (user_id, requester_id, created_at) VALUES (?, ?, ?)
+            ON CONFLICT (user_id, requester_id) DO NOTHING`, followedID, followerID, globaltime.Now().UTC())
+	default:
+		_, err = tx.Exec(`INSERT INTO followers (user_id, follower_id) VALUES (?, ?)`, followedID, followerID)
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var followingID string
-		if err := rows.Scan(&followingID); err != nil {
-			return nil, fmt.Errorf("failed to read following row: %w", err)
-		}
-		user.Following = append(user.Following, followingID)
-	}
-
-	// Fetch photos
-	rows, err = db.c.Query("SELECT photo_id FROM new_photos WHERE user_id = ?", user.ID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch photos: %w", err)
+		return "", fmt.Errorf("error following user: %w", err)
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var photoID string
-		if err := rows.Scan(&photoID); err != nil {
-			return nil, fmt.Errorf("failed to read photo row: %w", err)
-		}
-		user.Photos = append(user.Photos, photoID)
+	if err = notify(tx, event{userID: followedID, actorID: followerID, kind: kind, at: globaltime.Now()}); err != nil {
+		return "", err
 	}
-
-	return &user, nil
-}
-
-func (db *appdbimpl) FollowUser(followerID, followedID string) error {
-	_, err := db.c.Exec(`INSERT INTO followers (user_id, follower_id) VALUES (?, ?)`, followedID, followerID)
-	if err != nil {
-		return fmt.Errorf("error following user: %w", err)
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit: %w", err)
 	}
-	return nil
+	return state, nil
 }
 
+// UnfollowUser makes followerID stop following followedID, and withdraws its pending follow request if there is one.
 func (db *appdbimpl) UnfollowUser(followerID, followedID string) error {
 	_, err := db.c.Exec(`DELETE FROM followers WHERE user_id = ? AND follower_id = ?`, followedID, followerID)
 	if err != nil {
 		return fmt.Errorf("error unfollowing user: %w", err)
 	}
+	_, err = db.c.Exec(`DELETE FROM follow_requests WHERE user_id = ? AND requester_id = ?`, followedID, followerID)
+	if err != nil {
+		return fmt.Errorf("error withdrawing follow request: %w", err)
+	}
 	return nil
 }
 
-func (db *appdbimpl) GetUserIDByUsername(username string) (string, error) {
+func (db *appdbimpl) GetUserIDByUsername(name string) (string, error) {
 	var userID string
-	err := db.c.QueryRow("SELECT user_id FROM users WHERE username = ?", username).Scan(&userID)
+	err := db.c.QueryRow("SELECT user_id FROM users WHERE username_key = ?", username.Key(name)).Scan(&userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return "", fmt.Errorf("user not found")
+			return "", ErrUserNotFound
 		}
 		return "", fmt.Errorf("query error: %w", err)
 	}
@@ -256,7 +225,7 @@ func (db *appdbimpl) GetUserIDByUsername(username string) (string, error) {
 
 // getAllUsers
 func (db *appdbimpl) GetAllUsers() ([]User, error) {
-	rows, err := db.c.Query("SELECT user_id, username FROM users")
+	rows, err := db.c.Query("SELECT user_id, username FROM users WHERE deleted_at IS NULL")
 	if err != nil {
 		return nil, fmt.Errorf("failed to query users: %w", err)
 	}
@@ -275,21 +244,22 @@ func (db *appdbimpl) GetAllUsers() ([]User, error) {
 	return users, nil
 }
 
-func (db *appdbimpl) GetFollowersByUsername(username string) ([]string, error) {
-	var followers []string
-	query := `SELECT follower_id FROM followers WHERE user_id = (SELECT user_id FROM users WHERE username = ?)`
-	rows, err := db.c.Query(query, username)
+// GetFollowersByUsername returns the IDs of the followers of a user, most recent first. Deleted accounts are left out.
+// The followers of a private account are only listed to the account itself and to its followers: ErrPrivateAccount is
+// returned to anybody else.
+func (db *appdbimpl) GetFollowersByUsername(username string, viewerID string, page Page) ([]string, error) {
+	userID, err := db.GetUserIDByUsername(username)
 	if err != nil {
-		return nil, fmt.Errorf("error querying followers: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var followerID string
-		if err := rows.Scan(&followerID); err != nil {
-			return nil, fmt.Errorf("error scanning follower ID: %w", err)
-		}
-		followers = append(followers, followerID)
+	if err = db.checkAccountOpen(userID, viewerID); err != nil {
+		return nil, err
+	}
+	followers, err := db.queryIDs(`SELECT follower_id FROM followers
+        WHERE user_id = ? AND follower_id NOT IN (`+deletedUsersSQL+`)
+        ORDER BY rowid DESC LIMIT ? OFFSET ?`, userID, page.Limit, page.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("error querying followers: %w", err)
 	}
 	return followers, nil
 }
@@ -311,3 +281,105 @@ func (db *appdbimpl) IsUserFollowed(followedID, followerID string) (bool, error)
 	}
 	return exists, nil
 }
+
+// backfillUsernameKeys fills username_key for users created before it existed. When two old usernames differ only
+// by case, the user created last is renamed (see freeUsername), and its old username is recorded in the history like
+// any rename. Databases backfilled before then gave such users a key made of their own and their ID, which no username
+// can match: they are renamed the same way.
+func backfillUsernameKeys(db *sql.DB) error {
+	rows, err := db.Query(`SELECT user_id, username, username_key FROM users
+        WHERE username_key IS NULL OR instr(username_key, '#') > 0 ORDER BY rowid`)
+	if err != nil {
+		return fmt.Errorf("failed to query users without username key: %w", err)
+	}
+	var users []User
+	for rows.Next() {
+		var user User
+		var key sql.NullString
+		if err := rows.Scan(&user.ID, &user.Username, &key); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to scan user: %w", err)
+		}
+		// Old usernames may contain a #: their key is a real one
+		if !key.Valid || key.String == username.Key(user.Username)+"#"+user.ID {
+			users = append(users, user)
+		}
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iteration error: %w", err)
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := globaltime.Now().UTC()
+	for _, user := range users {
+		key := username.Key(user.Username)
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username_key = ? AND user_id != ?)", key, user.ID).
+			Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check username key: %w", err)
+		}
+		if !exists {
+			if _, err = tx.Exec("UPDATE users SET username_key = ? WHERE user_id = ?", key, user.ID); err != nil {
+				return fmt.Errorf("failed to set username key: %w", err)
+			}
+			continue
+		}
+
+		newUsername, err := freeUsername(tx, user.Username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE users SET username = ?, username_key = ? WHERE user_id = ?",
+			newUsername, username.Key(newUsername), user.ID)
+		if err != nil {
+			return fmt.Errorf("failed to rename user: %w", err)
+		}
+		_, err = tx.Exec(`INSERT INTO username_history (user_id, username, username_key, released_at)
+            VALUES (?, ?, ?, ?)`, user.ID, user.Username, key, now)
+		if err != nil {
+			return fmt.Errorf("failed to record username history: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// freeUsername returns a username that follows the policy and that nobody has or had: name (or "user", if name does
+// not follow the policy) followed by an underscore and the first number that makes it free, cut to fit.
+func freeUsername(tx *sql.Tx, name string) (string, error) {
+	base := username.Normalize(name)
+	if len(username.Validate(base)) > 0 {
+		base = "user"
+	}
+	for n := 2; ; n++ {
+		suffix := "_" + strconv.Itoa(n)
+		candidate := base
+		if len(candidate)+len(suffix) > username.MaxLength {
+			candidate = candidate[:username.MaxLength-len(suffix)]
+		}
+		candidate += suffix
+
+		var taken bool
+		err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username_key = @key)
+            OR EXISTS(SELECT 1 FROM username_history WHERE username_key = @key)`,
+			sql.Named("key", username.Key(candidate))).Scan(&taken)
+		if err != nil {
+			return "", fmt.Errorf("failed to check username: %w", err)
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+}
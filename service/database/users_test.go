@@ -0,0 +1,96 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/username"
+)
+
+// TestBackfillUsernameKeys opens databases made before usernames were compared regardless of case: users whose names
+// differ only by case from an older user's must be renamed to a valid username, with the old one in their history.
+func TestBackfillUsernameKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		users   [][]interface{}
+		want    map[string]string // username by user ID
+		renamed []string
+	}{
+		{
+			name:   "before username keys",
+			schema: `CREATE TABLE users (user_id TEXT PRIMARY KEY, username TEXT UNIQUE NOT NULL)`,
+			users: [][]interface{}{
+				{"u1", "Alice"}, {"u2", "alice"}, {"u3", "ALICE"}, {"u4", "bob#1"}, {"u5", "a very long name!"},
+				{"u6", "A very long name!"},
+			},
+			want: map[string]string{
+				"u1": "Alice", "u2": "alice_2", "u3": "ALICE_3", "u4": "bob#1", "u5": "a very long name!",
+				"u6": "user_2",
+			},
+			renamed: []string{"u2", "u3", "u6"},
+		},
+		{
+			name: "backfilled with unusable keys",
+			schema: `CREATE TABLE users (user_id TEXT PRIMARY KEY, username TEXT UNIQUE NOT NULL, username_key TEXT);
+                CREATE UNIQUE INDEX users_username_key ON users (username_key)`,
+			users: [][]interface{}{
+				{"u1", "Carol_the_great", "carol_the_great"}, {"u2", "carol_the_great", "carol_the_great#u2"},
+				{"u3", "dave#u3", "dave#u3"},
+			},
+			want:    map[string]string{"u1": "Carol_the_great", "u2": "carol_the_grea_2", "u3": "dave#u3"},
+			renamed: []string{"u2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := sql.Open("sqlite3", DataSourceName(filepath.Join(t.TempDir(), "test.db")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err = conn.Exec(tt.schema); err != nil {
+				t.Fatal(err)
+			}
+			for _, u := range tt.users {
+				query := `INSERT INTO users (user_id, username) VALUES (?, ?)`
+				if len(u) == 3 {
+					query = `INSERT INTO users (user_id, username, username_key) VALUES (?, ?, ?)`
+				}
+				if _, err = conn.Exec(query, u...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err = New(conn); err != nil {
+				t.Fatal(err)
+			}
+
+			for id, want := range tt.want {
+				var name, key string
+				if err = conn.QueryRow(`SELECT username, username_key FROM users WHERE user_id = ?`, id).Scan(&name, &key); err != nil {
+					t.Fatal(err)
+				}
+				if name != want || key != username.Key(want) {
+					t.Errorf("user %s is %q (key %q), want %q", id, name, key, want)
+				}
+			}
+			for _, id := range tt.renamed {
+				var n int
+				if err = conn.QueryRow(`SELECT COUNT(*) FROM username_history WHERE user_id = ?`, id).Scan(&n); err != nil {
+					t.Fatal(err)
+				}
+				if n != 1 {
+					t.Errorf("user %s has %d old usernames, want 1", id, n)
+				}
+				var name string
+				if err = conn.QueryRow(`SELECT username FROM users WHERE user_id = ?`, id).Scan(&name); err != nil {
+					t.Fatal(err)
+				}
+				if v := username.Validate(name); len(v) > 0 {
+					t.Errorf("user %s was renamed to %q, which %v", id, name, v)
+				}
+			}
+		})
+	}
+}
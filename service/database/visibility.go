@@ -0,0 +1,69 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// deletedUsersSQL selects the users who deleted their account and wait to be purged. Until then, their profile and
+// their content are seen by nobody (see account-deletion.go).
+const deletedUsersSQL = `SELECT user_id FROM users WHERE deleted_at IS NOT NULL`
+
+// photoVisibleSQL is the predicate deciding whether a photo can be seen by a user: photos hidden by the moderators, and
+// photos of deleted accounts, are seen by nobody, photos of private accounts only by their approved followers (see
+// accountOpenSQL), and every photo only by the audience its owner chose (see photoAudienceSQL). It is shared by every
+// query that reads photos, so that all of them agree on what a user is allowed to see. The query must alias the photo
+// table as `p` and bind the requesting user ID as the named parameter `viewer`.
+var photoVisibleSQL = `p.hidden_at IS NULL AND p.user_id NOT IN (` + deletedUsersSQL + `)
+    AND NOT EXISTS (
+        SELECT 1 FROM new_bans vb WHERE vb.banned_by = p.user_id AND vb.banned_user = @viewer
+    )
+    AND ` + accountOpenSQL("p.user_id") + `
+    AND ` + photoAudienceSQL
+
+// photoAudienceSQL is the part of photoVisibleSQL deciding whether the viewer is in the audience of a photo, given its
+// visibility level: owners see all their photos, archived (only-me) ones included.
+const photoAudienceSQL = `(p.user_id = @viewer OR p.visibility = '` + VisibilityPublic + `'
+        OR (p.visibility = '` + VisibilityFollowers + `' AND EXISTS (
+            SELECT 1 FROM followers af WHERE af.user_id = p.user_id AND af.follower_id = @viewer
+        ))
+        OR (p.visibility = '` + VisibilityCloseFriends + `' AND EXISTS (
+            SELECT 1 FROM close_friends ac WHERE ac.user_id = p.user_id AND ac.friend_id = @viewer
+        )))`
+
+// accountOpenSQL returns the predicate deciding whether the photos and the followers of the user in the column owner
+// can be seen by the user bound as `viewer`: those of public accounts can be seen by everybody, those of private
+// accounts only by the owner and its approved followers.
+func accountOpenSQL(owner string) string {
+	return `(` + owner + ` = @viewer
+        OR NOT EXISTS (SELECT 1 FROM users vu WHERE vu.user_id = ` + owner + ` AND vu.private)
+        OR EXISTS (SELECT 1 FROM followers vf WHERE vf.user_id = ` + owner + ` AND vf.follower_id = @viewer))`
+}
+
+// checkPhotoVisible returns ErrPhotoNotFound if the photo does not exist or cannot be seen by viewerID.
+func (db *appdbimpl) checkPhotoVisible(photoID, viewerID string) error {
+	var visible bool
+	err := db.c.QueryRow(`SELECT EXISTS(SELECT 1 FROM new_photos p WHERE p.photo_id = @photo AND `+photoVisibleSQL+`)`,
+		sql.Named("photo", photoID), sql.Named("viewer", viewerID)).Scan(&visible)
+	if err != nil {
+		return fmt.Errorf("failed to check photo visibility: %w", err)
+	}
+	if !visible {
+		return ErrPhotoNotFound
+	}
+	return nil
+}
+
+// checkAccountOpen returns ErrPrivateAccount if the account of userID is private and viewerID is neither its owner nor
+// one of its followers.
+func (db *appdbimpl) checkAccountOpen(userID, viewerID string) error {
+	var open bool
+	err := db.c.QueryRow(`SELECT `+accountOpenSQL("@user"), sql.Named("user", userID), sql.Named("viewer", viewerID)).Scan(&open)
+	if err != nil {
+		return fmt.Errorf("failed to check account visibility: %w", err)
+	}
+	if !open {
+		return ErrPrivateAccount
+	}
+	return nil
+}
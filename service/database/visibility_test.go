@@ -0,0 +1,50 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckPhotoVisible(t *testing.T) {
+	db := newTestDB(t)
+	ids := addUsers(t, db, "owner", "follower", "friend", "stranger")
+	for _, follower := range []string{"follower", "friend"} {
+		if _, err := db.FollowUser(ids[follower], ids["owner"]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.AddCloseFriend(ids["owner"], ids["friend"]); err != nil {
+		t.Fatal(err)
+	}
+	for _, visibility := range []string{VisibilityPublic, VisibilityFollowers, VisibilityCloseFriends, VisibilityOnlyMe} {
+		photo := Photo{ID: visibility, UserID: ids["owner"], Timestamp: time.Now(), Visibility: visibility}
+		if err := db.AddPhoto(photo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		visibility string
+		viewers    []string // Who can see the photo; the others cannot
+	}{
+		{VisibilityPublic, []string{"owner", "follower", "friend", "stranger"}},
+		{VisibilityFollowers, []string{"owner", "follower", "friend"}},
+		{VisibilityCloseFriends, []string{"owner", "friend"}},
+		{VisibilityOnlyMe, []string{"owner"}},
+	}
+	for _, tt := range tests {
+		allowed := map[string]bool{}
+		for _, viewer := range tt.viewers {
+			allowed[viewer] = true
+		}
+		for _, viewer := range []string{"owner", "follower", "friend", "stranger"} {
+			err := db.checkPhotoVisible(tt.visibility, ids[viewer])
+			if allowed[viewer] && err != nil {
+				t.Errorf("%s photo refused to %s: %v", tt.visibility, viewer, err)
+			} else if !allowed[viewer] && !errors.Is(err, ErrPhotoNotFound) {
+				t.Errorf("%s photo shown to %s (%v)", tt.visibility, viewer, err)
+			}
+		}
+	}
+}
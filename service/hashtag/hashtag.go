@@ -0,0 +1,73 @@
+/*
+Package hashtag contains the hashtag policy: how tags are found in captions, and how tags are compared.
+
+A tag is a # followed by letters, digits and underscores, at least one of them a letter, and not preceded by a letter,
+a digit, an underscore or another # (so that "a#b" and "##b" contain no tag). Tags are NFKC-normalized and compared
+case-insensitively: Key returns the value they are stored and compared with. Tags longer than MaxLength are not tags,
+and only the first MaxPerPhoto different tags of a caption count.
+*/
+package hashtag
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	MaxLength   = 50
+	MaxPerPhoto = 30
+)
+
+// Key returns the value used to compare tags, without the #: two tags with the same key are the same tag.
+func Key(tag string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimPrefix(tag, "#")))
+}
+
+// Valid reports whether key, as returned by Key, is a tag.
+func Valid(key string) bool {
+	if key == "" || utf8.RuneCountInString(key) > MaxLength {
+		return false
+	}
+	letter := false
+	for _, r := range key {
+		if !isTagRune(r) {
+			return false
+		}
+		letter = letter || unicode.IsLetter(r)
+	}
+	return letter
+}
+
+// Extract returns the keys of the tags in text, in order of first appearance and without repetitions.
+func Extract(text string) []string {
+	text = norm.NFKC.String(text)
+	var keys []string
+	seen := map[string]bool{}
+	prev := ' '
+	for i, r := range text {
+		if r == '#' && !isTagRune(prev) && prev != '#' {
+			rest := text[i+1:]
+			end := strings.IndexFunc(rest, func(r rune) bool { return !isTagRune(r) })
+			if end < 0 {
+				end = len(rest)
+			}
+			if key := Key(rest[:end]); Valid(key) && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+				if len(keys) == MaxPerPhoto {
+					break
+				}
+			}
+		}
+		prev = r
+	}
+	return keys
+}
+
+// isTagRune reports whether r can be part of a tag.
+func isTagRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
@@ -0,0 +1,204 @@
+/*
+Package fakeidp is an OpenID Connect identity provider that signs in anybody, for development and tests: it allows the
+login flow to be exercised offline, without registering the application at a real provider.
+
+The authorization endpoint takes the name of the user from the login_hint parameter, or asks for it with a form, and
+redirects back right away. The subject of the user is "fake|" followed by the name, so the same name is always the same
+identity. PKCE (S256) is required. ID tokens are not signed (their algorithm is "none"): package oidc does not need a
+signature for tokens received from the token endpoint.
+
+It is served by any http.Server, or by httptest.NewServer in tests:
+
+	idp := fakeidp.New()
+	srv := httptest.NewServer(idp)
+	idp.Issuer = srv.URL
+
+Never use it in production.
+*/
+package fakeidp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// codeLifetime is how long an authorization code can be exchanged
+const codeLifetime = time.Minute
+
+// Server is the fake identity provider. Issuer must be set to the URL where it is served before it is used.
+type Server struct {
+	Issuer string
+
+	mux *http.ServeMux
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+// grant is an authorization code waiting to be exchanged
+type grant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	name        string
+	expires     time.Time
+}
+
+// New returns a new fake identity provider.
+func New() *Server {
+	s := &Server{grants: make(map[string]grant)}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	s.mux.HandleFunc("/authorize", s.authorize)
+	s.mux.HandleFunc("/token", s.token)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                s.Issuer,
+		"authorization_endpoint":                s.Issuer + "/authorize",
+		"token_endpoint":                        s.Issuer + "/token",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+var form = template.Must(template.New("form").Parse(`<!DOCTYPE html>
+<title>Fake identity provider</title>
+<form method="get" action="authorize">
+{{range $k, $v := .}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+{{end}}<label>Sign in as <input name="login_hint" autofocus></label>
+<button>Sign in</button>
+</form>
+`))
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("client_id") == "" || q.Get("code_challenge_method") != "S256" ||
+		q.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	name := q.Get("login_hint")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = form.Execute(w, q)
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	for c, g := range s.grants {
+		if globaltime.Now().After(g.expires) {
+			delete(s.grants, c)
+		}
+	}
+	s.grants[code] = grant{
+		clientID:    q.Get("client_id"),
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		name:        name,
+		expires:     globaltime.Now().Add(codeLifetime),
+	}
+	s.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	clientID := r.PostForm.Get("client_id")
+	if user, _, ok := r.BasicAuth(); ok {
+		clientID, _ = url.QueryUnescape(user)
+	}
+
+	// Codes can be used only once
+	s.mu.Lock()
+	g, ok := s.grants[r.PostForm.Get("code")]
+	delete(s.grants, r.PostForm.Get("code"))
+	s.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" || globaltime.Now().After(g.expires) ||
+		g.clientID != clientID || g.redirectURI != r.PostForm.Get("redirect_uri") ||
+		g.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := globaltime.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":                s.Issuer,
+		"sub":                "fake|" + g.name,
+		"aud":                g.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.name,
+		"email":              g.name + "@fakeidp.invalid",
+		"email_verified":     true,
+	})
+	enc := base64.RawURLEncoding
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "fake-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     enc.EncodeToString(header) + "." + enc.EncodeToString(claims) + ".",
+	})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,250 @@
+/*
+Package oidc is a minimal OpenID Connect relying party, for the authorization code flow with PKCE.
+
+A Provider is configured with the issuer URL and the client credentials registered at the identity provider; endpoints
+are discovered from the issuer (`/.well-known/openid-configuration`) on first use. The login is split in two steps:
+
+  - AuthCodeURL returns the URL where the browser is sent to sign in. The caller must keep the state, the nonce and
+    the PKCE verifier (see NewLogin) until the identity provider redirects the browser back;
+  - Exchange trades the code received with the redirect for the identity of the user.
+
+The ID token is received directly from the token endpoint over TLS, so (as allowed by OpenID Connect Core, section
+3.1.3.7) its signature is not checked: the issuer, the audience, the expiration and the nonce are.
+
+The subpackage fakeidp contains an identity provider that can be used offline, in development and in tests.
+*/
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// ErrInvalidToken is returned by Exchange when the identity provider answered with an unacceptable ID token
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// Provider is an OpenID Connect identity provider
+type Provider struct {
+	// Name identifies the provider in the API paths (like /oidc/:provider/authorize)
+	Name string
+	// Issuer is the issuer URL of the provider
+	Issuer       string
+	ClientID     string
+	ClientSecret string // Empty for public clients
+	// RedirectURL is the URL of the callback, as registered at the provider
+	RedirectURL string
+
+	// Client is used for requests to the provider. If nil, a client with a short timeout is used.
+	Client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+}
+
+// Identity is the user identity asserted by a provider
+type Identity struct {
+	Issuer            string
+	Subject           string
+	PreferredUsername string
+	Email             string
+}
+
+// Login holds the values that must be kept between AuthCodeURL and Exchange
+type Login struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// NewLogin returns new random values for a login.
+func NewLogin() (Login, error) {
+	var l Login
+	for _, s := range []*string{&l.State, &l.Nonce, &l.Verifier} {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return l, fmt.Errorf("generating login values: %w", err)
+		}
+		*s = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return l, nil
+}
+
+func (p *Provider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return defaultClient
+}
+
+// discover returns the endpoints of the provider, fetching them on first use.
+func (p *Provider) discover() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	resp, err := p.client().Get(strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("fetching provider configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching provider configuration: %s", resp.Status)
+	}
+	var d discovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, fmt.Errorf("decoding provider configuration: %w", err)
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("provider configuration is for issuer %q, not %q", d.Issuer, p.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// AuthCodeURL returns the URL where the browser is sent to sign in at the provider.
+func (p *Provider) AuthCodeURL(l Login) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(l.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {l.State},
+		"nonce":                 {l.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades the authorization code for the identity of the user. l is the Login used to build the authorization
+// URL.
+func (p *Provider) Exchange(code string, l Login) (*Identity, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {l.Verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("building token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("requesting token: %s: %s", resp.Status, body)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("decoding token response: %w", err)
+	}
+	return p.checkIDToken(tokens.IDToken, l.Nonce)
+}
+
+// checkIDToken decodes the claims of an ID token received from the token endpoint, and checks them.
+func (p *Provider) checkIDToken(token string, nonce string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidToken)
+	}
+	var claims struct {
+		Issuer            string          `json:"iss"`
+		Subject           string          `json:"sub"`
+		Audience          json.RawMessage `json:"aud"`
+		Expiry            int64           `json:"exp"`
+		Nonce             string          `json:"nonce"`
+		PreferredUsername string          `json:"preferred_username"`
+		Email             string          `json:"email"`
+		EmailVerified     bool            `json:"email_verified"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+
+	// The audience is either a string or an array of strings
+	var audience []string
+	if err := json.Unmarshal(claims.Audience, &audience); err != nil {
+		audience = make([]string, 1)
+		if err := json.Unmarshal(claims.Audience, &audience[0]); err != nil {
+			return nil, fmt.Errorf("%w: malformed audience", ErrInvalidToken)
+		}
+	}
+	var forUs bool
+	for _, aud := range audience {
+		forUs = forUs || aud == p.ClientID
+	}
+
+	switch {
+	case claims.Issuer != p.Issuer:
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	case !forUs:
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	case globaltime.Now().Unix() >= claims.Expiry:
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	id := &Identity{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		PreferredUsername: claims.PreferredUsername,
+	}
+	if claims.EmailVerified {
+		id.Email = claims.Email
+	}
+	return id, nil
+}
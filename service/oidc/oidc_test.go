@@ -0,0 +1,186 @@
+package oidc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc/fakeidp"
+)
+
+// newFakeProvider serves a fake identity provider for the duration of the test, and returns a provider using it.
+func newFakeProvider(t *testing.T) *Provider {
+	t.Helper()
+	idp := fakeidp.New()
+	srv := httptest.NewServer(idp)
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+	return &Provider{
+		Name:        "fake",
+		Issuer:      srv.URL,
+		ClientID:    "decaf",
+		RedirectURL: "http://decaf.invalid/oidc/fake/callback",
+		Client:      srv.Client(),
+	}
+}
+
+// authorize signs in as name at the provider, like a browser sent to the URL returned by AuthCodeURL, and returns the
+// code and the state sent back to the redirect URL.
+func authorize(t *testing.T, p *Provider, l Login, name string) (string, string) {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := *p.Client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL + "&login_hint=" + url.QueryEscape(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization answered %s", resp.Status)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := back.Scheme + "://" + back.Host + back.Path; got != p.RedirectURL {
+		t.Fatalf("redirected to %s, want %s", got, p.RedirectURL)
+	}
+	return back.Query().Get("code"), back.Query().Get("state")
+}
+
+func TestExchange(t *testing.T) {
+	p := newFakeProvider(t)
+	l, err := NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := authorize(t, p, l, "alice")
+	if state != l.State {
+		t.Errorf("state = %q, want %q", state, l.State)
+	}
+
+	id, err := p.Exchange(code, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{Issuer: p.Issuer, Subject: "fake|alice", PreferredUsername: "alice", Email: "alice@fakeidp.invalid"}
+	if *id != want {
+		t.Errorf("identity = %+v, want %+v", *id, want)
+	}
+
+	// Codes can be used only once
+	if _, err = p.Exchange(code, l); err == nil {
+		t.Error("a code was exchanged twice")
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		tamper    func(l *Login)
+		tokenFail bool // Whether the ID token must be refused (ErrInvalidToken) rather than the code
+	}{
+		{"wrong nonce", func(l *Login) { l.Nonce = "another nonce" }, true},
+		{"wrong verifier", func(l *Login) { l.Verifier = "another verifier" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakeProvider(t)
+			l, err := NewLogin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, _ := authorize(t, p, l, "alice")
+			tt.tamper(&l)
+			_, err = p.Exchange(code, l)
+			if err == nil {
+				t.Fatal("exchange succeeded")
+			}
+			if errors.Is(err, ErrInvalidToken) != tt.tokenFail {
+				t.Errorf("error = %v", err)
+			}
+		})
+	}
+}
+
+func TestDiscoveryWrongIssuer(t *testing.T) {
+	p := newFakeProvider(t)
+	p.Issuer += "/elsewhere"
+	if _, err := p.AuthCodeURL(Login{}); err == nil {
+		t.Error("the configuration of another issuer was accepted")
+	}
+}
+
+func TestCheckIDToken(t *testing.T) {
+	p := &Provider{Issuer: "https://idp.invalid", ClientID: "decaf"}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":                p.Issuer,
+			"sub":                "1234",
+			"aud":                "decaf",
+			"exp":                time.Now().Add(time.Minute).Unix(),
+			"nonce":              "n",
+			"preferred_username": "alice",
+			"email":              "alice@example.com",
+			"email_verified":     false,
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(claims map[string]interface{})
+		ok     bool
+	}{
+		{"valid", func(map[string]interface{}) {}, true},
+		{"audience list", func(c map[string]interface{}) { c["aud"] = []string{"other", "decaf"} }, true},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.invalid" }, false},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "other" }, false},
+		{"wrong audience list", func(c map[string]interface{}) { c["aud"] = []string{"other"} }, false},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, false},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "m" }, false},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			tt.change(claims)
+			id, err := p.checkIDToken(idToken(t, claims), "n")
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Errorf("error = %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Unverified addresses are not trusted
+			if id.Subject != "1234" || id.PreferredUsername != "alice" || id.Email != "" {
+				t.Errorf("identity = %+v", *id)
+			}
+		})
+	}
+
+	if _, err := p.checkIDToken("not a token", "n"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("malformed token: error = %v, want ErrInvalidToken", err)
+	}
+}
+
+// idToken returns an unsigned ID token with the given claims.
+func idToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString(payload) + "."
+}
@@ -0,0 +1,99 @@
+/*
+Package password contains the password policy, and hashes passwords for storage.
+
+Passwords are hashed with Argon2id, a memory-hard KDF, using a random salt per password. The parameters are stored
+alongside the hash (in the PHC string format, like `$argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>`), so they can be
+raised later without invalidating the passwords already stored.
+*/
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	MinLength = 8
+	MaxLength = 128
+
+	// ResetTokenLifetime is how long a password reset token can be used after it is sent
+	ResetTokenLifetime = time.Hour
+)
+
+// Argon2id parameters for new hashes, as recommended by RFC 9106 for memory-constrained environments
+const (
+	memory     = 64 * 1024 // KiB
+	iterations = 1
+	threads    = 4
+	saltLen    = 16
+	keyLen     = 32
+)
+
+// ErrMalformedHash is returned by Verify when the stored hash cannot be parsed
+var ErrMalformedHash = errors.New("malformed password hash")
+
+var b64 = base64.RawStdEncoding
+
+// dummyHash is verified when there is no hash to check the password against, so that the answer takes the same time
+// whether the account exists or not.
+var dummyHash, _ = Hash("dummy password")
+
+// Validate returns the reasons why pw is not an acceptable password, or nil if it is.
+func Validate(pw string) []string {
+	if n := utf8.RuneCountInString(pw); n < MinLength || n > MaxLength {
+		return []string{"must be between 8 and 128 characters long"}
+	}
+	return nil
+}
+
+// Hash returns the encoded Argon2id hash of pw, with a new random salt.
+func Hash(pw string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generating salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(pw), salt, iterations, memory, threads, keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, memory, iterations, threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// Verify reports whether pw matches the encoded hash. An empty hash (no password set) never matches.
+func Verify(pw, encoded string) (bool, error) {
+	if encoded == "" {
+		_, _ = Verify(pw, dummyHash)
+		return false, nil
+	}
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, ErrMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrMalformedHash
+	}
+	var m, t uint32
+	var p uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+		return false, ErrMalformedHash
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrMalformedHash
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return false, ErrMalformedHash
+	}
+
+	other := argon2.IDKey([]byte(pw), salt, t, m, p, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
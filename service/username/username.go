@@ -0,0 +1,104 @@
+/*
+Package username contains the username policy: which names are accepted, and how names are compared.
+
+Usernames are normalized with Unicode NFKC (so that, for example, full-width letters become plain ASCII) and must then
+be 3 to 16 characters among letters, digits and underscore, as documented in `doc/api.yaml`. Two usernames that differ
+only by case are the same username: Key returns the value used to compare them. Some names (see reserved) cannot be
+used because they would be confused with API paths or with the staff.
+
+Users are mentioned in captions and comments by writing their username after an @, not preceded by a letter, a digit
+or an underscore (so that e-mail addresses mention nobody): Mentions finds them.
+
+When a user changes username, the old one is not released right away: it keeps pointing to the user for GracePeriod,
+and nobody else can claim it for Cooldown. Users can change username at most MaxRenames times every RenameWindow.
+*/
+package username
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	MinLength = 3
+	MaxLength = 16
+
+	// GracePeriod is how long an old username keeps resolving to the user who released it
+	GracePeriod = 14 * 24 * time.Hour
+	// Cooldown is how long an old username cannot be claimed by other users. It is longer than GracePeriod, so that
+	// old links never resolve to somebody else.
+	Cooldown = 30 * 24 * time.Hour
+
+	// MaxMentions is how many users a text can mention: further mentions are ignored
+	MaxMentions = 10
+
+	// MaxRenames is how many times a user can change username in RenameWindow
+	MaxRenames   = 3
+	RenameWindow = 30 * 24 * time.Hour
+)
+
+var charset = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// mention matches a mention, with the character before it (if any) in the first group and the name in the second one
+var mention = regexp.MustCompile(`(^|[^a-zA-Z0-9_@])@([a-zA-Z0-9_]+)`)
+
+// reserved lists the names (as keys) that nobody can use
+var reserved = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"me":            true,
+	"moderator":     true,
+	"root":          true,
+	"support":       true,
+	"system":        true,
+}
+
+// Normalize returns the form of name that is stored: NFKC-normalized, without leading and trailing spaces.
+func Normalize(name string) string {
+	return strings.TrimSpace(norm.NFKC.String(name))
+}
+
+// Key returns the value used to compare usernames: two names with the same key are the same username.
+func Key(name string) string {
+	return strings.ToLower(Normalize(name))
+}
+
+// Validate returns the reasons why name is not an acceptable username, or nil if it is.
+func Validate(name string) []string {
+	name = Normalize(name)
+
+	var violations []string
+	if n := utf8.RuneCountInString(name); n < MinLength || n > MaxLength {
+		violations = append(violations, "must be between 3 and 16 characters long")
+	}
+	if !charset.MatchString(name) {
+		violations = append(violations, "must contain only letters, digits and underscores")
+	}
+	if reserved[Key(name)] {
+		violations = append(violations, "is reserved")
+	}
+	return violations
+}
+
+// Mentions returns the keys of the usernames mentioned in text, in order of first appearance and without repetitions.
+// Names that cannot be usernames are left out, but the names are not checked to belong to users.
+func Mentions(text string) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, m := range mention.FindAllStringSubmatch(Normalize(text), -1) {
+		name := m[2]
+		if n := len(name); n < MinLength || n > MaxLength || seen[Key(name)] {
+			continue
+		}
+		seen[Key(name)] = true
+		keys = append(keys, Key(name))
+		if len(keys) == MaxMentions {
+			break
+		}
+	}
+	return keys
+}
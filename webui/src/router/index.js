@@ -22,7 +22,7 @@ const router = createRouter({
 
 router.beforeEach((to, from, next) => {
 	const requiresAuth = to.matched.some(record => record.meta.requiresAuth);
-	const isAuthenticated = localStorage.getItem('userId');
+	const isAuthenticated = localStorage.getItem('token');
   
 	if (requiresAuth && !isAuthenticated) {
 	  next('/login');